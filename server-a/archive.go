@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// uploadArchive accepts a single .zip, .tar, .tar.gz or .tar.zst file in the
+// "archive" form field and has the storage nodes extract it into a new
+// codebase.
+func (s *Server) uploadArchive(w http.ResponseWriter, r *http.Request) {
+	owner, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	// What an archive holds is only known once extracted, so it is checked
+	// against the quotas when recorded
+	if _, ok := s.budget(w, owner, "", false); !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	// Generate UUID for the new codebase
+	codebaseID := uuid.New().String()
+
+	attempts, err := s.streamToStorage(r.Context(), s.placement(codebaseID), "/extract", func(writer *multipart.Writer) error {
+		return copyArchivePart(writer, codebaseID, s.excludes, reader)
+	})
+	var stages []replicaStage
+	var results []FileResult
+	if err == nil {
+		stages, results, err = s.settleStages(attempts)
+	}
+	if errors.Is(err, errNoFiles) {
+		respondWithError(w, http.StatusBadRequest, "No archive uploaded")
+		return
+	}
+	if errors.Is(err, errInvalidForm) {
+		respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+		return
+	}
+	var se *storageError
+	if errors.As(err, &se) && se.Files != nil {
+		respondWithRejectedUpload(w, se)
+		return
+	}
+	if err != nil {
+		respondWithStorageError(w, err, "Failed to extract archive")
+		return
+	}
+
+	// Store metadata in database, then make the extracted files visible
+	files := storedFiles(results)
+	if !s.commitStaged(w, stages, codebaseID, s.withinQuota(owner, codebaseID, files, func(tx *sql.Tx) error {
+		return insertCodebase(tx, codebaseID, owner, files)
+	})) {
+		return
+	}
+
+	respondWithUpload(w, codebaseID, results)
+}
+
+// copyArchivePart forwards the codebase ID and the server-wide excludes
+// followed by the first archive part; any other fields are ignored.
+func copyArchivePart(writer *multipart.Writer, codebaseID string, excludes []string, reader *multipart.Reader) error {
+	if err := writer.WriteField("codebase_id", codebaseID); err != nil {
+		return err
+	}
+	if err := writeExcludes(writer, excludes); err != nil {
+		return err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return errNoFiles
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidForm, err)
+		}
+
+		if part.FormName() != "archive" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		dst, err := writer.CreateFormFile("archive", part.FileName())
+		if err != nil {
+			return err
+		}
+		if _, err := copyPart(dst, part); err != nil {
+			return err
+		}
+		return part.Close()
+	}
+}
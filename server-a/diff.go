@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// diffCodebases handles GET /codebases/{id}/diff, listing the files added,
+// removed and modified in a codebase relative to the codebase given by
+// against, with unified diffs of text files. rev and against_rev select
+// revisions; without against and against_rev the previous revision of the
+// codebase is used. format=patch downloads the whole diff as a .patch file.
+func (s *Server) diffCodebases(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid directory ID")
+		return
+	}
+
+	params := url.Values{}
+	against := query.Get("against")
+	if against != "" {
+		if _, err := uuid.Parse(against); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid directory ID to compare against")
+			return
+		}
+		params.Set("against", against)
+	}
+	for _, name := range []string{"rev", "against_rev"} {
+		if value := query.Get(name); value != "" {
+			if revision, err := strconv.Atoi(value); err != nil || revision < 1 {
+				respondWithError(w, http.StatusBadRequest, "Invalid revision")
+				return
+			}
+			params.Set(name, value)
+		}
+	}
+	if format := query.Get("format"); format != "" {
+		if format != "json" && format != "patch" {
+			respondWithError(w, http.StatusBadRequest, "Format must be json or patch")
+			return
+		}
+		params.Set("format", format)
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+	if against != "" && against != codebaseID {
+		// A node holding both codebases compares them itself; otherwise it
+		// copies the revision to compare against from a node holding it
+		others, ok := s.codebaseReplicas(w, against)
+		if !ok {
+			return
+		}
+		var common []string
+		for _, node := range nodes {
+			if containsNode(others, node) {
+				common = append(common, node)
+			}
+		}
+		if len(common) > 0 {
+			nodes = common
+		} else {
+			params.Set("against_nodes", strings.Join(others, ","))
+		}
+	}
+
+	// Forward request to storage, failing over between replicas
+	resp, err := s.getFromReplicas(r.Context(), nodes, fmt.Sprintf("/diff/%s?%s", codebaseID, params.Encode()), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve diff from storage")
+		return
+	}
+	defer resp.Body.Close()
+
+	// Copy headers and response
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errCodebaseNotFound = errors.New("codebase not found")
+	// errPendingCommits refuses a change while an earlier one is still
+	// being committed on storage, where the two could apply in the other
+	// order than they were recorded.
+	errPendingCommits = errors.New("codebase has changes still being committed")
+)
+
+// addCodebaseFiles handles POST /codebases/{id}/files, adding the files of a
+// multipart upload to an existing codebase. It accepts the same form as
+// /upload; files at paths that already exist are replaced.
+func (s *Server) addCodebaseFiles(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+	owner, ok := s.codebaseOwner(w, codebaseID)
+	if !ok {
+		return
+	}
+	budget, ok := s.budget(w, owner, codebaseID, true)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	stages, results, err := s.forwardFilesToStorage(r.Context(), nodes, codebaseID, 0, reader, budget)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	files := storedFiles(results)
+	if !s.commitStaged(w, stages, codebaseID, s.withinQuota(owner, codebaseID, files, func(tx *sql.Tx) error {
+		return upsertFiles(tx, codebaseID, files)
+	})) {
+		return
+	}
+
+	respondWithUpload(w, codebaseID, results)
+}
+
+// putCodebaseFile handles PUT /codebases/{id}/files?file=path, creating or
+// replacing a single file with the request body.
+func (s *Server) putCodebaseFile(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+
+	filePath := r.URL.Query().Get("file")
+	if filePath == "" {
+		respondWithError(w, http.StatusBadRequest, "File path is required")
+		return
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+	owner, ok := s.codebaseOwner(w, codebaseID)
+	if !ok {
+		return
+	}
+	budget, ok := s.budget(w, owner, codebaseID, true)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	// A single file cannot collide with another, so the legacy path field
+	// is enough to name it
+	stages, results, err := s.stageFiles(r.Context(), nodes, func(writer *multipart.Writer) error {
+		if err := writer.WriteField("codebase_id", codebaseID); err != nil {
+			return err
+		}
+		fileName := path.Base(filePath)
+		if err := writer.WriteField("path_"+fileName, filePath); err != nil {
+			return err
+		}
+		if err := writeExcludes(writer, s.excludes); err != nil {
+			return err
+		}
+		if err := budget.file(filePath); err != nil {
+			return err
+		}
+		dst, err := writer.CreateFormFile("files", fileName)
+		if err != nil {
+			return err
+		}
+		_, err = copyPart(budget.limit(dst, filePath), r.Body)
+		return err
+	})
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	files := storedFiles(results)
+	if !s.commitStaged(w, stages, codebaseID, s.withinQuota(owner, codebaseID, files, func(tx *sql.Tx) error {
+		return upsertFiles(tx, codebaseID, files)
+	})) {
+		return
+	}
+
+	respondWithUpload(w, codebaseID, results)
+}
+
+// deleteCodebaseFile handles DELETE /codebases/{id}/files?file=path. The
+// removal is staged on storage and committed like an upload, so metadata
+// and storage stay in step.
+func (s *Server) deleteCodebaseFile(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+
+	filePath := r.URL.Query().Get("file")
+	if filePath == "" {
+		respondWithError(w, http.StatusBadRequest, "File path is required")
+		return
+	}
+
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM files JOIN codebases ON codebases.id = files.codebase_id
+		WHERE codebase_id = $1 AND file_path = $2 AND files.revision = codebases.revision)`,
+		codebaseID, filePath).Scan(&exists)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query files")
+		return
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "File not found")
+		return
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	stages, err := s.stageRemoval(r.Context(), nodes, removalRequest{CodebaseID: codebaseID, Delete: []string{filePath}})
+	if err != nil {
+		respondWithStorageError(w, err, "Failed to delete file from storage")
+		return
+	}
+
+	if !s.commitStaged(w, stages, codebaseID, func(tx *sql.Tx) error {
+		revision, err := lockIdleCodebase(tx, codebaseID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM files WHERE codebase_id = $1 AND revision = $2 AND file_path = $3",
+			codebaseID, revision, filePath)
+		if err != nil {
+			return fmt.Errorf("delete file %s: %w", filePath, err)
+		}
+		return syncFileCount(tx, codebaseID, revision)
+	}) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"message":      fmt.Sprintf("Deleted %s", filePath),
+		"directory_id": codebaseID,
+	})
+}
+
+// deleteCodebase handles DELETE /codebases/{id}. The codebase and its file
+// rows are deleted in the same transaction that records the staged removal
+// of its directory; storage removes the directory once downloads of it in
+// progress have finished.
+func (s *Server) deleteCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+
+	// A change still being committed would recreate the directory
+	pending, err := hasPendingCommits(s.db, codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query pending commits")
+		return
+	}
+	if pending {
+		respondWithError(w, http.StatusConflict, "Codebase has changes still being committed, try again shortly")
+		return
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	stages, err := s.stageRemoval(r.Context(), nodes, removalRequest{CodebaseID: codebaseID, DeleteCodebase: true})
+	if err != nil {
+		respondWithStorageError(w, err, "Failed to delete codebase from storage")
+		return
+	}
+
+	if !s.commitStaged(w, stages, codebaseID, func(tx *sql.Tx) error {
+		if _, err := lockIdleCodebase(tx, codebaseID); err != nil {
+			return err
+		}
+		// Files are removed by ON DELETE CASCADE
+		_, err := tx.Exec("DELETE FROM codebases WHERE id = $1", codebaseID)
+		return err
+	}) {
+		return
+	}
+
+	log.Printf("Deleted codebase: %s", codebaseID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"message":      "Codebase deleted",
+		"directory_id": codebaseID,
+	})
+}
+
+// existingCodebase validates the codebase ID in the URL and checks that the
+// codebase exists, writing an error response if not.
+func (s *Server) existingCodebase(w http.ResponseWriter, r *http.Request) (string, bool) {
+	codebaseID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid directory ID")
+		return "", false
+	}
+
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM codebases WHERE id = $1)", codebaseID).Scan(&exists)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query codebase")
+		return "", false
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "Codebase not found")
+		return "", false
+	}
+	return codebaseID, true
+}
+
+type removalRequest struct {
+	CodebaseID     string   `json:"codebase_id"`
+	Delete         []string `json:"delete,omitempty"`
+	DeleteCodebase bool     `json:"delete_codebase,omitempty"`
+}
+
+// stageRemoval asks the nodes holding a codebase to stage the removal of
+// files or of the whole codebase.
+func (s *Server) stageRemoval(ctx context.Context, nodes []string, req removalRequest) ([]replicaStage, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := make([]stageAttempt, len(nodes))
+	for i, node := range nodes {
+		attempts[i] = s.postStage(ctx, node, "/stages", body)
+	}
+
+	stages, _, err := s.settleStages(attempts)
+	return stages, err
+}
+
+// postStage posts a JSON request creating a stage to node and reads the
+// stage ID and per-file results it answers with.
+func (s *Server) postStage(ctx context.Context, node, endpoint string, body []byte) stageAttempt {
+	attempt := stageAttempt{replicaStage: replicaStage{Node: node}}
+	resp, err := s.postToStorage(ctx, node+endpoint, "application/json", bytes.NewReader(body))
+	s.health.record(node, err)
+	if err != nil {
+		attempt.Err = err
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		attempt.Err = readStorageError(resp)
+		return attempt
+	}
+
+	var staged struct {
+		StageID string       `json:"stage_id"`
+		Files   []FileResult `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&staged); err != nil || staged.StageID == "" {
+		attempt.Err = fmt.Errorf("invalid response from storage server")
+		return attempt
+	}
+	attempt.StageID = staged.StageID
+	attempt.Files = staged.Files
+	return attempt
+}
+
+// upsertFiles records files added to the latest revision of an existing
+// codebase, replacing the rows of files stored at the same paths.
+func upsertFiles(tx *sql.Tx, codebaseID string, files []FileInfo) error {
+	revision, err := lockIdleCodebase(tx, codebaseID)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		_, err := tx.Exec("DELETE FROM files WHERE codebase_id = $1 AND revision = $2 AND file_path = $3",
+			codebaseID, revision, f.Path)
+		if err != nil {
+			return fmt.Errorf("replace file %s: %w", f.Path, err)
+		}
+	}
+	if err := insertFiles(tx, codebaseID, revision, files); err != nil {
+		return err
+	}
+
+	return syncFileCount(tx, codebaseID, revision)
+}
+
+// lockCodebase locks a codebase row until tx ends, so concurrent changes to
+// its files are applied one at a time, and returns its latest revision.
+func lockCodebase(tx *sql.Tx, codebaseID string) (int, error) {
+	var revision int
+	err := tx.QueryRow("SELECT revision FROM codebases WHERE id = $1 FOR UPDATE", codebaseID).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return 0, errCodebaseNotFound
+	}
+	return revision, err
+}
+
+// lockIdleCodebase locks a codebase row like lockCodebase, failing with
+// errPendingCommits if a change to it is still being committed on storage.
+func lockIdleCodebase(tx *sql.Tx, codebaseID string) (int, error) {
+	revision, err := lockCodebase(tx, codebaseID)
+	if err != nil {
+		return 0, err
+	}
+	pending, err := hasPendingCommits(tx, codebaseID)
+	if err != nil {
+		return 0, err
+	}
+	if pending {
+		return 0, errPendingCommits
+	}
+	return revision, nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func hasPendingCommits(q queryRower, codebaseID string) (bool, error) {
+	var pending bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM pending_commits WHERE codebase_id = $1)", codebaseID).Scan(&pending)
+	return pending, err
+}
+
+// syncFileCount recounts the files of a revision, which is the latest.
+func syncFileCount(tx *sql.Tx, codebaseID string, revision int) error {
+	_, err := tx.Exec(`UPDATE revisions SET file_count = (SELECT COUNT(*) FROM files WHERE codebase_id = $1 AND revision = $2)
+		WHERE codebase_id = $1 AND revision = $2`,
+		codebaseID, revision)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE codebases SET file_count = (SELECT file_count FROM revisions WHERE codebase_id = $1 AND revision = $2) WHERE id = $1",
+		codebaseID, revision)
+	return err
+}
@@ -1,16 +1,19 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,30 +23,86 @@ import (
 
 const (
 	MaxUploadSize = 100 << 20 // 100MB
+	MaxFieldSize  = 4 << 10   // 4KB
+)
+
+var (
+	errNoFiles       = errors.New("no files uploaded")
+	errInvalidForm   = errors.New("invalid form data")
+	errStorageClosed = errors.New("storage server closed the upload stream")
 )
 
 type Server struct {
-	db               *sql.DB
-	storageServerURL string
+	db             *sql.DB
+	storageNodes   []string     // Server B instances
+	replicas       int          // how many nodes store each codebase
+	writeQuorum    int          // how many of them must stage a change
+	client         *http.Client // for every request to the storage nodes
+	health         nodeHealth
+	quotas         Quotas
+	excludes       []string // .gitignore patterns left out of every upload
+	adminToken     string
+	proxySecret    string // lets the authenticating proxy name users
+	reconciler     reconciler
+	statsRefresher statsRefresher
 }
 
 type UploadResponse struct {
-	Success       bool     `json:"success"`
-	Message       string   `json:"message"`
-	DirectoryID   string   `json:"directory_id,omitempty"`
-	UploadedFiles []string `json:"uploaded_files,omitempty"`
+	Success       bool         `json:"success"`
+	Message       string       `json:"message"`
+	DirectoryID   string       `json:"directory_id,omitempty"`
+	UploadedFiles []string     `json:"uploaded_files,omitempty"`
+	AcceptedFiles []FileResult `json:"accepted_files,omitempty"`
+	RejectedFiles []FileResult `json:"rejected_files,omitempty"`
+	IgnoredFiles  []FileResult `json:"ignored_files,omitempty"`
 }
 
 type FileInfo struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-	Path string `json:"path"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Path     string `json:"path"`
+	SHA256   string `json:"sha256,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// FileResult is the outcome storage reports for one uploaded file.
+type FileResult struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+const (
+	fileStored   = "stored"
+	fileRejected = "rejected"
+	fileIgnored  = "ignored"
+)
+
+// storedFiles returns the files that storage actually kept.
+func storedFiles(results []FileResult) []FileInfo {
+	var files []FileInfo
+	for _, r := range results {
+		if r.Status == fileStored {
+			files = append(files, FileInfo{Name: r.Name, Size: r.Size, Path: r.Path, SHA256: r.SHA256,
+				MIMEType: r.MIMEType, Language: r.Language})
+		}
+	}
+	return files
 }
 
 type Codebase struct {
-	ID        string    `json:"directory_id"`
-	CreatedAt time.Time `json:"created_at"`
-	FileCount int       `json:"file_count"`
+	ID        string          `json:"directory_id"`
+	Owner     string          `json:"owner"`
+	CreatedAt time.Time       `json:"created_at"`
+	FileCount int             `json:"file_count"`
+	Revision  int             `json:"revision"`
+	Languages []LanguageShare `json:"languages,omitempty"` // largest languages, once computed
 }
 
 func NewServer() *Server {
@@ -52,9 +111,18 @@ func NewServer() *Server {
 		dbURL = "user=postgres password=password dbname=postgres sslmode=disable"
 	}
 
-	storageServerURL := os.Getenv("SERVER_B_URL")
-	if storageServerURL == "" {
-		storageServerURL = "http://localhost:8081"
+	storageNodes := storageNodesFromEnv()
+	replicas, writeQuorum, err := replicationFromEnv(len(storageNodes))
+	if err != nil {
+		log.Fatalf("Invalid replication settings: %v", err)
+	}
+	quotas, err := quotasFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid quota settings: %v", err)
+	}
+	client, err := storageClientFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid storage settings: %v", err)
 	}
 
 	db, err := sql.Open("postgres", dbURL)
@@ -67,8 +135,15 @@ func NewServer() *Server {
 	}
 
 	server := &Server{
-		db:               db,
-		storageServerURL: storageServerURL,
+		db:           db,
+		storageNodes: storageNodes,
+		client:       client,
+		replicas:     replicas,
+		writeQuorum:  writeQuorum,
+		quotas:       quotas,
+		excludes:     uploadExcludesFromEnv(),
+		adminToken:   os.Getenv("ADMIN_TOKEN"),
+		proxySecret:  os.Getenv("TRUSTED_PROXY_SECRET"),
 	}
 	server.initDB()
 	return server
@@ -92,18 +167,106 @@ func (s *Server) initDB() {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_files_codebase_id ON files(codebase_id);
+
+	ALTER TABLE files ADD COLUMN IF NOT EXISTS sha256 TEXT;
+
+	ALTER TABLE codebases ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 1;
+	ALTER TABLE files ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 1;
+
+	CREATE INDEX IF NOT EXISTS idx_files_codebase_revision ON files(codebase_id, revision);
+
+	CREATE TABLE IF NOT EXISTS revisions (
+		codebase_id UUID REFERENCES codebases(id) ON DELETE CASCADE,
+		revision INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		file_count INTEGER DEFAULT 0,
+		PRIMARY KEY (codebase_id, revision)
+	);
+
+	INSERT INTO revisions (codebase_id, revision, created_at, file_count)
+		SELECT id, revision, created_at, file_count FROM codebases
+		ON CONFLICT DO NOTHING;
+
+	CREATE TABLE IF NOT EXISTS pending_commits (
+		stage_id UUID PRIMARY KEY,
+		codebase_id UUID NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id UUID PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		codebase_id UUID REFERENCES codebases(id) ON DELETE SET NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS codebase_replicas (
+		codebase_id UUID REFERENCES codebases(id) ON DELETE CASCADE,
+		node TEXT NOT NULL,
+		PRIMARY KEY (codebase_id, node)
+	);
+
+	CREATE TABLE IF NOT EXISTS upload_session_replicas (
+		session_id UUID REFERENCES upload_sessions(id) ON DELETE CASCADE,
+		node TEXT NOT NULL,
+		PRIMARY KEY (session_id, node)
+	);
+
+	ALTER TABLE pending_commits ADD COLUMN IF NOT EXISTS node TEXT;
+
+	ALTER TABLE codebases ADD COLUMN IF NOT EXISTS placement TEXT[];
+
+	ALTER TABLE codebases ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT 'anonymous';
+	ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS owner TEXT NOT NULL DEFAULT 'anonymous';
+	ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS planned_codebase_id UUID;
+	CREATE INDEX IF NOT EXISTS idx_codebases_owner ON codebases(owner);
+
+	ALTER TABLE files ADD COLUMN IF NOT EXISTS mime_type TEXT;
+	ALTER TABLE files ADD COLUMN IF NOT EXISTS language TEXT;
+
+	ALTER TABLE codebases ADD COLUMN IF NOT EXISTS generation INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS codebase_stats (
+		codebase_id UUID REFERENCES codebases(id) ON DELETE CASCADE,
+		revision INTEGER NOT NULL,
+		generation INTEGER NOT NULL,
+		stats JSONB NOT NULL,
+		computed_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (codebase_id, revision)
+	);
 	`
 
 	if _, err := s.db.Exec(query); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+
+	// Everything stored before replication is on the first storage node
+	for _, backfill := range []string{
+		`INSERT INTO codebase_replicas (codebase_id, node) SELECT id, $1 FROM codebases
+			WHERE NOT EXISTS (SELECT 1 FROM codebase_replicas WHERE codebase_id = codebases.id)`,
+		`INSERT INTO upload_session_replicas (session_id, node) SELECT id, $1 FROM upload_sessions
+			WHERE NOT EXISTS (SELECT 1 FROM upload_session_replicas WHERE session_id = upload_sessions.id)`,
+		"UPDATE pending_commits SET node = $1 WHERE node IS NULL",
+	} {
+		if _, err := s.db.Exec(backfill, s.storageNodes[0]); err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+	}
+
+	// Codebases stored before placement was recorded are placed where they
+	// are
+	_, err := s.db.Exec(`UPDATE codebases SET placement = ARRAY(
+		SELECT node FROM codebase_replicas WHERE codebase_id = codebases.id ORDER BY node)
+		WHERE placement IS NULL`)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
 }
 
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Upload-Offset")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -114,141 +277,404 @@ func enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) uploadCodebase(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+// requireAdmin rejects requests without the configured ADMIN_TOKEN as a
+// bearer token. Admin endpoints are open when no token is configured.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken != "" && r.Header.Get("Authorization") != "Bearer "+s.adminToken {
+			respondWithError(w, http.StatusUnauthorized, "Admin token required")
+			return
+		}
+		next(w, r)
+	}
+}
 
-	if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
-		respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+func (s *Server) uploadCodebase(w http.ResponseWriter, r *http.Request) {
+	owner, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	budget, ok := s.budget(w, owner, "", false)
+	if !ok {
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		respondWithError(w, http.StatusBadRequest, "No files uploaded")
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid form data")
 		return
 	}
 
 	// Generate UUID for the new codebase
 	codebaseID := uuid.New().String()
 
-	// Forward files to storage server
-	uploadedFiles, err := s.forwardFilesToStorage(codebaseID, files, r)
+	// Stream files to the storage nodes chosen for the codebase
+	stages, results, err := s.forwardFilesToStorage(r.Context(), s.placement(codebaseID), codebaseID, 0, reader, budget)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to store files: %v", err))
+		respondWithStoreError(w, err)
 		return
 	}
 
-	// Store metadata in database
-	tx, err := s.db.Begin()
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Database transaction failed")
+	// Store metadata for the stored files only, then make them visible
+	files := storedFiles(results)
+	if !s.commitStaged(w, stages, codebaseID, s.withinQuota(owner, codebaseID, files, func(tx *sql.Tx) error {
+		return insertCodebase(tx, codebaseID, owner, files)
+	})) {
 		return
 	}
-	defer tx.Rollback()
 
+	respondWithUpload(w, codebaseID, results)
+}
+
+// insertCodebase records a codebase owned by owner and the files of its
+// first revision inside tx.
+func insertCodebase(tx *sql.Tx, codebaseID, owner string, files []FileInfo) error {
 	// Insert codebase record
-	_, err = tx.Exec("INSERT INTO codebases (id, file_count) VALUES ($1, $2)",
-		codebaseID, len(uploadedFiles))
+	_, err := tx.Exec("INSERT INTO codebases (id, owner, file_count) VALUES ($1, $2, $3)",
+		codebaseID, owner, len(files))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to save codebase metadata")
-		return
+		return fmt.Errorf("insert codebase: %w", err)
+	}
+
+	_, err = tx.Exec("INSERT INTO revisions (codebase_id, revision, file_count) VALUES ($1, 1, $2)",
+		codebaseID, len(files))
+	if err != nil {
+		return fmt.Errorf("insert revision: %w", err)
 	}
 
-	// Insert file records
-	for _, fileInfo := range uploadedFiles {
-		_, err = tx.Exec(`INSERT INTO files (codebase_id, file_path, file_name, file_size) 
-			VALUES ($1, $2, $3, $4)`,
-			codebaseID, fileInfo.Path, fileInfo.Name, fileInfo.Size)
+	return insertFiles(tx, codebaseID, 1, files)
+}
+
+// insertFiles records the files of a revision inside tx.
+func insertFiles(tx *sql.Tx, codebaseID string, revision int, files []FileInfo) error {
+	for _, fileInfo := range files {
+		_, err := tx.Exec(`INSERT INTO files (codebase_id, revision, file_path, file_name, file_size, sha256, mime_type, language) 
+			VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))`,
+			codebaseID, revision, fileInfo.Path, fileInfo.Name, fileInfo.Size, fileInfo.SHA256, fileInfo.MIMEType, fileInfo.Language)
 		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to save file metadata")
-			return
+			return fmt.Errorf("insert file %s: %w", fileInfo.Path, err)
 		}
 	}
 
-	if err = tx.Commit(); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
-		return
-	}
+	return nil
+}
 
+// respondWithUpload reports a successful upload, listing accepted,
+// rejected and ignored files separately so clients can retry just the
+// rejected ones.
+func respondWithUpload(w http.ResponseWriter, codebaseID string, results []FileResult) {
 	var filePaths []string
 	var totalSize int64
-	for _, f := range uploadedFiles {
+	accepted := []FileResult{}
+	rejected, ignored := splitUnstored(results)
+	for _, f := range results {
+		if f.Status != fileStored {
+			continue
+		}
+		accepted = append(accepted, f)
 		filePaths = append(filePaths, f.Path)
 		totalSize += f.Size
 	}
 
+	message := fmt.Sprintf("Successfully uploaded %d files (%d bytes total)", len(accepted), totalSize)
+	if len(rejected) > 0 {
+		message += fmt.Sprintf(", %d rejected", len(rejected))
+	}
+	if len(ignored) > 0 {
+		message += fmt.Sprintf(", %d ignored", len(ignored))
+	}
+
 	response := UploadResponse{
 		Success:       true,
-		Message:       fmt.Sprintf("Successfully uploaded %d files (%d bytes total)", len(uploadedFiles), totalSize),
+		Message:       message,
 		DirectoryID:   codebaseID,
 		UploadedFiles: filePaths,
+		AcceptedFiles: accepted,
+		RejectedFiles: rejected,
+		IgnoredFiles:  ignored,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) forwardFilesToStorage(codebaseID string, files []*multipart.FileHeader, r *http.Request) ([]FileInfo, error) {
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
+// respondWithStoreError reports why files could not be staged on storage.
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNoFiles) {
+		respondWithError(w, http.StatusBadRequest, "No files uploaded")
+		return
+	}
+	if errors.Is(err, errInvalidForm) {
+		respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+		return
+	}
+	var qe *quotaError
+	if errors.As(err, &qe) {
+		respondWithError(w, qe.Status, qe.Message)
+		return
+	}
+	var se *storageError
+	if errors.As(err, &se) && se.Files != nil {
+		// Storage rejected every file
+		respondWithRejectedUpload(w, se)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to store files: %v", err))
+}
 
-	// Add codebase ID
-	writer.WriteField("codebase_id", codebaseID)
+// respondWithRejectedUpload reports an upload in which storage kept no files.
+func respondWithRejectedUpload(w http.ResponseWriter, se *storageError) {
+	rejected, ignored := splitUnstored(se.Files)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(UploadResponse{
+		Success:       false,
+		Message:       se.Message,
+		RejectedFiles: rejected,
+		IgnoredFiles:  ignored,
+	})
+}
 
-	var fileInfos []FileInfo
+// splitUnstored returns the files storage rejected and those it left out
+// by the ignore rules.
+func splitUnstored(results []FileResult) (rejected, ignored []FileResult) {
+	for _, f := range results {
+		switch f.Status {
+		case fileStored:
+		case fileIgnored:
+			ignored = append(ignored, f)
+		default:
+			rejected = append(rejected, f)
+		}
+	}
+	return rejected, ignored
+}
 
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
-		if err != nil {
+// forwardFilesToStorage streams the incoming multipart parts to the storage
+// nodes through pipes, so only a copy buffer is held in memory regardless
+// of the upload size. Each node stages the files and returns a stage ID
+// together with what happened to each file. A non-zero revision makes the
+// files a new revision of the codebase rather than changes to the latest.
+// The upload is cut off once it outgrows budget.
+func (s *Server) forwardFilesToStorage(ctx context.Context, nodes []string, codebaseID string, revision int, reader *multipart.Reader, budget *uploadBudget) ([]replicaStage, []FileResult, error) {
+	return s.stageFiles(ctx, nodes, func(writer *multipart.Writer) error {
+		return copyUploadParts(writer, codebaseID, revision, s.excludes, reader, budget)
+	})
+}
+
+// stageFiles sends the /store form produced by fill to nodes and returns
+// the stages of the quorum that stored it and their per-file results.
+func (s *Server) stageFiles(ctx context.Context, nodes []string, fill func(*multipart.Writer) error) ([]replicaStage, []FileResult, error) {
+	attempts, err := s.streamToStorage(ctx, nodes, "/store", fill)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.settleStages(attempts)
+}
+
+// streamToStorage posts the multipart body produced by fill to every node
+// while fill is still running, and reads the stage each node created. It
+// only returns an error if the client's upload could not be read.
+func (s *Server) streamToStorage(ctx context.Context, nodes []string, endpoint string, fill func(*multipart.Writer) error) ([]stageAttempt, error) {
+	rep := newReplicator(nodes)
+	writer := multipart.NewWriter(rep)
+
+	// Send to storage while the parts are still being read
+	rep.start(&s.health, func(node string, body io.Reader) (*http.Response, error) {
+		return s.postToStorage(ctx, node+endpoint, writer.FormDataContentType(), body)
+	})
+
+	copyErr := fill(writer)
+	if copyErr == nil {
+		copyErr = writer.Close()
+	}
+	responses := rep.finish(copyErr)
+	defer closeResponses(responses)
+
+	if copyErr != nil && !errors.Is(copyErr, errStorageClosed) {
+		return nil, copyErr
+	}
+
+	attempts := make([]stageAttempt, len(responses))
+	for i, r := range responses {
+		attempts[i] = stageAttempt{replicaStage: replicaStage{Node: r.node}, Err: r.err}
+		if r.err != nil {
 			continue
 		}
-		defer file.Close()
-
-		// Get relative path from form data
-		relativePath := r.FormValue("path_" + fileHeader.Filename)
-		if relativePath == "" {
-			relativePath = fileHeader.Filename
+		if r.resp.StatusCode != http.StatusOK {
+			attempts[i].Err = readStorageError(r.resp)
+			continue
+		}
+		if copyErr != nil {
+			// Every node stopped reading, yet one claims success
+			attempts[i].Err = copyErr
+			continue
 		}
 
-		// Create form file
-		part, err := writer.CreateFormFile("files", fileHeader.Filename)
-		if err != nil {
+		var stored struct {
+			StageID string       `json:"stage_id"`
+			Files   []FileResult `json:"files"`
+		}
+		if err := json.NewDecoder(r.resp.Body).Decode(&stored); err != nil || stored.StageID == "" {
+			attempts[i].Err = fmt.Errorf("invalid response from storage server")
 			continue
 		}
+		attempts[i].StageID = stored.StageID
+		attempts[i].Files = stored.Files
+	}
+	return attempts, nil
+}
 
-		written, err := io.Copy(part, file)
+// copyUploadParts re-encodes the client's manifest, file and path parts onto
+// writer in the order they arrive, within budget. Storage resolves paths,
+// leaves out files matching excludes or the ignore files of the upload and
+// reports the outcome of every file.
+func copyUploadParts(writer *multipart.Writer, codebaseID string, revision int, excludes []string, reader *multipart.Reader, budget *uploadBudget) error {
+	// Add codebase ID first so storage can place files as they arrive
+	if err := writer.WriteField("codebase_id", codebaseID); err != nil {
+		return err
+	}
+	if revision > 0 {
+		if err := writer.WriteField("revision", strconv.Itoa(revision)); err != nil {
+			return err
+		}
+	}
+	if err := writeExcludes(writer, excludes); err != nil {
+		return err
+	}
+
+	fileCount := 0
+	hasManifest := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			continue
+			return fmt.Errorf("%w: %v", errInvalidForm, err)
 		}
 
-		// Add path information
-		writer.WriteField("path_"+fileHeader.Filename, relativePath)
+		formName := part.FormName()
+		switch {
+		case formName == "manifest":
+			// Forwarded verbatim; storage validates it
+			dst, err := writer.CreateFormField("manifest")
+			if err != nil {
+				return err
+			}
+			if _, err := copyPart(dst, part); err != nil {
+				return err
+			}
+			hasManifest = true
+
+		case formName == "files" && part.FileName() != "":
+			if err := budget.file(part.FileName()); err != nil {
+				return err
+			}
+			dst, err := writer.CreateFormFile("files", part.FileName())
+			if err != nil {
+				return err
+			}
+			if _, err := copyPart(budget.limit(dst, part.FileName()), part); err != nil {
+				return err
+			}
+			fileCount++
+
+		case strings.HasPrefix(formName, "path_"):
+			// Add path information
+			value, err := readFormValue(part)
+			if err != nil {
+				return err
+			}
+			if err := writer.WriteField(formName, value); err != nil {
+				return err
+			}
+		}
 
-		fileInfos = append(fileInfos, FileInfo{
-			Name: filepath.Base(relativePath),
-			Path: relativePath,
-			Size: written,
-		})
+		part.Close()
 	}
 
-	writer.Close()
+	// A manifest may name only content storage already has
+	if fileCount == 0 && !hasManifest {
+		return errNoFiles
+	}
+	return nil
+}
 
-	// Send to storage server
-	resp, err := http.Post(s.storageServerURL+"/store", writer.FormDataContentType(), &buf)
-	if err != nil {
-		return nil, err
+// defaultUploadExcludes are left out of every upload unless UPLOAD_EXCLUDE
+// is set.
+var defaultUploadExcludes = []string{".git/", ".DS_Store"}
+
+// uploadExcludesFromEnv reads UPLOAD_EXCLUDE, a comma separated list of
+// .gitignore patterns left out of every upload; "none" leaves out nothing.
+func uploadExcludesFromEnv() []string {
+	value := os.Getenv("UPLOAD_EXCLUDE")
+	if value == "" {
+		return defaultUploadExcludes
 	}
-	defer resp.Body.Close()
+	var excludes []string
+	if value == "none" {
+		return excludes
+	}
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			excludes = append(excludes, pattern)
+		}
+	}
+	return excludes
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("storage server returned status %d", resp.StatusCode)
+// writeExcludes forwards the server-wide exclude patterns, one per line,
+// which storage applies after the ignore files of the upload.
+func writeExcludes(writer *multipart.Writer, excludes []string) error {
+	if len(excludes) == 0 {
+		return nil
 	}
+	return writer.WriteField("exclude", strings.Join(excludes, "\n"))
+}
 
-	return fileInfos, nil
+// copyPart copies a part body to dst, telling apart failures reading the
+// client's request from failures writing to the storage server.
+func copyPart(dst io.Writer, part io.Reader) (int64, error) {
+	var written int64
+	buf := make([]byte, 32<<10)
+	for {
+		n, readErr := part.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, fmt.Errorf("%w: %v", errInvalidForm, readErr)
+		}
+	}
+}
+
+func readFormValue(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, MaxFieldSize+1))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidForm, err)
+	}
+	if len(value) > MaxFieldSize {
+		return "", fmt.Errorf("%w: field %s too large", errInvalidForm, part.FormName())
+	}
+	return string(value), nil
 }
 
 func (s *Server) listCodebases(w http.ResponseWriter, r *http.Request) {
-	rows, err := s.db.Query("SELECT id, created_at, file_count FROM codebases ORDER BY created_at DESC")
+	// Language summaries come from breakdowns cached for the latest
+	// revision as it is now
+	rows, err := s.db.Query(`SELECT id, owner, created_at, file_count, codebases.revision, codebase_stats.stats
+		FROM codebases LEFT JOIN codebase_stats ON codebase_stats.codebase_id = codebases.id
+			AND codebase_stats.revision = codebases.revision AND codebase_stats.generation = codebases.generation
+		ORDER BY created_at DESC`)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to query codebases")
 		return
@@ -258,9 +684,15 @@ func (s *Server) listCodebases(w http.ResponseWriter, r *http.Request) {
 	var codebases []Codebase
 	for rows.Next() {
 		var cb Codebase
-		if err := rows.Scan(&cb.ID, &cb.CreatedAt, &cb.FileCount); err != nil {
+		var stats []byte
+		if err := rows.Scan(&cb.ID, &cb.Owner, &cb.CreatedAt, &cb.FileCount, &cb.Revision, &stats); err != nil {
 			continue
 		}
+		if stats != nil {
+			cb.Languages = languageSummary(stats)
+		} else {
+			s.refreshStats(cb.ID, cb.Revision)
+		}
 		codebases = append(codebases, cb)
 	}
 
@@ -280,16 +712,30 @@ func (s *Server) getCodebaseFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	revision, ok := requestedRevision(w, r)
+	if !ok {
+		return
+	}
+
 	// Check if codebase exists
-	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM codebases WHERE id = $1)", codebaseID).Scan(&exists)
-	if err != nil || !exists {
+	var latest int
+	err := s.db.QueryRow("SELECT revision FROM codebases WHERE id = $1", codebaseID).Scan(&latest)
+	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Codebase not found")
 		return
 	}
+	if revision == 0 {
+		revision = latest
+	}
+	if revision > latest {
+		respondWithError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
 
 	// Get files from database
-	rows, err := s.db.Query("SELECT file_path, file_name, file_size FROM files WHERE codebase_id = $1", codebaseID)
+	rows, err := s.db.Query(`SELECT file_path, file_name, file_size, COALESCE(sha256, ''), COALESCE(mime_type, ''), COALESCE(language, '')
+		FROM files WHERE codebase_id = $1 AND revision = $2`,
+		codebaseID, revision)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to query files")
 		return
@@ -299,7 +745,7 @@ func (s *Server) getCodebaseFiles(w http.ResponseWriter, r *http.Request) {
 	var files []FileInfo
 	for rows.Next() {
 		var f FileInfo
-		if err := rows.Scan(&f.Path, &f.Name, &f.Size); err != nil {
+		if err := rows.Scan(&f.Path, &f.Name, &f.Size, &f.SHA256, &f.MIMEType, &f.Language); err != nil {
 			continue
 		}
 		files = append(files, f)
@@ -309,6 +755,7 @@ func (s *Server) getCodebaseFiles(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success":      true,
 		"directory_id": codebaseID,
+		"revision":     revision,
 		"files":        files,
 	})
 }
@@ -328,10 +775,20 @@ func (s *Server) readFileContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward request to storage server
+	rev, ok := revisionQuery(w, r)
+	if !ok {
+		return
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	// Forward request to storage, failing over between replicas
 	//log.Printf("Fetching file content for codebase %s, file %s", codebaseID, filePath)
-	url := fmt.Sprintf("%s/content/%s?file=%s", s.storageServerURL, codebaseID, filePath)
-	resp, err := http.Get(url)
+	target := fmt.Sprintf("/content/%s?%s", codebaseID, url.Values{"file": {filePath}, "rev": {rev}}.Encode())
+	resp, err := s.getFromReplicas(r.Context(), nodes, target, nil)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve file from storage")
 		return
@@ -359,10 +816,25 @@ func (s *Server) downloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward request to storage server
-	url := fmt.Sprintf("%s/download/%s?file=%s", s.storageServerURL, codebaseID, filePath)
-	//log.Printf("%s/download/%s?file=%s", s.storageServerURL, codebaseID, filePath)
-	resp, err := http.Get(url)
+	rev, ok := revisionQuery(w, r)
+	if !ok {
+		return
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	// Forward request to storage, failing over between replicas
+	target := fmt.Sprintf("/download/%s?%s", codebaseID, url.Values{"file": {filePath}, "rev": {rev}}.Encode())
+	//log.Printf("%s/download/%s?file=%s", nodes[0], codebaseID, filePath)
+	header := http.Header{}
+	// Let clients revalidate cached downloads against the file's checksum
+	if etag := r.Header.Get("If-None-Match"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	resp, err := s.getFromReplicas(r.Context(), nodes, target, header)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve file from storage")
 		return
@@ -388,9 +860,18 @@ func (s *Server) downloadZip(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Forward request to storage server
-	url := fmt.Sprintf("%s/zip/%s", s.storageServerURL, codebaseID)
-	resp, err := http.Get(url)
+	rev, ok := revisionQuery(w, r)
+	if !ok {
+		return
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	// Forward request to storage, failing over between replicas
+	resp, err := s.getFromReplicas(r.Context(), nodes, fmt.Sprintf("/zip/%s?%s", codebaseID, url.Values{"rev": {rev}}.Encode()), nil)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve ZIP from storage")
 		return
@@ -412,6 +893,38 @@ func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// storageError carries an error status and message returned by Server B.
+type storageError struct {
+	Status  int
+	Message string
+	Files   []FileResult // per-file results, when storage rejected every file
+}
+
+func (e *storageError) Error() string {
+	return fmt.Sprintf("storage server returned status %d: %s", e.Status, e.Message)
+}
+
+func readStorageError(resp *http.Response) error {
+	var body struct {
+		Error string       `json:"error"`
+		Files []FileResult `json:"files"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, MaxUploadSize)).Decode(&body)
+	return &storageError{Status: resp.StatusCode, Message: body.Error, Files: body.Files}
+}
+
+// respondWithStorageError passes client errors reported by storage through
+// and hides everything else behind fallback.
+func respondWithStorageError(w http.ResponseWriter, err error, fallback string) {
+	var se *storageError
+	if errors.As(err, &se) && se.Status >= 400 && se.Status < 500 && se.Message != "" {
+		respondWithError(w, se.Status, se.Message)
+		return
+	}
+	log.Printf("%s: %v", fallback, err)
+	respondWithError(w, http.StatusBadGateway, fallback)
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -425,18 +938,87 @@ func main() {
 	server := NewServer()
 	defer server.db.Close()
 
+	// Maintenance commands run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "rebalance" {
+		if err := server.runRebalance(os.Args[2:]); err != nil {
+			log.Fatalf("Rebalancing failed: %v", err)
+		}
+		return
+	}
+
+	go server.retryPendingCommits(30 * time.Second)
+
+	stageTimeout := time.Hour
+	if value := os.Getenv("STAGE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("Invalid STAGE_TIMEOUT %q", value)
+		}
+		stageTimeout = timeout
+	}
+	go server.reapStages(stageTimeout)
+
+	sessionTTL := 24 * time.Hour
+	if value := os.Getenv("SESSION_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid SESSION_TTL %q", value)
+		}
+		sessionTTL = ttl
+	}
+	go server.reapUploadSessions(sessionTTL)
+
+	reconcileInterval := 24 * time.Hour
+	if value := os.Getenv("RECONCILE_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			log.Fatalf("Invalid RECONCILE_INTERVAL %q", value)
+		}
+		reconcileInterval = interval
+	}
+	if reconcileInterval > 0 {
+		go server.runReconciler(reconcileInterval)
+	}
+
 	r := mux.NewRouter()
 	r.Use(enableCORS)
 
 	// API routes
 	r.HandleFunc("/upload", server.uploadCodebase).Methods("POST", "OPTIONS")
+	r.HandleFunc("/upload/negotiate", server.negotiateUpload).Methods("POST")
+	r.HandleFunc("/upload/archive", server.uploadArchive).Methods("POST", "OPTIONS")
 	r.HandleFunc("/codebases", server.listCodebases).Methods("GET")
 	r.HandleFunc("/codebases/{id}", server.getCodebaseFiles).Methods("GET")
+	r.HandleFunc("/codebases/{id}", server.deleteCodebase).Methods("DELETE")
 	r.HandleFunc("/codebases/{id}/content", server.readFileContent).Methods("GET")
 	r.HandleFunc("/codebases/{id}/download", server.downloadFile).Methods("GET")
 	r.HandleFunc("/codebases/{id}/zip", server.downloadZip).Methods("GET")
+	r.HandleFunc("/codebases/{id}/diff", server.diffCodebases).Methods("GET")
+	r.HandleFunc("/codebases/{id}/search", server.searchCodebase).Methods("GET")
+	r.HandleFunc("/codebases/{id}/grep", server.grepCodebase).Methods("GET")
+	r.HandleFunc("/codebases/{id}/files", server.getCodebaseFiles).Methods("GET")
+	r.HandleFunc("/codebases/{id}/files", server.addCodebaseFiles).Methods("POST")
+	r.HandleFunc("/codebases/{id}/files", server.putCodebaseFile).Methods("PUT")
+	r.HandleFunc("/codebases/{id}/files", server.deleteCodebaseFile).Methods("DELETE")
+	r.HandleFunc("/codebases/{id}/revisions", server.uploadRevision).Methods("POST")
+	r.HandleFunc("/codebases/{id}/revisions", server.listRevisions).Methods("GET")
+	r.HandleFunc("/codebases/{id}/usage", server.getCodebaseUsage).Methods("GET")
+	r.HandleFunc("/codebases/{id}/stats", server.getCodebaseStats).Methods("GET")
+	r.HandleFunc("/usage", server.getUsage).Methods("GET")
 	r.HandleFunc("/health", server.healthCheck).Methods("GET")
 
+	// Resumable upload sessions
+	r.HandleFunc("/uploads", server.createUploadSession).Methods("POST")
+	r.HandleFunc("/uploads/{id}", server.getUploadSession).Methods("GET")
+	r.HandleFunc("/uploads/{id}", server.uploadChunk).Methods("PUT")
+	r.HandleFunc("/uploads/{id}", server.abortUploadSession).Methods("DELETE")
+	r.HandleFunc("/uploads/{id}/finalize", server.finalizeUploadSession).Methods("POST")
+
+	// Admin routes
+	r.HandleFunc("/admin/reconcile", server.requireAdmin(server.runReconcile)).Methods("POST")
+	r.HandleFunc("/admin/reconcile", server.requireAdmin(server.getReconcileReport)).Methods("GET")
+	r.HandleFunc("/admin/storage", server.requireAdmin(server.getStorageStats)).Methods("GET")
+
 	// Serve static files
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 
@@ -446,6 +1028,7 @@ func main() {
 	}
 
 	log.Printf("Server A starting on port %s", port)
-	log.Printf("Storage server URL: %s", server.storageServerURL)
+	log.Printf("Storage nodes: %s (%d replicas per codebase, write quorum %d)",
+		strings.Join(server.storageNodes, ", "), server.replicas, server.writeQuorum)
 	log.Fatal(http.ListenAndServe(":"+port, r))
 }
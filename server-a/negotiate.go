@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// MaxNegotiateSize limits the file list of a negotiation request.
+const MaxNegotiateSize = 8 << 20
+
+type negotiateRequest struct {
+	DirectoryID string `json:"directory_id,omitempty"` // the codebase uploaded to, if it exists
+	Files       []struct {
+		Path   string `json:"path"`
+		SHA256 string `json:"sha256"`
+	} `json:"files"`
+}
+
+// negotiateUpload handles POST /upload/negotiate. The client lists the path
+// and SHA-256 of every file it is about to upload and learns which content
+// storage already has ("have") and which it still needs ("want"). Files
+// with known content are then listed in the upload manifest by checksum
+// alone, without a part, and only the wanted content is sent. As the
+// upload may go to any storage node, content is only known if every node
+// that answers has it. Content only an encrypted codebase holds is only
+// known to uploads to that codebase, named by directory_id.
+func (s *Server) negotiateUpload(w http.ResponseWriter, r *http.Request) {
+	var req negotiateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxNegotiateSize)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(req.Files) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No files listed")
+		return
+	}
+
+	sums := make([]string, 0, len(req.Files))
+	for i := range req.Files {
+		f := &req.Files[i]
+		if f.Path == "" || f.SHA256 == "" {
+			respondWithError(w, http.StatusBadRequest, "Every file needs a path and a sha256")
+			return
+		}
+		f.SHA256 = strings.ToLower(f.SHA256)
+		sums = append(sums, f.SHA256)
+	}
+
+	if req.DirectoryID != "" {
+		if _, err := uuid.Parse(req.DirectoryID); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid directory ID")
+			return
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"sha256": sums, "codebase_id": req.DirectoryID})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to encode request")
+		return
+	}
+
+	haveCount := make(map[string]int)
+	answered := 0
+	var lastErr error
+	for _, node := range s.storageNodes {
+		have, err := s.checkBlobs(r.Context(), node, body)
+		if err != nil {
+			var se *storageError
+			if errors.As(err, &se) {
+				respondWithStorageError(w, err, "Failed to query storage")
+				return
+			}
+			lastErr = err
+			continue
+		}
+		answered++
+		for _, sum := range have {
+			haveCount[sum]++
+		}
+	}
+	if answered == 0 {
+		respondWithStorageError(w, lastErr, "Failed to query storage")
+		return
+	}
+
+	have := []string{}
+	want := []string{}
+	seen := make(map[string]bool, len(sums))
+	for _, sum := range sums {
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+		if haveCount[sum] == answered {
+			have = append(have, sum)
+		} else {
+			want = append(want, sum)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("%d of %d files need uploading", countWanted(req, want), len(req.Files)),
+		"have":    have,
+		"want":    want,
+	})
+}
+
+// checkBlobs asks node which of the checksums in body it has content for.
+func (s *Server) checkBlobs(ctx context.Context, node string, body []byte) ([]string, error) {
+	resp, err := s.postToStorage(ctx, node+"/blobs/check", "application/json", bytes.NewReader(body))
+	s.health.record(node, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStorageError(resp)
+	}
+
+	var known struct {
+		Have []string `json:"have"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&known); err != nil {
+		return nil, fmt.Errorf("invalid response from storage server")
+	}
+	return known.Have, nil
+}
+
+// countWanted counts the listed files whose content storage does not have.
+func countWanted(req negotiateRequest, want []string) int {
+	wanted := make(map[string]bool, len(want))
+	for _, sum := range want {
+		wanted[sum] = true
+	}
+
+	n := 0
+	for _, f := range req.Files {
+		if wanted[f.SHA256] {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// anonymousUser owns the codebases uploaded without an X-User-ID header.
+const anonymousUser = "anonymous"
+
+const maxUserIDLength = 128
+
+// quotaLockClass keys the advisory locks that serialize quota checks of
+// one user.
+const quotaLockClass = 0x71756f74
+
+// Quotas limits what users and codebases may store. Stored bytes and files
+// count every revision kept. Zero means unlimited.
+type Quotas struct {
+	UserBytes     int64 // total bytes of a user's codebases
+	UserFiles     int64 // total files of a user's codebases
+	UserCodebases int64 // codebases a user may own
+	CodebaseBytes int64 // total bytes of one codebase
+	CodebaseFiles int64 // total files of one codebase
+	MaxFileSize   int64 // size of any single file
+}
+
+// quotasFromEnv reads the QUOTA_* settings. Byte sizes may carry a KB, MB,
+// GB or TB suffix.
+func quotasFromEnv() (Quotas, error) {
+	var q Quotas
+	settings := []struct {
+		name  string
+		value *int64
+		bytes bool
+	}{
+		{"QUOTA_USER_BYTES", &q.UserBytes, true},
+		{"QUOTA_USER_FILES", &q.UserFiles, false},
+		{"QUOTA_USER_CODEBASES", &q.UserCodebases, false},
+		{"QUOTA_CODEBASE_BYTES", &q.CodebaseBytes, true},
+		{"QUOTA_CODEBASE_FILES", &q.CodebaseFiles, false},
+		{"QUOTA_MAX_FILE_SIZE", &q.MaxFileSize, true},
+	}
+	for _, setting := range settings {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		n, err := parseQuota(value, setting.bytes)
+		if err != nil {
+			return q, fmt.Errorf("%s: %w", setting.name, err)
+		}
+		*setting.value = n
+	}
+	return q, nil
+}
+
+func parseQuota(value string, bytes bool) (int64, error) {
+	multiplier := int64(1)
+	if bytes {
+		upper := strings.ToUpper(strings.TrimSpace(value))
+		for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+			if strings.HasSuffix(upper, suffix) {
+				value = strings.TrimSpace(upper[:len(upper)-2])
+				multiplier = int64(1) << (10 * (i + 1))
+				break
+			}
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/multiplier {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// quotaError is a change refused because it does not fit the quotas.
+type quotaError struct {
+	Status  int
+	Message string
+}
+
+func (e *quotaError) Error() string {
+	return e.Message
+}
+
+func fileTooLarge(name string, size, limit int64) *quotaError {
+	return &quotaError{http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("File %s is %d bytes, larger than the limit of %d bytes per file", name, size, limit)}
+}
+
+// requestUser returns the user a request is made for, writing an error
+// response if it names one it may not. Only the authenticating proxy in
+// front of Server A may name a user, in the X-User-ID header of requests
+// that carry TRUSTED_PROXY_SECRET in X-Proxy-Secret; anyone else could
+// escape their quota by changing the header.
+func (s *Server) requestUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := r.Header.Get("X-User-ID")
+	if user == "" {
+		return anonymousUser, true
+	}
+	secret := r.Header.Get("X-Proxy-Secret")
+	if s.proxySecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.proxySecret)) != 1 {
+		respondWithError(w, http.StatusForbidden, "X-User-ID is only accepted from the trusted proxy")
+		return "", false
+	}
+	valid := len(user) <= maxUserIDLength
+	for _, c := range user {
+		if !unicode.IsPrint(c) {
+			valid = false
+		}
+	}
+	if !valid {
+		respondWithError(w, http.StatusBadRequest, "Invalid X-User-ID header")
+		return "", false
+	}
+	return user, true
+}
+
+// Usage is what a user or codebase stores.
+type Usage struct {
+	Bytes     int64 `json:"bytes"`
+	Files     int64 `json:"files"`
+	Codebases int64 `json:"codebases,omitempty"`
+}
+
+func userUsage(q queryRower, user string) (Usage, error) {
+	var u Usage
+	err := q.QueryRow(`SELECT COUNT(DISTINCT codebases.id), COALESCE(SUM(files.file_size), 0), COUNT(files.id)
+		FROM codebases LEFT JOIN files ON files.codebase_id = codebases.id
+		WHERE codebases.owner = $1`, user).Scan(&u.Codebases, &u.Bytes, &u.Files)
+	return u, err
+}
+
+func codebaseUsage(q queryRower, codebaseID string) (Usage, error) {
+	var u Usage
+	err := q.QueryRow("SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM files WHERE codebase_id = $1",
+		codebaseID).Scan(&u.Bytes, &u.Files)
+	return u, err
+}
+
+// remaining is what is left of limit after used, or -1 without a limit.
+func remaining(limit, used int64) int64 {
+	if limit == 0 {
+		return -1
+	}
+	if used > limit {
+		return 0
+	}
+	return limit - used
+}
+
+// tighter returns the smaller of two remainders, where -1 is unlimited.
+func tighter(a, b int64) int64 {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// uploadBudget bounds what an upload may stream to storage, so one that
+// cannot fit the quotas is cut off before storage has received all of it.
+// The exact check is made when the change is recorded.
+type uploadBudget struct {
+	maxFileSize int64 // 0 is unlimited
+	bytes       int64 // left to stream, -1 is unlimited
+	files       int64
+}
+
+// file counts a file about to be streamed.
+func (b *uploadBudget) file(name string) error {
+	if b.files == 0 {
+		return &quotaError{http.StatusRequestEntityTooLarge, "Upload has more files than the file quota allows"}
+	}
+	if b.files > 0 {
+		b.files--
+	}
+	return nil
+}
+
+// declare counts a file of the given size whose body is streamed later,
+// as by an upload session.
+func (b *uploadBudget) declare(name string, size int64) error {
+	if err := b.file(name); err != nil {
+		return err
+	}
+	if b.maxFileSize > 0 && size > b.maxFileSize {
+		return fileTooLarge(name, size, b.maxFileSize)
+	}
+	if b.bytes >= 0 {
+		if size > b.bytes {
+			return &quotaError{http.StatusRequestEntityTooLarge, "Upload is larger than the storage quota allows"}
+		}
+		b.bytes -= size
+	}
+	return nil
+}
+
+// limit wraps dst, the destination of the body of file name, failing
+// writes with a quotaError once the file or the upload outgrows the
+// budget.
+func (b *uploadBudget) limit(dst io.Writer, name string) io.Writer {
+	return &budgetWriter{dst: dst, budget: b, name: name}
+}
+
+type budgetWriter struct {
+	dst     io.Writer
+	budget  *uploadBudget
+	name    string
+	written int64
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	w.written += n
+	if limit := w.budget.maxFileSize; limit > 0 && w.written > limit {
+		return 0, fileTooLarge(w.name, w.written, limit)
+	}
+	if w.budget.bytes >= 0 {
+		if n > w.budget.bytes {
+			return 0, &quotaError{http.StatusRequestEntityTooLarge, "Upload is larger than the storage quota allows"}
+		}
+		w.budget.bytes -= n
+	}
+	return w.dst.Write(p)
+}
+
+// budget checks that owner may store more, in codebaseID or, if it is
+// empty, in a new codebase, writing an error response if the quotas are
+// used up, and returns what an upload may stream. If the upload may
+// replace the latest files of the codebase, they count as available.
+func (s *Server) budget(w http.ResponseWriter, owner, codebaseID string, replacing bool) (*uploadBudget, bool) {
+	user, err := userUsage(s.db, owner)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query storage usage")
+		return nil, false
+	}
+
+	if codebaseID == "" {
+		if limit := s.quotas.UserCodebases; limit > 0 && user.Codebases >= limit {
+			respondWithError(w, http.StatusTooManyRequests,
+				fmt.Sprintf("User %s already has %d codebases, the most allowed", owner, user.Codebases))
+			return nil, false
+		}
+	}
+
+	budget := &uploadBudget{
+		maxFileSize: s.quotas.MaxFileSize,
+		bytes:       tighter(remaining(s.quotas.UserBytes, user.Bytes), remaining(s.quotas.CodebaseBytes, 0)),
+		files:       tighter(remaining(s.quotas.UserFiles, user.Files), remaining(s.quotas.CodebaseFiles, 0)),
+	}
+	if codebaseID != "" {
+		codebase, err := codebaseUsage(s.db, codebaseID)
+		var latest Usage
+		if err == nil && replacing {
+			err = s.db.QueryRow(`SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM files
+				WHERE codebase_id = $1 AND revision = (SELECT revision FROM codebases WHERE id = $1)`,
+				codebaseID).Scan(&latest.Bytes, &latest.Files)
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to query storage usage")
+			return nil, false
+		}
+		budget.bytes = tighter(remaining(s.quotas.UserBytes, user.Bytes-latest.Bytes),
+			remaining(s.quotas.CodebaseBytes, codebase.Bytes-latest.Bytes))
+		budget.files = tighter(remaining(s.quotas.UserFiles, user.Files-latest.Files),
+			remaining(s.quotas.CodebaseFiles, codebase.Files-latest.Files))
+	}
+
+	if budget.bytes == 0 || budget.files == 0 {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Storage quota of user %s is used up", owner))
+		return nil, false
+	}
+	return budget, true
+}
+
+// codebaseOwner returns the user owning an existing codebase.
+func (s *Server) codebaseOwner(w http.ResponseWriter, codebaseID string) (string, bool) {
+	var owner string
+	if err := s.db.QueryRow("SELECT owner FROM codebases WHERE id = $1", codebaseID).Scan(&owner); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query codebase")
+		return "", false
+	}
+	return owner, true
+}
+
+// withinQuota wraps record, which stores files in codebaseID for owner, so
+// that the change is refused with a quotaError if it takes the owner or
+// the codebase over a quota. A change that shrinks usage is always
+// allowed, even above a quota lowered since.
+func (s *Server) withinQuota(owner, codebaseID string, files []FileInfo, record func(*sql.Tx) error) func(*sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		if limit := s.quotas.MaxFileSize; limit > 0 {
+			for _, f := range files {
+				if f.Size > limit {
+					return fileTooLarge(f.Path, f.Size, limit)
+				}
+			}
+		}
+
+		// Concurrent changes of the owner are checked one at a time
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))", quotaLockClass, owner); err != nil {
+			return err
+		}
+		userBefore, err := userUsage(tx, owner)
+		if err != nil {
+			return err
+		}
+		codebaseBefore, err := codebaseUsage(tx, codebaseID)
+		if err != nil {
+			return err
+		}
+
+		if err := record(tx); err != nil {
+			return err
+		}
+
+		userAfter, err := userUsage(tx, owner)
+		if err != nil {
+			return err
+		}
+		codebaseAfter, err := codebaseUsage(tx, codebaseID)
+		if err != nil {
+			return err
+		}
+
+		exceeds := func(limit, before, after int64) bool {
+			return limit > 0 && after > limit && after > before
+		}
+		switch {
+		case exceeds(s.quotas.UserCodebases, userBefore.Codebases, userAfter.Codebases):
+			return &quotaError{http.StatusTooManyRequests,
+				fmt.Sprintf("User %s already has %d codebases, the most allowed", owner, userBefore.Codebases)}
+		case exceeds(s.quotas.UserBytes, userBefore.Bytes, userAfter.Bytes):
+			return &quotaError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Upload would bring user %s to %d bytes, over the quota of %d bytes", owner, userAfter.Bytes, s.quotas.UserBytes)}
+		case exceeds(s.quotas.UserFiles, userBefore.Files, userAfter.Files):
+			return &quotaError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Upload would bring user %s to %d files, over the quota of %d files", owner, userAfter.Files, s.quotas.UserFiles)}
+		case exceeds(s.quotas.CodebaseBytes, codebaseBefore.Bytes, codebaseAfter.Bytes):
+			return &quotaError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Upload would bring the codebase to %d bytes, over the quota of %d bytes", codebaseAfter.Bytes, s.quotas.CodebaseBytes)}
+		case exceeds(s.quotas.CodebaseFiles, codebaseBefore.Files, codebaseAfter.Files):
+			return &quotaError{http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Upload would bring the codebase to %d files, over the quota of %d files", codebaseAfter.Files, s.quotas.CodebaseFiles)}
+		}
+		return nil
+	}
+}
+
+// quotaLimits are the quotas reported by the usage endpoints, leaving out
+// unlimited ones.
+type quotaLimits struct {
+	Bytes       int64 `json:"bytes,omitempty"`
+	Files       int64 `json:"files,omitempty"`
+	Codebases   int64 `json:"codebases,omitempty"`
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+}
+
+// getUsage handles GET /usage, reporting what the requesting user stores
+// against their quotas.
+func (s *Server) getUsage(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+
+	usage, err := userUsage(s.db, user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query storage usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"user":    user,
+		"usage":   usage,
+		"limits": quotaLimits{
+			Bytes:       s.quotas.UserBytes,
+			Files:       s.quotas.UserFiles,
+			Codebases:   s.quotas.UserCodebases,
+			MaxFileSize: s.quotas.MaxFileSize,
+		},
+	})
+}
+
+// getCodebaseUsage handles GET /codebases/{id}/usage, reporting what a
+// codebase stores against the per-codebase quotas.
+func (s *Server) getCodebaseUsage(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+	owner, ok := s.codebaseOwner(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	usage, err := codebaseUsage(s.db, codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query storage usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"directory_id": codebaseID,
+		"owner":        owner,
+		"usage":        usage,
+		"limits": quotaLimits{
+			Bytes:       s.quotas.CodebaseBytes,
+			Files:       s.quotas.CodebaseFiles,
+			MaxFileSize: s.quotas.MaxFileSize,
+		},
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var quotaSettings = []string{
+	"QUOTA_USER_BYTES",
+	"QUOTA_USER_FILES",
+	"QUOTA_USER_CODEBASES",
+	"QUOTA_CODEBASE_BYTES",
+	"QUOTA_CODEBASE_FILES",
+	"QUOTA_MAX_FILE_SIZE",
+}
+
+func TestQuotasFromEnv(t *testing.T) {
+	for _, name := range quotaSettings {
+		t.Setenv(name, "")
+	}
+	q, err := quotasFromEnv()
+	if err != nil || q != (Quotas{}) {
+		t.Fatalf("quotasFromEnv without settings = %+v, %v, want unlimited", q, err)
+	}
+
+	t.Setenv("QUOTA_USER_BYTES", "10GB")
+	t.Setenv("QUOTA_USER_FILES", "1000")
+	t.Setenv("QUOTA_USER_CODEBASES", "0")
+	t.Setenv("QUOTA_CODEBASE_BYTES", " 5 mb ")
+	t.Setenv("QUOTA_CODEBASE_FILES", "250")
+	t.Setenv("QUOTA_MAX_FILE_SIZE", "512")
+	want := Quotas{
+		UserBytes:     10 << 30,
+		UserFiles:     1000,
+		CodebaseBytes: 5 << 20,
+		CodebaseFiles: 250,
+		MaxFileSize:   512,
+	}
+	if q, err := quotasFromEnv(); err != nil || q != want {
+		t.Errorf("quotasFromEnv = %+v, %v, want %+v", q, err, want)
+	}
+}
+
+func TestQuotasFromEnvErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"QUOTA_USER_BYTES", "lots"},
+		{"QUOTA_USER_BYTES", "-1"},
+		{"QUOTA_USER_BYTES", "1.5GB"},
+		{"QUOTA_USER_BYTES", "10PB"},
+		{"QUOTA_USER_BYTES", "GB"},
+		{"QUOTA_CODEBASE_BYTES", "99999999TB"},
+		{"QUOTA_MAX_FILE_SIZE", "9223372036854775807"},
+		// Counts take no size suffix
+		{"QUOTA_USER_FILES", "10KB"},
+		{"QUOTA_CODEBASE_FILES", "1e6"},
+		{"QUOTA_USER_CODEBASES", "-5"},
+	}
+	for _, tt := range tests {
+		for _, name := range quotaSettings {
+			t.Setenv(name, "")
+		}
+		t.Setenv(tt.name, tt.value)
+		q, err := quotasFromEnv()
+		if err == nil {
+			t.Errorf("%s=%q: quotasFromEnv = %+v, want an error", tt.name, tt.value, q)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.name+": ") {
+			t.Errorf("%s=%q: error %q does not name the setting", tt.name, tt.value, err)
+		}
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		value string
+		bytes bool
+		want  int64
+	}{
+		{"0", true, 0},
+		{"1", true, 1},
+		{"1KB", true, 1 << 10},
+		{"1kb", true, 1 << 10},
+		{"3 MB", true, 3 << 20},
+		{"2GB", true, 2 << 30},
+		{"4TB", true, 4 << 40},
+		{"4194304TB", true, 1 << 62},
+		{"42", false, 42},
+	}
+	for _, tt := range tests {
+		if got, err := parseQuota(tt.value, tt.bytes); err != nil || got != tt.want {
+			t.Errorf("parseQuota(%q, %v) = %d, %v, want %d", tt.value, tt.bytes, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// rebalanceLockID is the PostgreSQL advisory lock held by a rebalancing
+// run, so two runs never move the same codebase at once, and by a
+// reconciliation that deletes orphans, so it never takes a copy being
+// made for a move for one.
+const rebalanceLockID = 0x72656261
+
+// moveAttempts is how often a move is retried when the codebase changes
+// while it is being copied.
+const moveAttempts = 3
+
+var errCodebaseChanged = errors.New("codebase changed while it was copied")
+
+var errRebalancing = errors.New("another rebalancing run is in progress")
+
+// lockRebalancing takes the rebalancing advisory lock for the whole
+// session of a dedicated connection, failing with errRebalancing if a
+// rebalancing run holds it. The returned function releases it.
+func (s *Server) lockRebalancing() (func(), error) {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", rebalanceLockID).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !locked {
+		conn.Close()
+		return nil, errRebalancing
+	}
+	return func() {
+		conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", rebalanceLockID)
+		conn.Close()
+	}, nil
+}
+
+// RebalanceReport describes a rebalancing run.
+type RebalanceReport struct {
+	StartedAt        time.Time      `json:"started_at"`
+	FinishedAt       time.Time      `json:"finished_at"`
+	DryRun           bool           `json:"dry_run"`
+	Nodes            []string       `json:"nodes"`
+	CodebasesChecked int            `json:"codebases_checked"`
+	Moves            []CodebaseMove `json:"moves"`
+	Errors           []string       `json:"errors"`
+}
+
+// CodebaseMove is a codebase copied to the nodes it is placed on and
+// removed from the nodes it no longer is.
+type CodebaseMove struct {
+	CodebaseID string   `json:"directory_id"`
+	To         []string `json:"to"`
+	From       []string `json:"from"`
+}
+
+func (m CodebaseMove) empty() bool {
+	return len(m.To) == 0 && len(m.From) == 0
+}
+
+// placements returns the nodes every codebase is placed on, keyed by
+// codebase ID.
+func (s *Server) placements() (map[string][]string, error) {
+	rows, err := s.db.Query("SELECT id, placement FROM codebases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	placed := make(map[string][]string)
+	for rows.Next() {
+		var id string
+		var nodes []string
+		if err := rows.Scan(&id, pq.Array(&nodes)); err != nil {
+			return nil, err
+		}
+		placed[id] = nodes
+	}
+	return placed, rows.Err()
+}
+
+// rebalance moves every codebase onto the nodes consistent hashing places
+// it on among the current storage nodes, after nodes were added or
+// removed, or to restore replicas a codebase lost. It is run as
+// "server-a rebalance" alongside the running servers. Reads keep going to
+// the codebase's old replicas until it is copied, and to its new ones
+// after; the old ones only lose their copy once they are no longer
+// recorded as replicas.
+func (s *Server) rebalance(dryRun bool) (*RebalanceReport, error) {
+	unlock, err := s.lockRebalancing()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	report := &RebalanceReport{
+		StartedAt: time.Now().UTC(),
+		DryRun:    dryRun,
+		Nodes:     s.storageNodes,
+		Moves:     []CodebaseMove{},
+		Errors:    []string{},
+	}
+
+	replicas, err := s.replicaNodes()
+	if err != nil {
+		return nil, fmt.Errorf("query codebases: %w", err)
+	}
+	placed, err := s.placements()
+	if err != nil {
+		return nil, fmt.Errorf("query placements: %w", err)
+	}
+
+	ids := make([]string, 0, len(replicas))
+	for id := range replicas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		report.CodebasesChecked++
+		if len(replicas[id]) == 0 {
+			// Not yet committed, or lost; nothing to copy from
+			continue
+		}
+
+		target := rankNodes(id, s.storageNodes)[:s.replicas]
+		planned := CodebaseMove{CodebaseID: id, To: missingNodes(target, replicas[id]), From: missingNodes(replicas[id], target)}
+		if dryRun {
+			if !planned.empty() {
+				report.Moves = append(report.Moves, planned)
+			}
+			continue
+		}
+		if planned.empty() && sameNodes(placed[id], target) {
+			continue
+		}
+
+		move, err := s.moveCodebase(id, target)
+		if !move.empty() {
+			report.Moves = append(report.Moves, move)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("move %s: %v", id, err))
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+	return report, nil
+}
+
+// moveCodebase places a codebase on target, copies it to the nodes of
+// target that do not hold it and, once all of them do, removes it from the
+// nodes outside target.
+func (s *Server) moveCodebase(codebaseID string, target []string) (CodebaseMove, error) {
+	move := CodebaseMove{CodebaseID: codebaseID, To: []string{}, From: []string{}}
+
+	// Placed before copying, so the reconciler takes the copies for what
+	// they are rather than for orphans
+	result, err := s.db.Exec("UPDATE codebases SET placement = $2 WHERE id = $1", codebaseID, pq.Array(target))
+	if err != nil {
+		return move, fmt.Errorf("record placement: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return move, nil
+	}
+
+	var errs []error
+	for attempt := 1; ; attempt++ {
+		sources, err := s.replicasOf(codebaseID)
+		if err != nil {
+			return move, err
+		}
+
+		copies := make(map[string]codebaseCopy)
+		for _, node := range missingNodes(target, sources) {
+			copied, err := s.copyCodebase(codebaseID, sources, node)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("copy to %s: %w", node, err))
+				continue
+			}
+			copies[node] = copied
+		}
+
+		added, removed, err := s.switchReplicas(codebaseID, target, copies)
+		if errors.Is(err, errCodebaseNotFound) {
+			// Deleted during the move; nothing refers to the copies
+			for node := range copies {
+				s.deleteStoredCodebase(node, codebaseID)
+			}
+			return move, nil
+		}
+		if err != nil {
+			return move, err
+		}
+		move.To = append(move.To, added...)
+
+		// Readers that looked the replicas up before the switch move on to
+		// the next replica when the copy they try is gone
+		for _, node := range removed {
+			if err := s.deleteStoredCodebase(node, codebaseID); err != nil {
+				errs = append(errs, fmt.Errorf("delete from %s: %w", node, err))
+				continue
+			}
+			move.From = append(move.From, node)
+			log.Printf("Removed codebase %s from %s", codebaseID, node)
+		}
+
+		if len(added) == len(copies) || attempt == moveAttempts {
+			if len(added) < len(copies) {
+				errs = append(errs, errCodebaseChanged)
+			}
+			return move, errors.Join(errs...)
+		}
+	}
+}
+
+// codebaseCopy is a codebase copied to a node, as that node holds it.
+type codebaseCopy struct {
+	Revision int
+	Files    []FileResult
+}
+
+// copyCodebase exports a codebase from the first of sources that can
+// provide it and imports it into node, replacing anything node held of it.
+func (s *Server) copyCodebase(codebaseID string, sources []string, node string) (codebaseCopy, error) {
+	var lastErr error
+	for _, source := range sources {
+		copied, err := s.transferCodebase(codebaseID, source, node)
+		if err == nil {
+			log.Printf("Copied codebase %s from %s to %s", codebaseID, source, node)
+			return copied, nil
+		}
+		lastErr = err
+	}
+	return codebaseCopy{}, lastErr
+}
+
+func (s *Server) transferCodebase(codebaseID, source, node string) (codebaseCopy, error) {
+	export, err := s.client.Get(fmt.Sprintf("%s/export/%s", source, codebaseID))
+	s.health.record(source, err)
+	if err != nil {
+		return codebaseCopy{}, err
+	}
+	defer export.Body.Close()
+	if export.StatusCode != http.StatusOK {
+		return codebaseCopy{}, readStorageError(export)
+	}
+
+	resp, err := s.client.Post(fmt.Sprintf("%s/import/%s", node, codebaseID), "application/x-tar", export.Body)
+	s.health.record(node, err)
+	if err != nil {
+		return codebaseCopy{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return codebaseCopy{}, readStorageError(resp)
+	}
+
+	var imported struct {
+		StageID  string       `json:"stage_id"`
+		Revision int          `json:"revision"`
+		Files    []FileResult `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&imported); err != nil || imported.StageID == "" {
+		return codebaseCopy{}, fmt.Errorf("invalid response from storage server")
+	}
+
+	// Committed before the copy is recorded, so it is complete by the time
+	// anything reads it
+	commit, err := s.client.Post(fmt.Sprintf("%s/stages/%s/commit", node, imported.StageID), "application/json", nil)
+	s.health.record(node, err)
+	if err != nil {
+		s.abortStage(replicaStage{Node: node, StageID: imported.StageID})
+		return codebaseCopy{}, err
+	}
+	defer commit.Body.Close()
+	if commit.StatusCode != http.StatusOK {
+		return codebaseCopy{}, readStorageError(commit)
+	}
+	return codebaseCopy{Revision: imported.Revision, Files: imported.Files}, nil
+}
+
+// switchReplicas records the copies that hold the codebase's current
+// content as replicas and, if every node of target then holds it, drops
+// the replicas outside target. Copies that a change committed while they
+// were made has outdated are left out. It returns the nodes added and
+// removed.
+func (s *Server) switchReplicas(codebaseID string, target []string, copies map[string]codebaseCopy) ([]string, []string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Changes to the codebase wait until the switch is committed
+	revision, err := lockCodebase(tx, codebaseID)
+	if err != nil {
+		return nil, nil, err
+	}
+	recorded, err := revisionFiles(tx, codebaseID, revision)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := queryNodes(tx, "SELECT node FROM codebase_replicas WHERE codebase_id = $1", codebaseID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var added []string
+	for _, node := range target {
+		copied, ok := copies[node]
+		if !ok || containsNode(current, node) {
+			continue
+		}
+		if copied.Revision != revision || !matchesRecorded(copied.Files, recorded) {
+			log.Printf("Copy of codebase %s on %s is outdated, it changed while it was copied", codebaseID, node)
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO codebase_replicas (codebase_id, node) VALUES ($1, $2)", codebaseID, node); err != nil {
+			return nil, nil, err
+		}
+		added = append(added, node)
+	}
+
+	var removed []string
+	if len(missingNodes(target, append(current, added...))) == 0 {
+		removed = missingNodes(current, target)
+		for _, node := range removed {
+			if _, err := tx.Exec("DELETE FROM codebase_replicas WHERE codebase_id = $1 AND node = $2", codebaseID, node); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return added, removed, nil
+}
+
+// revisionFiles returns the files recorded for a revision of a codebase,
+// keyed by path.
+func revisionFiles(tx *sql.Tx, codebaseID string, revision int) (map[string]FileInfo, error) {
+	rows, err := tx.Query("SELECT file_path, file_size, COALESCE(sha256, '') FROM files WHERE codebase_id = $1 AND revision = $2",
+		codebaseID, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]FileInfo)
+	for rows.Next() {
+		var f FileInfo
+		if err := rows.Scan(&f.Path, &f.Size, &f.SHA256); err != nil {
+			return nil, err
+		}
+		files[f.Path] = f
+	}
+	return files, rows.Err()
+}
+
+// matchesRecorded reports whether stored files are exactly the recorded
+// ones. Rows recorded before checksums were kept are compared by size.
+func matchesRecorded(stored []FileResult, recorded map[string]FileInfo) bool {
+	if len(stored) != len(recorded) {
+		return false
+	}
+	for _, f := range stored {
+		r, ok := recorded[f.Path]
+		if !ok || r.Size != f.Size || (r.SHA256 != "" && r.SHA256 != f.SHA256) {
+			return false
+		}
+	}
+	return true
+}
+
+// missingNodes returns the nodes of want that are not in have.
+func missingNodes(want, have []string) []string {
+	missing := []string{}
+	for _, node := range want {
+		if !containsNode(have, node) {
+			missing = append(missing, node)
+		}
+	}
+	return missing
+}
+
+func sameNodes(a, b []string) bool {
+	return len(a) == len(b) && len(missingNodes(a, b)) == 0
+}
+
+// runRebalance runs "server-a rebalance", logging every move. With
+// --dry-run it only logs the moves it would make.
+func (s *Server) runRebalance(args []string) error {
+	dryRun := false
+	for _, arg := range args {
+		if arg != "--dry-run" {
+			return fmt.Errorf("unknown argument %q", arg)
+		}
+		dryRun = true
+	}
+
+	report, err := s.rebalance(dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "Moved"
+	if dryRun {
+		verb = "Would move"
+	}
+	for _, move := range report.Moves {
+		log.Printf("%s codebase %s: copied to %v, removed from %v", verb, move.CodebaseID, move.To, move.From)
+	}
+	for _, e := range report.Errors {
+		log.Printf("Error: %s", e)
+	}
+	log.Printf("Rebalanced %d codebases over %d storage nodes: %d moved, %d errors",
+		report.CodebasesChecked, len(report.Nodes), len(report.Moves), len(report.Errors))
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("%d codebases could not be moved", len(report.Errors))
+	}
+	return nil
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errStaleSnapshot = errors.New("codebase changed since storage was inventoried")
+
+// ReconcileReport describes how the metadata database and the storage
+// nodes disagree.
+type ReconcileReport struct {
+	StartedAt           time.Time        `json:"started_at"`
+	FinishedAt          time.Time        `json:"finished_at"`
+	Repair              RepairOpts       `json:"repair"`
+	NodesChecked        int              `json:"nodes_checked"`
+	CodebasesChecked    int              `json:"codebases_checked"`
+	OrphanedDirectories []DirectoryIssue `json:"orphaned_directories"`
+	MissingDirectories  []DirectoryIssue `json:"missing_directories"`
+	UnderReplicated     []string         `json:"under_replicated"`
+	MissingFiles        []FileIssue      `json:"missing_files"`
+	UntrackedFiles      []FileIssue      `json:"untracked_files"`
+	SizeMismatches      []FileIssue      `json:"size_mismatches"`
+	ChecksumMismatches  []FileIssue      `json:"checksum_mismatches"`
+	Repaired            []string         `json:"repaired"`
+	Errors              []string         `json:"errors"`
+}
+
+// DirectoryIssue is a codebase directory on a storage node that should not
+// hold it, or missing from one that should.
+type DirectoryIssue struct {
+	CodebaseID string `json:"directory_id"`
+	Node       string `json:"node"`
+}
+
+type FileIssue struct {
+	CodebaseID     string `json:"directory_id"`
+	Node           string `json:"node"`
+	Path           string `json:"path"`
+	RecordedSize   int64  `json:"recorded_size"`
+	StoredSize     int64  `json:"stored_size"`
+	RecordedSHA256 string `json:"recorded_sha256,omitempty"`
+	StoredSHA256   string `json:"stored_sha256,omitempty"`
+}
+
+// RepairOpts selects which problems a reconciliation run fixes. Without
+// either option a run only reports.
+type RepairOpts struct {
+	DeleteOrphans bool `json:"delete_orphans"`
+	RebuildFiles  bool `json:"rebuild_files"`
+}
+
+type reconciler struct {
+	running sync.Mutex // held for the duration of a run
+	mu      sync.Mutex // guards last
+	last    *ReconcileReport
+}
+
+// reconcile compares every storage node with the codebases, files and
+// codebase_replicas tables.
+func (s *Server) reconcile(opts RepairOpts) (*ReconcileReport, error) {
+	s.reconciler.running.Lock()
+	defer s.reconciler.running.Unlock()
+
+	// A rebalancing run places codebases on nodes and copies them there
+	// before recording them as replicas, so deleting orphans while one
+	// runs could take a copy being made for one
+	if opts.DeleteOrphans {
+		unlock, err := s.lockRebalancing()
+		if err != nil {
+			return nil, fmt.Errorf("delete orphans: %w", err)
+		}
+		defer unlock()
+	}
+
+	report := &ReconcileReport{
+		StartedAt:           time.Now().UTC(),
+		Repair:              opts,
+		OrphanedDirectories: []DirectoryIssue{},
+		MissingDirectories:  []DirectoryIssue{},
+		UnderReplicated:     []string{},
+		MissingFiles:        []FileIssue{},
+		UntrackedFiles:      []FileIssue{},
+		SizeMismatches:      []FileIssue{},
+		ChecksumMismatches:  []FileIssue{},
+		Repaired:            []string{},
+		Errors:              []string{},
+	}
+
+	// The snapshots are taken in this order so that in-flight uploads are
+	// never misreported: metadata is committed before its stage, and the
+	// pending_commits row is only cleared after the stage is committed.
+	// A codebase recorded before the pending commits were read therefore
+	// either is still pending or already has its directory on its
+	// replicas, and a directory found in storage always has its codebase
+	// recorded by the time the files table is read. Replicas are only ever
+	// dropped from a settled codebase, so a node that held it when the
+	// snapshot was taken and no longer does holds stale content or, if
+	// rebalancing moved the codebase off it during the run, none, which is
+	// reported as a missing directory. Generations are read first: a
+	// codebase whose generation is unchanged when its files are rebuilt
+	// has had no change recorded since.
+	generations, err := s.generations()
+	if err != nil {
+		return nil, fmt.Errorf("query generations: %w", err)
+	}
+	replicas, err := s.replicaNodes()
+	if err != nil {
+		return nil, fmt.Errorf("query codebases: %w", err)
+	}
+	settled := make(map[string]bool, len(replicas))
+	for id := range replicas {
+		settled[id] = true
+	}
+
+	pending := make(map[string]bool)
+	rows, err := s.db.Query("SELECT codebase_id FROM pending_commits")
+	if err != nil {
+		return nil, fmt.Errorf("query pending commits: %w", err)
+	}
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			pending[id] = true
+		}
+	}
+	rows.Close()
+
+	// Nodes that cannot be reached are reported and skipped
+	inventories := make(map[string]map[string]map[string]FileInfo)
+	for _, node := range s.storageNodes {
+		stored, err := s.fetchInventory(node)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("fetch inventory of %s: %v", node, err))
+			continue
+		}
+		inventories[node] = stored
+	}
+	if len(inventories) == 0 {
+		return nil, fmt.Errorf("fetch storage inventory: no storage node answered")
+	}
+	report.NodesChecked = len(inventories)
+
+	recorded, err := s.recordedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("query files: %w", err)
+	}
+
+	// Read after the inventories: rebalancing places a codebase on a node
+	// before copying it there, so any copy found is placed by now
+	placed, err := s.placements()
+	if err != nil {
+		return nil, fmt.Errorf("query placements: %w", err)
+	}
+
+	for _, node := range s.storageNodes {
+		for id := range inventories[node] {
+			_, ok := recorded[id]
+			switch {
+			case !ok && !settled[id] && !pending[id]:
+				// Codebases deleted during the run are not orphans
+			case ok && settled[id] && !pending[id] && !containsNode(replicas[id], node) && !containsNode(placed[id], node):
+				// Left behind by a move that was interrupted
+			default:
+				continue
+			}
+			report.OrphanedDirectories = append(report.OrphanedDirectories, DirectoryIssue{CodebaseID: id, Node: node})
+		}
+	}
+	sortDirectoryIssues(report.OrphanedDirectories)
+
+	var rebuild []string
+	rebuildFrom := make(map[string]map[string]FileInfo)
+	for id, files := range recorded {
+		if !settled[id] || pending[id] {
+			continue
+		}
+		report.CodebasesChecked++
+		if len(replicas[id]) < s.replicas {
+			report.UnderReplicated = append(report.UnderReplicated, id)
+		}
+
+		diverged := false
+		for _, node := range rankNodes(id, replicas[id]) {
+			inventory, checked := inventories[node]
+			if !checked {
+				continue
+			}
+			storedFiles, ok := inventory[id]
+			if !ok {
+				report.MissingDirectories = append(report.MissingDirectories, DirectoryIssue{CodebaseID: id, Node: node})
+				continue
+			}
+			if rebuildFrom[id] == nil {
+				rebuildFrom[id] = storedFiles
+			}
+
+			for path, f := range files {
+				storedFile, ok := storedFiles[path]
+				issue := FileIssue{
+					CodebaseID:     id,
+					Node:           node,
+					Path:           path,
+					RecordedSize:   f.Size,
+					StoredSize:     storedFile.Size,
+					RecordedSHA256: f.SHA256,
+					StoredSHA256:   storedFile.SHA256,
+				}
+				switch {
+				case !ok:
+					report.MissingFiles = append(report.MissingFiles, issue)
+					diverged = true
+				case storedFile.Size != f.Size:
+					report.SizeMismatches = append(report.SizeMismatches, issue)
+					diverged = true
+				case f.SHA256 != "" && storedFile.SHA256 != f.SHA256:
+					// Rows recorded before checksums were kept have none
+					report.ChecksumMismatches = append(report.ChecksumMismatches, issue)
+					diverged = true
+				}
+			}
+			for path, f := range storedFiles {
+				if _, ok := files[path]; !ok {
+					report.UntrackedFiles = append(report.UntrackedFiles, FileIssue{CodebaseID: id, Node: node, Path: path, StoredSize: f.Size, StoredSHA256: f.SHA256})
+					diverged = true
+				}
+			}
+		}
+
+		if diverged {
+			rebuild = append(rebuild, id)
+		}
+	}
+	sortDirectoryIssues(report.MissingDirectories)
+	sort.Strings(report.UnderReplicated)
+
+	if opts.DeleteOrphans {
+		for _, orphan := range report.OrphanedDirectories {
+			if err := s.deleteStoredCodebase(orphan.Node, orphan.CodebaseID); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("delete orphan %s from %s: %v", orphan.CodebaseID, orphan.Node, err))
+				continue
+			}
+			report.Repaired = append(report.Repaired, fmt.Sprintf("deleted orphaned directory %s from %s", orphan.CodebaseID, orphan.Node))
+		}
+	}
+
+	if opts.RebuildFiles {
+		sort.Strings(rebuild)
+		for _, id := range rebuild {
+			// From the preferred replica; any others that disagree with it
+			// are reported again by the next run
+			generation, ok := generations[id]
+			if !ok {
+				continue
+			}
+			err := s.rebuildFileRows(id, generation, rebuildFrom[id])
+			if errors.Is(err, errStaleSnapshot) || errors.Is(err, errPendingCommits) || errors.Is(err, errCodebaseNotFound) {
+				report.Errors = append(report.Errors, fmt.Sprintf("rebuild files of %s: skipped, it changed during the run", id))
+				continue
+			}
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("rebuild files of %s: %v", id, err))
+				continue
+			}
+			report.Repaired = append(report.Repaired, fmt.Sprintf("rebuilt file records of %s from storage", id))
+		}
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	s.reconciler.mu.Lock()
+	s.reconciler.last = report
+	s.reconciler.mu.Unlock()
+	return report, nil
+}
+
+func sortDirectoryIssues(issues []DirectoryIssue) {
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].CodebaseID != issues[j].CodebaseID {
+			return issues[i].CodebaseID < issues[j].CodebaseID
+		}
+		return issues[i].Node < issues[j].Node
+	})
+}
+
+// fetchInventory returns every file stored on node keyed by codebase ID and
+// path.
+func (s *Server) fetchInventory(node string) (map[string]map[string]FileInfo, error) {
+	resp, err := s.client.Get(node + "/inventory")
+	s.health.record(node, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStorageError(resp)
+	}
+
+	var inventory struct {
+		Codebases []struct {
+			ID    string     `json:"directory_id"`
+			Files []FileInfo `json:"files"`
+		} `json:"codebases"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inventory); err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]map[string]FileInfo, len(inventory.Codebases))
+	for _, cb := range inventory.Codebases {
+		files := make(map[string]FileInfo, len(cb.Files))
+		for _, f := range cb.Files {
+			files[f.Path] = f
+		}
+		stored[cb.ID] = files
+	}
+	return stored, nil
+}
+
+// replicaNodes returns the nodes holding every codebase, keyed by codebase
+// ID, including codebases no node holds.
+func (s *Server) replicaNodes() (map[string][]string, error) {
+	rows, err := s.db.Query("SELECT id, COALESCE(node, '') FROM codebases LEFT JOIN codebase_replicas ON codebase_replicas.codebase_id = codebases.id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replicas := make(map[string][]string)
+	for rows.Next() {
+		var id, node string
+		if err := rows.Scan(&id, &node); err != nil {
+			return nil, err
+		}
+		if node == "" {
+			replicas[id] = nil
+			continue
+		}
+		replicas[id] = append(replicas[id], node)
+	}
+	return replicas, rows.Err()
+}
+
+// generations returns the generation of every codebase, keyed by codebase
+// ID.
+func (s *Server) generations() (map[string]int, error) {
+	rows, err := s.db.Query("SELECT id, generation FROM codebases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	generations := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var generation int
+		if err := rows.Scan(&id, &generation); err != nil {
+			return nil, err
+		}
+		generations[id] = generation
+	}
+	return generations, rows.Err()
+}
+
+func (s *Server) codebaseIDs() (map[string]bool, error) {
+	rows, err := s.db.Query("SELECT id FROM codebases")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// recordedFiles returns every file in the files table keyed by codebase ID
+// and path, including codebases without any files.
+func (s *Server) recordedFiles() (map[string]map[string]FileInfo, error) {
+	ids, err := s.codebaseIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := make(map[string]map[string]FileInfo, len(ids))
+	for id := range ids {
+		recorded[id] = make(map[string]FileInfo)
+	}
+
+	// Storage inventories the latest revision of each codebase
+	rows, err := s.db.Query(`SELECT codebase_id, file_path, file_name, file_size, COALESCE(sha256, '')
+		FROM files JOIN codebases ON codebases.id = files.codebase_id AND codebases.revision = files.revision`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var f FileInfo
+		if err := rows.Scan(&id, &f.Path, &f.Name, &f.Size, &f.SHA256); err != nil {
+			return nil, err
+		}
+		if files, ok := recorded[id]; ok {
+			files[f.Path] = f
+		}
+	}
+	return recorded, rows.Err()
+}
+
+// rebuildFileRows replaces the files recorded for the latest revision of a
+// codebase with what is actually in storage, as of a snapshot taken when
+// the codebase was at generation. It fails with errStaleSnapshot if a
+// change was recorded since, as the snapshot would undo it, and with
+// errPendingCommits if a change is still being committed.
+func (s *Server) rebuildFileRows(codebaseID string, generation int, stored map[string]FileInfo) error {
+	files := make([]FileInfo, 0, len(stored))
+	for _, f := range stored {
+		files = append(files, f)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	revision, err := lockIdleCodebase(tx, codebaseID)
+	if err != nil {
+		return err
+	}
+	var current int
+	if err := tx.QueryRow("SELECT generation FROM codebases WHERE id = $1", codebaseID).Scan(&current); err != nil {
+		return err
+	}
+	if current != generation {
+		return errStaleSnapshot
+	}
+
+	// Outdates the statistics cached for the codebase, like any change
+	if _, err := tx.Exec("UPDATE codebases SET generation = generation + 1 WHERE id = $1", codebaseID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM files WHERE codebase_id = $1 AND revision = $2", codebaseID, revision); err != nil {
+		return err
+	}
+	if err := insertFiles(tx, codebaseID, revision, files); err != nil {
+		return err
+	}
+	if err := syncFileCount(tx, codebaseID, revision); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Server) deleteStoredCodebase(node, codebaseID string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/codebase/%s", node, codebaseID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	s.health.record(node, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return readStorageError(resp)
+	}
+	return nil
+}
+
+// runReconciler reconciles every interval and logs a summary. Periodic runs
+// only report; repairs are requested explicitly through the admin endpoint.
+func (s *Server) runReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := s.reconcile(RepairOpts{})
+		if err != nil {
+			log.Printf("Reconciliation failed: %v", err)
+			continue
+		}
+		log.Printf("Reconciliation: %d codebases checked on %d storage nodes, %d orphaned directories, %d missing directories, %d under-replicated codebases, %d missing files, %d untracked files, %d size mismatches, %d checksum mismatches",
+			report.CodebasesChecked, report.NodesChecked, len(report.OrphanedDirectories), len(report.MissingDirectories), len(report.UnderReplicated),
+			len(report.MissingFiles), len(report.UntrackedFiles), len(report.SizeMismatches), len(report.ChecksumMismatches))
+	}
+}
+
+// runReconcile handles POST /admin/reconcile. The delete_orphans and
+// rebuild_files query parameters enable repairs.
+func (s *Server) runReconcile(w http.ResponseWriter, r *http.Request) {
+	opts := RepairOpts{
+		DeleteOrphans: r.URL.Query().Get("delete_orphans") == "true",
+		RebuildFiles:  r.URL.Query().Get("rebuild_files") == "true",
+	}
+
+	report, err := s.reconcile(opts)
+	if err != nil {
+		log.Printf("Reconciliation failed: %v", err)
+		respondWithError(w, http.StatusBadGateway, "Reconciliation failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"report":  report,
+	})
+}
+
+// getReconcileReport handles GET /admin/reconcile, returning the most
+// recent report.
+func (s *Server) getReconcileReport(w http.ResponseWriter, r *http.Request) {
+	s.reconciler.mu.Lock()
+	report := s.reconciler.last
+	s.reconciler.mu.Unlock()
+
+	if report == nil {
+		respondWithError(w, http.StatusNotFound, "No reconciliation has run yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"report":  report,
+	})
+}
+
+// getStorageStats handles GET /admin/storage, reporting the usage of every
+// storage node and how much deduplication saves on it.
+func (s *Server) getStorageStats(w http.ResponseWriter, r *http.Request) {
+	type nodeStats struct {
+		Node  string          `json:"node"`
+		Stats json.RawMessage `json:"stats,omitempty"`
+		Error string          `json:"error,omitempty"`
+	}
+
+	nodes := make([]nodeStats, 0, len(s.storageNodes))
+	answered := 0
+	for _, node := range s.storageNodes {
+		stats, err := s.fetchStats(r.Context(), node)
+		if err != nil {
+			log.Printf("Error retrieving statistics of %s: %v", node, err)
+			nodes = append(nodes, nodeStats{Node: node, Error: "Failed to retrieve storage statistics"})
+			continue
+		}
+		nodes = append(nodes, nodeStats{Node: node, Stats: stats})
+		answered++
+	}
+	if answered == 0 {
+		respondWithError(w, http.StatusBadGateway, "Failed to retrieve storage statistics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"nodes":   nodes,
+	})
+}
+
+func (s *Server) fetchStats(ctx context.Context, node string) (json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+"/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	s.health.record(node, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStorageError(resp)
+	}
+
+	var stats json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
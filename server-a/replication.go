@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// nodeRetryAfter is how long a storage node that failed to answer is tried
+// after its replicas rather than before them.
+const nodeRetryAfter = 30 * time.Second
+
+var errNoReplicas = errors.New("no storage node holds the codebase")
+
+// storageNodesFromEnv returns the Server B instances listed in
+// SERVER_B_URLS, or the single one in SERVER_B_URL.
+func storageNodesFromEnv() []string {
+	list := os.Getenv("SERVER_B_URLS")
+	if list == "" {
+		list = os.Getenv("SERVER_B_URL")
+	}
+	if list == "" {
+		list = "http://localhost:8081"
+	}
+
+	var nodes []string
+	seen := make(map[string]bool)
+	for _, node := range strings.Split(list, ",") {
+		node = strings.TrimSuffix(strings.TrimSpace(node), "/")
+		if node != "" && !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// replicationFromEnv reads REPLICATION_FACTOR, how many nodes store each
+// codebase, and WRITE_QUORUM, how many of them must store a change for it
+// to succeed. They default to up to three replicas and a majority.
+func replicationFromEnv(nodes int) (int, int, error) {
+	replicas := nodes
+	if replicas > 3 {
+		replicas = 3
+	}
+	if value := os.Getenv("REPLICATION_FACTOR"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > nodes {
+			return 0, 0, fmt.Errorf("REPLICATION_FACTOR must be between 1 and the %d storage nodes", nodes)
+		}
+		replicas = n
+	}
+
+	quorum := replicas/2 + 1
+	if value := os.Getenv("WRITE_QUORUM"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > replicas {
+			return 0, 0, fmt.Errorf("WRITE_QUORUM must be between 1 and REPLICATION_FACTOR (%d)", replicas)
+		}
+		quorum = n
+	}
+	return replicas, quorum, nil
+}
+
+// storageDialTimeout bounds connecting to a storage node, TLS handshake
+// included.
+const storageDialTimeout = 10 * time.Second
+
+// storageClientFromEnv returns the client every request to the storage
+// nodes goes through. A node that accepts no connection, or does not start
+// answering within STORAGE_TIMEOUT once it has the whole request, fails
+// like one that is down. Response bodies are not bounded, as downloads and
+// exports stream for as long as they need; the request's context ends them
+// when the client that asked goes away.
+func storageClientFromEnv() (*http.Client, error) {
+	timeout := 5 * time.Minute
+	if value := os.Getenv("STORAGE_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("STORAGE_TIMEOUT must be a positive duration")
+		}
+		timeout = d
+	}
+
+	dialer := &net.Dialer{Timeout: storageDialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   storageDialTimeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}, nil
+}
+
+// nodeHealth remembers storage nodes that recently failed to answer, so
+// they are tried last until nodeRetryAfter has passed.
+type nodeHealth struct {
+	mu   sync.Mutex
+	down map[string]time.Time
+}
+
+// record notes whether a request to node got an answer. Requests that
+// were cancelled say nothing about the node.
+func (h *nodeHealth) record(node string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		delete(h.down, node)
+		return
+	}
+	if h.down == nil {
+		h.down = make(map[string]time.Time)
+	}
+	if _, ok := h.down[node]; !ok {
+		log.Printf("Storage node %s is unreachable: %v", node, err)
+	}
+	h.down[node] = time.Now()
+}
+
+func (h *nodeHealth) healthy(node string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since, ok := h.down[node]
+	return !ok || time.Since(since) > nodeRetryAfter
+}
+
+// order returns nodes with the healthy ones first, otherwise keeping their
+// order.
+func (h *nodeHealth) order(nodes []string) []string {
+	ordered := make([]string, 0, len(nodes))
+	var down []string
+	for _, node := range nodes {
+		if h.healthy(node) {
+			ordered = append(ordered, node)
+		} else {
+			down = append(down, node)
+		}
+	}
+	return append(ordered, down...)
+}
+
+// rankNodes orders nodes by rendezvous hashing on id, so every codebase
+// has its own preferred nodes and codebases spread evenly across them.
+func rankNodes(id string, nodes []string) []string {
+	ranked := append([]string(nil), nodes...)
+	score := func(node string) []byte {
+		sum := sha256.Sum256([]byte(node + "\x00" + id))
+		return sum[:]
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return bytes.Compare(score(ranked[i]), score(ranked[j])) > 0
+	})
+	return ranked
+}
+
+// placement chooses the nodes a new codebase or upload session is stored
+// on, passing over nodes that are down while there are enough others.
+func (s *Server) placement(id string) []string {
+	return s.health.order(rankNodes(id, s.storageNodes))[:s.replicas]
+}
+
+// quorum is how many of n nodes a change must reach: the write quorum, or
+// all of them when fewer are left.
+func (s *Server) quorum(n int) int {
+	if n < s.writeQuorum {
+		return n
+	}
+	return s.writeQuorum
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryNodes(q querier, query string, id string) ([]string, error) {
+	rows, err := q.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []string
+	for rows.Next() {
+		var node string
+		if err := rows.Scan(&node); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
+
+// replicasOf returns the nodes holding the current content of a codebase,
+// in the order reads should try them.
+func (s *Server) replicasOf(codebaseID string) ([]string, error) {
+	nodes, err := queryNodes(s.db, "SELECT node FROM codebase_replicas WHERE codebase_id = $1", codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	return s.health.order(rankNodes(codebaseID, nodes)), nil
+}
+
+// codebaseReplicas returns the nodes holding a codebase, writing an error
+// response if there are none.
+func (s *Server) codebaseReplicas(w http.ResponseWriter, codebaseID string) ([]string, bool) {
+	nodes, err := s.replicasOf(codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query codebase replicas")
+		return nil, false
+	}
+	if len(nodes) == 0 {
+		respondWithError(w, http.StatusNotFound, "Codebase not found")
+		return nil, false
+	}
+	return nodes, true
+}
+
+// updateReplicas records which nodes hold a codebase once a change staged
+// on nodes is committed. A new codebase is stored and placed on all of
+// them; an existing one loses the replicas that missed the change, as they
+// now hold stale content. Changes never add replicas to an existing
+// codebase, so a node that missed one change cannot come back with a later
+// one; only rebalancing copies the codebase back to it.
+func updateReplicas(tx *sql.Tx, codebaseID string, nodes []string) error {
+	current, err := queryNodes(tx, "SELECT node FROM codebase_replicas WHERE codebase_id = $1", codebaseID)
+	if err != nil {
+		return err
+	}
+
+	if len(current) == 0 {
+		if _, err := tx.Exec("UPDATE codebases SET placement = $2 WHERE id = $1", codebaseID, pq.Array(nodes)); err != nil {
+			return fmt.Errorf("record placement: %w", err)
+		}
+		for _, node := range nodes {
+			// Nothing to record if the change deleted the codebase
+			_, err := tx.Exec(`INSERT INTO codebase_replicas (codebase_id, node)
+				SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM codebases WHERE id = $1)`,
+				codebaseID, node)
+			if err != nil {
+				return fmt.Errorf("record replica %s: %w", node, err)
+			}
+		}
+		return nil
+	}
+
+	for _, node := range current {
+		if containsNode(nodes, node) {
+			continue
+		}
+		log.Printf("Storage node %s no longer holds codebase %s: it missed a change", node, codebaseID)
+		if _, err := tx.Exec("DELETE FROM codebase_replicas WHERE codebase_id = $1 AND node = $2", codebaseID, node); err != nil {
+			return fmt.Errorf("drop replica %s: %w", node, err)
+		}
+	}
+	return nil
+}
+
+// dropReplica forgets that node holds a codebase, unless it is the last
+// node that does.
+func (s *Server) dropReplica(codebaseID, node string) error {
+	_, err := s.db.Exec(`DELETE FROM codebase_replicas WHERE codebase_id = $1 AND node = $2
+		AND EXISTS (SELECT 1 FROM codebase_replicas WHERE codebase_id = $1 AND node <> $2)`,
+		codebaseID, node)
+	return err
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// replicaStage is a change staged on one storage node.
+type replicaStage struct {
+	Node    string
+	StageID string
+}
+
+// stageAttempt is what one node made of a request to stage a change.
+type stageAttempt struct {
+	replicaStage
+	Files []FileResult
+	Err   error
+}
+
+// settleStages checks that a quorum of the nodes a change was sent to
+// staged it, and staged the same files. Nodes that failed or kept other
+// files than the rest, for instance because they lack content a manifest
+// refers to, are left out and their stages aborted. If there is no quorum
+// every stage is aborted and the error returned is a client error reported
+// by storage if there was one.
+func (s *Server) settleStages(attempts []stageAttempt) ([]replicaStage, []FileResult, error) {
+	reference := -1
+	for i, a := range attempts {
+		if a.Err == nil && (reference < 0 || len(storedFiles(a.Files)) > len(storedFiles(attempts[reference].Files))) {
+			reference = i
+		}
+	}
+
+	var stages, stray []replicaStage
+	var results []FileResult
+	if reference >= 0 {
+		results = attempts[reference].Files
+		want := storedSet(results)
+		for _, a := range attempts {
+			if a.Err != nil {
+				continue
+			}
+			if !sameFiles(storedSet(a.Files), want) {
+				log.Printf("Storage node %s staged other files than its peers, leaving it out", a.Node)
+				stray = append(stray, a.replicaStage)
+				continue
+			}
+			stages = append(stages, a.replicaStage)
+		}
+	}
+
+	var firstErr error
+	for _, a := range attempts {
+		if a.Err == nil {
+			continue
+		}
+		var se *storageError
+		if errors.As(a.Err, &se) && se.Status >= 400 && se.Status < 500 {
+			firstErr = a.Err
+			break
+		}
+		if firstErr == nil {
+			firstErr = a.Err
+		}
+	}
+
+	if len(stages) < s.quorum(len(attempts)) {
+		s.abortStages(append(stages, stray...))
+		if firstErr == nil {
+			return nil, nil, fmt.Errorf("staged the same files on %d of %d storage nodes, %d needed",
+				len(stages), len(attempts), s.quorum(len(attempts)))
+		}
+		if len(stages) > 0 {
+			return nil, nil, fmt.Errorf("staged on %d of %d storage nodes, %d needed: %v",
+				len(stages), len(attempts), s.quorum(len(attempts)), firstErr)
+		}
+		return nil, nil, firstErr
+	}
+
+	for _, a := range attempts {
+		if a.Err != nil {
+			log.Printf("Storage node %s failed to stage a change: %v", a.Node, a.Err)
+		}
+	}
+	s.abortStages(stray)
+	return stages, results, nil
+}
+
+func storedSet(results []FileResult) map[string]string {
+	set := make(map[string]string)
+	for _, f := range storedFiles(results) {
+		set[f.Path] = f.SHA256
+	}
+	return set
+}
+
+func sameFiles(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, sum := range a {
+		if other, ok := b[path]; !ok || other != sum {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeResponse is the answer of one storage node to a replicated request.
+type nodeResponse struct {
+	node string
+	resp *http.Response
+	err  error
+}
+
+// replicator streams a request body to several storage nodes at once,
+// through one pipe per node, so the client's upload is read only once and
+// never held in memory. A node that stops reading early is left behind
+// while the others carry on.
+type replicator struct {
+	nodes     []string
+	pipes     []*io.PipeWriter
+	stopped   []bool
+	responses []nodeResponse
+	wg        sync.WaitGroup
+}
+
+func newReplicator(nodes []string) *replicator {
+	return &replicator{
+		nodes:     nodes,
+		pipes:     make([]*io.PipeWriter, len(nodes)),
+		stopped:   make([]bool, len(nodes)),
+		responses: make([]nodeResponse, len(nodes)),
+	}
+}
+
+// start sends a request to every node, reading its body from what is
+// written to the replicator.
+func (rep *replicator) start(health *nodeHealth, send func(node string, body io.Reader) (*http.Response, error)) {
+	for i, node := range rep.nodes {
+		pr, pw := io.Pipe()
+		rep.pipes[i] = pw
+		rep.wg.Add(1)
+		go func(i int, node string) {
+			defer rep.wg.Done()
+			resp, err := send(node, pr)
+			health.record(node, err)
+			// Unblock the writer if the node stopped reading early
+			pr.CloseWithError(errStorageClosed)
+			rep.responses[i] = nodeResponse{node: node, resp: resp, err: err}
+		}(i, node)
+	}
+}
+
+// Write fails only once every node has stopped reading.
+func (rep *replicator) Write(p []byte) (int, error) {
+	live := 0
+	for i, pw := range rep.pipes {
+		if rep.stopped[i] {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			rep.stopped[i] = true
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errStorageClosed
+	}
+	return len(p), nil
+}
+
+// finish ends the request bodies, with err if writing them failed, and
+// waits for every node's response. The caller must close the bodies of
+// the responses.
+func (rep *replicator) finish(err error) []nodeResponse {
+	for _, pw := range rep.pipes {
+		pw.CloseWithError(err)
+	}
+	rep.wg.Wait()
+	return rep.responses
+}
+
+func closeResponses(responses []nodeResponse) {
+	for _, r := range responses {
+		if r.err == nil {
+			r.resp.Body.Close()
+		}
+	}
+}
+
+// postToStorage is http.Post through the storage client, cancelled with
+// ctx.
+func (s *Server) postToStorage(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return s.client.Do(req)
+}
+
+// getFromReplicas sends a GET request for target to each of nodes in turn
+// and returns the first response that is neither a server error nor a 404,
+// which a replica that lost its data answers. Otherwise it returns the
+// last response, or the last error if no node answered. The requests end
+// with ctx. The caller must close the body of the response.
+func (s *Server) getFromReplicas(ctx context.Context, nodes []string, target string, header http.Header) (*http.Response, error) {
+	var last *http.Response
+	lastErr := errNoReplicas
+	for _, node := range nodes {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+target, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		resp, err := s.client.Do(req)
+		s.health.record(node, err)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if last != nil {
+			last.Body.Close()
+		}
+		last = resp
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusNotFound {
+			return resp, nil
+		}
+		log.Printf("Storage node %s answered %d for %s, trying the next replica", node, resp.StatusCode, target)
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRankNodes(t *testing.T) {
+	nodes := []string{"http://b1:8081", "http://b2:8081", "http://b3:8081", "http://b4:8081"}
+	reversed := []string{nodes[3], nodes[2], nodes[1], nodes[0]}
+
+	first := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		id := fmt.Sprintf("codebase-%d", i)
+		ranked := rankNodes(id, nodes)
+
+		// The ranking depends on the codebase alone, not on the order the
+		// nodes are configured in
+		if other := rankNodes(id, reversed); !reflect.DeepEqual(ranked, other) {
+			t.Fatalf("rankNodes(%s) = %v, but %v for the nodes reversed", id, ranked, other)
+		}
+		sorted := append([]string(nil), ranked...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, nodes) {
+			t.Fatalf("rankNodes(%s) = %v, not a permutation of %v", id, ranked, nodes)
+		}
+
+		// Removing a node keeps the others in the same order, so only
+		// codebases preferring it move
+		without := rankNodes(id, nodes[1:])
+		var kept []string
+		for _, node := range ranked {
+			if node != nodes[0] {
+				kept = append(kept, node)
+			}
+		}
+		if !reflect.DeepEqual(without, kept) {
+			t.Fatalf("rankNodes(%s) = %v, but %v without %s", id, ranked, without, nodes[0])
+		}
+
+		first[ranked[0]]++
+	}
+
+	if nodes[0] != "http://b1:8081" {
+		t.Errorf("rankNodes modified its argument: %v", nodes)
+	}
+	for _, node := range nodes {
+		if n := first[node]; n < 800 || n > 1200 {
+			t.Errorf("%s is preferred by %d of 4000 codebases, want about 1000", node, n)
+		}
+	}
+}
+
+// stageRecorder is a storage node recording the stages aborted on it.
+type stageRecorder struct {
+	mu      sync.Mutex
+	aborted []string
+}
+
+func (r *stageRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodDelete && strings.HasPrefix(req.URL.Path, "/stages/") {
+		r.mu.Lock()
+		r.aborted = append(r.aborted, strings.TrimPrefix(req.URL.Path, "/stages/"))
+		r.mu.Unlock()
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestSettleStages(t *testing.T) {
+	recorder := &stageRecorder{}
+	node := httptest.NewServer(recorder)
+	defer node.Close()
+
+	stored := func(paths ...string) []FileResult {
+		var results []FileResult
+		for _, p := range paths {
+			results = append(results, FileResult{Name: p, Path: p, Status: fileStored, SHA256: "sum-" + p})
+		}
+		return results
+	}
+	files := stored("a.go", "b.go")
+	ok := func(stage string, results []FileResult) stageAttempt {
+		return stageAttempt{replicaStage: replicaStage{Node: node.URL, StageID: stage}, Files: results}
+	}
+	failed := func(err error) stageAttempt {
+		return stageAttempt{replicaStage: replicaStage{Node: node.URL}, Err: err}
+	}
+	unreachable := errors.New("connection refused")
+	badRequest := &storageError{Status: http.StatusBadRequest, Message: "bad manifest"}
+	changed := stored("a.go", "b.go")
+	changed[1].SHA256 = "other"
+
+	tests := []struct {
+		name        string
+		writeQuorum int
+		attempts    []stageAttempt
+		stages      []string
+		aborted     []string
+		err         string
+	}{
+		{
+			name:        "all staged",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{ok("s1", files), ok("s2", files), ok("s3", files)},
+			stages:      []string{"s1", "s2", "s3"},
+		},
+		{
+			name:        "quorum despite a failure",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{ok("s1", files), failed(unreachable), ok("s3", files)},
+			stages:      []string{"s1", "s3"},
+		},
+		{
+			name:        "stray missing a file",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{ok("s1", stored("a.go")), ok("s2", files), ok("s3", files)},
+			stages:      []string{"s2", "s3"},
+			aborted:     []string{"s1"},
+		},
+		{
+			name:        "stray with other content",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{ok("s1", files), ok("s2", files), ok("s3", changed)},
+			stages:      []string{"s1", "s2"},
+			aborted:     []string{"s3"},
+		},
+		{
+			name:        "files other than stored ones do not count",
+			writeQuorum: 2,
+			attempts: []stageAttempt{
+				ok("s1", append(stored("a.go", "b.go"), FileResult{Path: "c.bin", Status: "rejected"})),
+				ok("s2", files),
+			},
+			stages: []string{"s1", "s2"},
+		},
+		{
+			name:        "no quorum",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{ok("s1", files), failed(unreachable), failed(unreachable)},
+			aborted:     []string{"s1"},
+			err:         "staged on 1 of 3 storage nodes, 2 needed: connection refused",
+		},
+		{
+			name:        "no quorum with strays",
+			writeQuorum: 3,
+			attempts:    []stageAttempt{ok("s1", files), ok("s2", files), ok("s3", stored("a.go"))},
+			aborted:     []string{"s1", "s2", "s3"},
+			err:         "staged the same files on 2 of 3 storage nodes, 3 needed",
+		},
+		{
+			name:        "client error wins",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{failed(unreachable), failed(badRequest), failed(unreachable)},
+			err:         badRequest.Error(),
+		},
+		{
+			name:        "every node unreachable",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{failed(unreachable), failed(unreachable)},
+			err:         unreachable.Error(),
+		},
+		{
+			name:        "quorum capped by the nodes tried",
+			writeQuorum: 2,
+			attempts:    []stageAttempt{ok("s1", files)},
+			stages:      []string{"s1"},
+		},
+	}
+	for _, tt := range tests {
+		recorder.aborted = nil
+		s := &Server{client: node.Client(), writeQuorum: tt.writeQuorum}
+		stages, results, err := s.settleStages(tt.attempts)
+
+		var ids []string
+		for _, stage := range stages {
+			ids = append(ids, stage.StageID)
+		}
+		if !reflect.DeepEqual(ids, tt.stages) {
+			t.Errorf("%s: stages %v, want %v", tt.name, ids, tt.stages)
+		}
+		sort.Strings(recorder.aborted)
+		if !reflect.DeepEqual(recorder.aborted, tt.aborted) {
+			t.Errorf("%s: aborted %v, want %v", tt.name, recorder.aborted, tt.aborted)
+		}
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: err %v, want %s", tt.name, err, tt.err)
+		case tt.err == "" && !sameFiles(storedSet(results), storedSet(files)):
+			t.Errorf("%s: results %+v, want %+v", tt.name, results, files)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Revision struct {
+	Revision  int       `json:"revision"`
+	CreatedAt time.Time `json:"created_at"`
+	FileCount int       `json:"file_count"`
+}
+
+// uploadRevision handles POST /codebases/{id}/revisions. It takes the same
+// form as /upload, but instead of creating a codebase it appends a revision
+// to an existing one whose file set is exactly the uploaded files. Earlier
+// revisions stay readable with the rev parameter.
+func (s *Server) uploadRevision(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+
+	// Storage numbers revisions in the order they are committed, so one
+	// still being committed has to finish first
+	pending, err := hasPendingCommits(s.db, codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query pending commits")
+		return
+	}
+	if pending {
+		respondWithError(w, http.StatusConflict, "Codebase has changes still being committed, try again shortly")
+		return
+	}
+
+	var latest int
+	if err := s.db.QueryRow("SELECT revision FROM codebases WHERE id = $1", codebaseID).Scan(&latest); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query codebase")
+		return
+	}
+	revision := latest + 1
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+	owner, ok := s.codebaseOwner(w, codebaseID)
+	if !ok {
+		return
+	}
+	budget, ok := s.budget(w, owner, codebaseID, false)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	stages, results, err := s.forwardFilesToStorage(r.Context(), nodes, codebaseID, revision, reader, budget)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+
+	files := storedFiles(results)
+	if !s.commitStaged(w, stages, codebaseID, s.withinQuota(owner, codebaseID, files, func(tx *sql.Tx) error {
+		return insertRevision(tx, codebaseID, revision, files)
+	})) {
+		return
+	}
+
+	log.Printf("Uploaded revision %d of codebase %s", revision, codebaseID)
+
+	respondWithUpload(w, codebaseID, results)
+}
+
+// insertRevision records a new latest revision of a codebase and its files.
+// It fails if another revision was recorded since revision was chosen.
+func insertRevision(tx *sql.Tx, codebaseID string, revision int, files []FileInfo) error {
+	latest, err := lockIdleCodebase(tx, codebaseID)
+	if err != nil {
+		return err
+	}
+	if latest != revision-1 {
+		return fmt.Errorf("revision %d of codebase %s was uploaded concurrently", latest, codebaseID)
+	}
+
+	_, err = tx.Exec("INSERT INTO revisions (codebase_id, revision, file_count) VALUES ($1, $2, $3)",
+		codebaseID, revision, len(files))
+	if err != nil {
+		return fmt.Errorf("insert revision: %w", err)
+	}
+	if err := insertFiles(tx, codebaseID, revision, files); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE codebases SET revision = $1, file_count = $2 WHERE id = $3",
+		revision, len(files), codebaseID)
+	return err
+}
+
+// listRevisions handles GET /codebases/{id}/revisions, oldest first.
+func (s *Server) listRevisions(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := s.db.Query("SELECT revision, created_at, file_count FROM revisions WHERE codebase_id = $1 ORDER BY revision",
+		codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query revisions")
+		return
+	}
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		if err := rows.Scan(&rev.Revision, &rev.CreatedAt, &rev.FileCount); err != nil {
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"directory_id": codebaseID,
+		"revisions":    revisions,
+	})
+}
+
+// requestedRevision parses the optional rev query parameter, returning 0 for
+// the latest revision. It writes an error response if rev is invalid.
+func requestedRevision(w http.ResponseWriter, r *http.Request) (int, bool) {
+	rev := r.URL.Query().Get("rev")
+	if rev == "" {
+		return 0, true
+	}
+
+	revision, err := strconv.Atoi(rev)
+	if err != nil || revision < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid revision")
+		return 0, false
+	}
+	return revision, true
+}
+
+// revisionQuery validates the optional rev query parameter for forwarding
+// to storage, which serves the latest revision if it is empty.
+func revisionQuery(w http.ResponseWriter, r *http.Request) (string, bool) {
+	revision, ok := requestedRevision(w, r)
+	if !ok || revision == 0 {
+		return "", ok
+	}
+	return strconv.Itoa(revision), true
+}
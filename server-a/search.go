@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// searchCodebase handles GET /codebases/{id}/search?q=..., finding the text
+// files of a codebase that hold every term of q, with their matching lines
+// and the lines around them. path (a glob, repeatable), language,
+// case_sensitive, context, limit and rev are passed on to storage, which
+// searches its index of the codebase.
+func (s *Server) searchCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid directory ID")
+		return
+	}
+	if strings.TrimSpace(query.Get("q")) == "" {
+		respondWithError(w, http.StatusBadRequest, "Search query is required")
+		return
+	}
+	rev, ok := revisionQuery(w, r)
+	if !ok {
+		return
+	}
+
+	params := url.Values{}
+	for _, name := range []string{"q", "path", "language", "case_sensitive", "context", "limit"} {
+		if values, ok := query[name]; ok {
+			params[name] = values
+		}
+	}
+	if rev != "" {
+		params.Set("rev", rev)
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	// Forward request to storage, failing over between replicas
+	resp, err := s.getFromReplicas(r.Context(), nodes, fmt.Sprintf("/search/%s?%s", codebaseID, params.Encode()), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to search codebase on storage")
+		return
+	}
+	defer resp.Body.Close()
+
+	// Copy headers and response
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// grepCodebase handles GET /codebases/{id}/grep?pattern=..., running an RE2
+// regular expression over the text files of a codebase on storage. Matches
+// are streamed back as newline delimited JSON as storage finds them.
+// include and exclude (globs, repeatable), max_results, timeout and rev are
+// passed on to storage.
+func (s *Server) grepCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid directory ID")
+		return
+	}
+	if query.Get("pattern") == "" {
+		respondWithError(w, http.StatusBadRequest, "Pattern is required")
+		return
+	}
+	rev, ok := revisionQuery(w, r)
+	if !ok {
+		return
+	}
+
+	params := url.Values{}
+	for _, name := range []string{"pattern", "include", "exclude", "max_results", "timeout"} {
+		if values, ok := query[name]; ok {
+			params[name] = values
+		}
+	}
+	if rev != "" {
+		params.Set("rev", rev)
+	}
+
+	nodes, ok := s.codebaseReplicas(w, codebaseID)
+	if !ok {
+		return
+	}
+
+	resp, err := s.getFromReplicas(r.Context(), nodes, fmt.Sprintf("/grep/%s?%s", codebaseID, params.Encode()), nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to grep codebase on storage")
+		return
+	}
+	// A client that goes away stops the grep on storage once the next
+	// match fails to reach it, or at the grep's timeout
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	streamBody(w, resp.Body)
+}
+
+// streamBody copies body to w, flushing whatever arrives right away.
+func streamBody(w http.ResponseWriter, body io.Reader) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	MaxChunkSize = 16 << 20 // 16MB
+)
+
+type createUploadSessionRequest struct {
+	Files []struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+// createUploadSession starts a resumable upload. The client declares every
+// file up front and then PUTs chunks of each file at arbitrary offsets. The
+// session is created on the nodes that will store the codebase, so the
+// codebase's ID is chosen here and placed like any other codebase.
+func (s *Server) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var req createUploadSessionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxUploadSize)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session request")
+		return
+	}
+
+	if len(req.Files) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No files declared")
+		return
+	}
+
+	owner, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	budget, ok := s.budget(w, owner, "", false)
+	if !ok {
+		return
+	}
+	for _, f := range req.Files {
+		if err := budget.declare(f.Path, f.Size); err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+	}
+
+	sessionID := uuid.New().String()
+	codebaseID := uuid.New().String()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to encode session request")
+		return
+	}
+
+	var nodes []string
+	var session json.RawMessage
+	var sessionErr error
+	for _, node := range s.placement(codebaseID) {
+		stored, err := s.createStorageSession(r.Context(), node, sessionID, body)
+		if err != nil {
+			log.Printf("Error creating upload session %s on %s: %v", sessionID, node, err)
+			if sessionErr == nil {
+				sessionErr = err
+			}
+			continue
+		}
+		if nodes == nil {
+			session = stored
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) < s.quorum(s.replicas) {
+		s.abortStorageSession(nodes, sessionID)
+		respondWithStorageError(w, sessionErr, "Failed to create session on storage")
+		return
+	}
+
+	if err := s.insertUploadSession(sessionID, codebaseID, owner, nodes); err != nil {
+		s.abortStorageSession(nodes, sessionID)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save upload session")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"upload_id": sessionID,
+		"session":   session,
+	})
+}
+
+// createStorageSession creates a session on one node and returns its
+// description of the session.
+func (s *Server) createStorageSession(ctx context.Context, node, sessionID string, body []byte) (json.RawMessage, error) {
+	resp, err := s.postToStorage(ctx, fmt.Sprintf("%s/sessions/%s", node, sessionID), "application/json", bytes.NewReader(body))
+	s.health.record(node, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStorageError(resp)
+	}
+
+	var stored struct {
+		Session json.RawMessage `json:"session"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("invalid response from storage server")
+	}
+	return stored.Session, nil
+}
+
+// insertUploadSession records a session for owner, the codebase it will be
+// finalized into and the nodes it was created on.
+func (s *Server) insertUploadSession(sessionID, codebaseID, owner string, nodes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO upload_sessions (id, planned_codebase_id, owner) VALUES ($1, $2, $3)", sessionID, codebaseID, owner); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if _, err := tx.Exec("INSERT INTO upload_session_replicas (session_id, node) VALUES ($1, $2)", sessionID, node); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sessionNodes returns the nodes an upload session was created on, writing
+// an error response if the session is unknown.
+func (s *Server) sessionNodes(w http.ResponseWriter, sessionID string) ([]string, bool) {
+	nodes, err := queryNodes(s.db, "SELECT node FROM upload_session_replicas WHERE session_id = $1", sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query upload session")
+		return nil, false
+	}
+	if len(nodes) == 0 {
+		respondWithError(w, http.StatusNotFound, "Upload session not found")
+		return nil, false
+	}
+	return s.health.order(rankNodes(sessionID, nodes)), true
+}
+
+// getUploadSession reports the byte ranges received so far for every file.
+func (s *Server) getUploadSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	nodes, ok := s.sessionNodes(w, sessionID)
+	if !ok {
+		return
+	}
+
+	resp, err := s.getFromReplicas(r.Context(), nodes, "/sessions/"+sessionID, nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Failed to retrieve session from storage")
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// uploadChunk streams one chunk of a file to every node holding the
+// session. The offset is taken from the offset query parameter or, tus
+// style, the Upload-Offset header. A node that misses a chunk cannot
+// stage the session, so chunks have to reach the write quorum too.
+func (s *Server) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	filePath := r.URL.Query().Get("file")
+
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	if filePath == "" {
+		respondWithError(w, http.StatusBadRequest, "File path is required")
+		return
+	}
+
+	offset := r.URL.Query().Get("offset")
+	if offset == "" {
+		offset = r.Header.Get("Upload-Offset")
+	}
+	if offset == "" {
+		respondWithError(w, http.StatusBadRequest, "Offset is required")
+		return
+	}
+
+	if r.ContentLength > MaxChunkSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Chunks are limited to %d bytes", MaxChunkSize))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MaxChunkSize)
+
+	nodes, ok := s.sessionNodes(w, sessionID)
+	if !ok {
+		return
+	}
+
+	chunkPath := fmt.Sprintf("/sessions/%s/chunk?file=%s&offset=%s",
+		sessionID, url.QueryEscape(filePath), url.QueryEscape(offset))
+	rep := newReplicator(nodes)
+	rep.start(&s.health, func(node string, body io.Reader) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, node+chunkPath, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = r.ContentLength
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return s.client.Do(req)
+	})
+	_, copyErr := copyPart(rep, r.Body)
+	responses := rep.finish(copyErr)
+	defer closeResponses(responses)
+
+	if copyErr != nil && !errors.Is(copyErr, errStorageClosed) {
+		respondWithError(w, http.StatusBadRequest, "Failed to read chunk")
+		return
+	}
+
+	// Answer with the first node that stored the chunk if enough did, and
+	// otherwise with the first error storage reported
+	var stored, failed *http.Response
+	count := 0
+	for _, nr := range responses {
+		switch {
+		case nr.err != nil:
+			log.Printf("Error storing chunk of upload session %s on %s: %v", sessionID, nr.node, nr.err)
+		case nr.resp.StatusCode/100 == 2:
+			if stored == nil {
+				stored = nr.resp
+			}
+			count++
+		case failed == nil:
+			failed = nr.resp
+		}
+	}
+	resp := stored
+	if count < s.quorum(len(nodes)) {
+		resp = failed
+	}
+	if resp == nil {
+		respondWithError(w, http.StatusBadGateway, "Failed to store chunk")
+		return
+	}
+
+	if uploadOffset := resp.Header.Get("Upload-Offset"); uploadOffset != "" {
+		w.Header().Set("Upload-Offset", uploadOffset)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// finalizeUploadSession stages a complete session for a new codebase and
+// commits it once the codebase is recorded. Finalizing twice returns the
+// same ID.
+func (s *Server) finalizeUploadSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	var finalized, planned sql.NullString
+	var owner string
+	err := s.db.QueryRow("SELECT codebase_id, planned_codebase_id, owner FROM upload_sessions WHERE id = $1", sessionID).Scan(&finalized, &planned, &owner)
+	if err == sql.ErrNoRows {
+		respondWithError(w, http.StatusNotFound, "Upload session not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query upload session")
+		return
+	}
+
+	if finalized.Valid {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(UploadResponse{
+			Success:     true,
+			Message:     "Upload session already finalized",
+			DirectoryID: finalized.String,
+		})
+		return
+	}
+
+	// Sessions created before their codebase ID was chosen up front get
+	// one now
+	codebaseID := planned.String
+	if !planned.Valid {
+		codebaseID = uuid.New().String()
+	}
+
+	nodes, ok := s.sessionNodes(w, sessionID)
+	if !ok {
+		return
+	}
+
+	stages, results, err := s.stageStorageSession(r.Context(), nodes, sessionID, codebaseID)
+	if err != nil {
+		respondWithStorageError(w, err, "Failed to commit upload session")
+		return
+	}
+
+	// Store metadata in database, then make the session's files visible
+	files := storedFiles(results)
+	if !s.commitStaged(w, stages, codebaseID, s.withinQuota(owner, codebaseID, files, func(tx *sql.Tx) error {
+		if err := insertCodebase(tx, codebaseID, owner, files); err != nil {
+			return err
+		}
+		_, err := tx.Exec("UPDATE upload_sessions SET codebase_id = $1 WHERE id = $2", codebaseID, sessionID)
+		return err
+	})) {
+		return
+	}
+
+	respondWithUpload(w, codebaseID, results)
+}
+
+func (s *Server) abortUploadSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload ID")
+		return
+	}
+
+	nodes, ok := s.sessionNodes(w, sessionID)
+	if !ok {
+		return
+	}
+
+	if err := s.abortStorageSession(nodes, sessionID); err != nil {
+		respondWithStorageError(w, err, "Failed to abort upload session")
+		return
+	}
+
+	if _, err := s.db.Exec("DELETE FROM upload_sessions WHERE id = $1 AND codebase_id IS NULL", sessionID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete upload session")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// stageStorageSession asks the nodes holding a complete session to turn it
+// into a stage for codebaseID.
+func (s *Server) stageStorageSession(ctx context.Context, nodes []string, sessionID, codebaseID string) ([]replicaStage, []FileResult, error) {
+	body, err := json.Marshal(map[string]string{
+		"codebase_id": codebaseID,
+		"exclude":     strings.Join(s.excludes, "\n"),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attempts := make([]stageAttempt, len(nodes))
+	for i, node := range nodes {
+		attempts[i] = s.postStage(ctx, node, fmt.Sprintf("/sessions/%s/stage", sessionID), body)
+	}
+	return s.settleStages(attempts)
+}
+
+// abortStorageSession deletes a session from nodes. It only fails if no
+// node deleted it; the others remove it once it is older than their
+// SESSION_TTL.
+func (s *Server) abortStorageSession(nodes []string, sessionID string) error {
+	var firstErr error
+	deleted := false
+	for _, node := range nodes {
+		err := s.deleteStorageSession(node, sessionID)
+		if err == nil {
+			deleted = true
+			continue
+		}
+		log.Printf("Error aborting upload session %s on %s: %v", sessionID, node, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if deleted {
+		return nil
+	}
+	return firstErr
+}
+
+func (s *Server) deleteStorageSession(node, sessionID string) error {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/sessions/%s", node, sessionID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	s.health.record(node, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return readStorageError(resp)
+	}
+	return nil
+}
+
+// reapUploadSessions periodically deletes the rows of upload sessions that
+// were never finalized and are older than ttl. The storage nodes reap their
+// copies of such sessions after the same SESSION_TTL.
+func (s *Server) reapUploadSessions(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := s.db.Exec("DELETE FROM upload_sessions WHERE codebase_id IS NULL AND created_at < $1", time.Now().Add(-ttl))
+		if err != nil {
+			log.Printf("Error reaping upload sessions: %v", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Reaped %d abandoned upload sessions", n)
+		}
+	}
+}
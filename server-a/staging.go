@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// commitStaged records metadata for files that the storage nodes hold in
+// stages and then tells them to commit the stages, so metadata and stored
+// files never diverge:
+//
+//   - if record fails the transaction is rolled back and the stages aborted;
+//   - if committing the transaction fails the stages are left alone, as the
+//     transaction may have committed anyway, and reapStages resolves them;
+//   - otherwise the nodes holding the codebase and the decision to commit
+//     are logged in codebase_replicas and pending_commits within the same
+//     transaction, and once that transaction commits the stages are
+//     committed on storage, retrying in the background until they succeed.
+//
+// It writes an error response and returns false if the metadata could not
+// be saved.
+func (s *Server) commitStaged(w http.ResponseWriter, stages []replicaStage, codebaseID string, record func(*sql.Tx) error) bool {
+	tx, err := s.db.Begin()
+	if err != nil {
+		s.abortStages(stages)
+		respondWithError(w, http.StatusInternalServerError, "Database transaction failed")
+		return false
+	}
+	defer tx.Rollback()
+
+	if err := record(tx); err != nil {
+		s.abortStages(stages)
+		var qe *quotaError
+		if errors.As(err, &qe) {
+			respondWithError(w, qe.Status, qe.Message)
+			return false
+		}
+		if errors.Is(err, errPendingCommits) {
+			respondWithError(w, http.StatusConflict, "Codebase has changes still being committed, try again shortly")
+			return false
+		}
+		log.Printf("Error saving codebase %s: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save codebase metadata")
+		return false
+	}
+
+	// Outdates the statistics cached for the codebase
+	if _, err := tx.Exec("UPDATE codebases SET generation = generation + 1 WHERE id = $1", codebaseID); err != nil {
+		s.abortStages(stages)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save codebase metadata")
+		return false
+	}
+
+	nodes := make([]string, len(stages))
+	for i, stage := range stages {
+		nodes[i] = stage.Node
+	}
+	if err := updateReplicas(tx, codebaseID, nodes); err != nil {
+		log.Printf("Error saving replicas of codebase %s: %v", codebaseID, err)
+		s.abortStages(stages)
+		respondWithError(w, http.StatusInternalServerError, "Failed to save codebase metadata")
+		return false
+	}
+
+	for _, stage := range stages {
+		_, err := tx.Exec("INSERT INTO pending_commits (stage_id, codebase_id, node) VALUES ($1, $2, $3)",
+			stage.StageID, codebaseID, stage.Node)
+		if err != nil {
+			s.abortStages(stages)
+			respondWithError(w, http.StatusInternalServerError, "Failed to save codebase metadata")
+			return false
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		// The commit may still have reached the database, so the stages
+		// are left for reapStages, which aborts them only if no
+		// pending_commits row names them
+		log.Printf("Error committing metadata of codebase %s: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return false
+	}
+
+	// The metadata is durable, so from here on the stages are only ever
+	// committed, never aborted
+	for _, stage := range stages {
+		if err := s.finishCommit(stage, codebaseID); err != nil {
+			log.Printf("Commit of stage %s on %s for codebase %s deferred: %v", stage.StageID, stage.Node, codebaseID, err)
+		}
+	}
+	return true
+}
+
+// finishCommit commits a stage on its storage node and clears its
+// pending_commits entry. Committing is idempotent on Server B, so retries
+// are safe. The commit is not tied to the request that made the change, as
+// the change is already recorded and a client going away must not hold it
+// up.
+func (s *Server) finishCommit(stage replicaStage, codebaseID string) error {
+	resp, err := s.client.Post(fmt.Sprintf("%s/stages/%s/commit", stage.Node, stage.StageID), "application/json", nil)
+	s.health.record(stage.Node, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// Storage reaped or lost the stage; retrying cannot help. The node
+		// no longer holds the codebase's current content, unless it is the
+		// last one, in which case the reconciler reports the missing files
+		log.Printf("ERROR: stage %s for codebase %s no longer exists on storage node %s", stage.StageID, codebaseID, stage.Node)
+		if err := s.dropReplica(codebaseID, stage.Node); err != nil {
+			return err
+		}
+	default:
+		return readStorageError(resp)
+	}
+
+	_, err = s.db.Exec("DELETE FROM pending_commits WHERE stage_id = $1", stage.StageID)
+	return err
+}
+
+func (s *Server) abortStages(stages []replicaStage) {
+	for _, stage := range stages {
+		s.abortStage(stage)
+	}
+}
+
+// abortStage aborts a stage on its storage node, whether or not the client
+// whose change it held is still there.
+func (s *Server) abortStage(stage replicaStage) {
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/stages/%s", stage.Node, stage.StageID), nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := s.client.Do(req)
+	s.health.record(stage.Node, err)
+	if err != nil {
+		// reapStages aborts the stage once it times out
+		log.Printf("Error aborting stage %s on %s: %v", stage.StageID, stage.Node, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// retryPendingCommits periodically re-sends commits that could not be
+// delivered when the metadata was saved.
+func (s *Server) retryPendingCommits(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := s.db.Query("SELECT stage_id, codebase_id, node FROM pending_commits WHERE created_at < CURRENT_TIMESTAMP - $1::interval",
+			fmt.Sprintf("%d seconds", int(interval.Seconds())))
+		if err != nil {
+			log.Printf("Error querying pending commits: %v", err)
+			continue
+		}
+
+		type pendingCommit struct {
+			stage      replicaStage
+			codebaseID string
+		}
+		var pending []pendingCommit
+		for rows.Next() {
+			var p pendingCommit
+			if err := rows.Scan(&p.stage.StageID, &p.codebaseID, &p.stage.Node); err == nil {
+				pending = append(pending, p)
+			}
+		}
+		rows.Close()
+
+		for _, p := range pending {
+			if err := s.finishCommit(p.stage, p.codebaseID); err != nil {
+				log.Printf("Retrying commit of stage %s on %s for codebase %s failed: %v", p.stage.StageID, p.stage.Node, p.codebaseID, err)
+			}
+		}
+	}
+}
+
+// reapStages periodically aborts the stages storage nodes have held for
+// longer than timeout without pending_commits naming them, which are left
+// by uploads that failed or whose metadata transaction ended in doubt. A
+// stage pending_commits names is committed, however old.
+func (s *Server) reapStages(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-timeout)
+		for _, node := range s.storageNodes {
+			stages, err := s.fetchStages(node)
+			if err != nil {
+				log.Printf("Error listing stages on %s: %v", node, err)
+				continue
+			}
+
+			for _, stage := range stages {
+				if !stage.CreatedAt.Before(cutoff) {
+					continue
+				}
+				var pending bool
+				err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pending_commits WHERE stage_id = $1)", stage.ID).Scan(&pending)
+				if err != nil {
+					log.Printf("Error checking pending commits for stage %s: %v", stage.ID, err)
+					continue
+				}
+				if pending {
+					continue
+				}
+				s.abortStage(replicaStage{Node: node, StageID: stage.ID})
+				log.Printf("Aborted abandoned stage %s on %s for codebase %s", stage.ID, node, stage.CodebaseID)
+			}
+		}
+	}
+}
+
+// storedStage is a stage a storage node holds, neither committed nor
+// aborted.
+type storedStage struct {
+	ID         string    `json:"id"`
+	CodebaseID string    `json:"codebase_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (s *Server) fetchStages(node string) ([]storedStage, error) {
+	resp, err := s.client.Get(node + "/stages")
+	s.health.record(node, err)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStorageError(resp)
+	}
+
+	var list struct {
+		Stages []storedStage `json:"stages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Stages, nil
+}
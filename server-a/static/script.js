@@ -16,6 +16,13 @@ window.onload = function () {
         fileInput.removeAttribute("webkitdirectory");
         fileInput.removeAttribute("directory");
       }
+      if (this.value === "archive") {
+        fileInput.removeAttribute("multiple");
+        fileInput.setAttribute("accept", ".zip,.tar,.tar.gz,.tgz,.tar.zst,.tzst");
+      } else {
+        fileInput.setAttribute("multiple", "");
+        fileInput.setAttribute("accept", "*/*");
+      }
       fileInput.value = ""; // Clear current selection
       document.getElementById("file-info").style.display = "none";
       document.getElementById("upload-btn").disabled = true;
@@ -135,18 +142,36 @@ async function uploadFiles() {
 
   const formData = new FormData();
   let processedFiles = 0;
+  let endpoint = `${API_BASE}/upload`;
 
-  for (let file of files) {
-    formData.append("files", file);
+  if (uploadType === "archive") {
+    // The server extracts the archive, so only the single file is sent
+    formData.append("archive", files[0]);
+    endpoint = `${API_BASE}/upload/archive`;
+    progressBar.style.width = "50%";
+  }
 
-    // Handle path based on upload type
-    if (uploadType === "directory" && file.webkitRelativePath) {
-      // For directory uploads, use the relative path
-      formData.append(`path_${file.name}`, file.webkitRelativePath);
-    } else {
-      // For individual files, just use the filename
-      formData.append(`path_${file.name}`, file.name);
-    }
+  if (uploadType !== "archive") {
+    // The manifest describes every file part by its index, so files with
+    // the same name in different directories keep their own paths
+    const manifest = { version: 2, files: [] };
+    Array.from(files).forEach((file, index) => {
+      manifest.files.push({
+        part: index,
+        // For directory uploads use the relative path, otherwise the name
+        path:
+          uploadType === "directory" && file.webkitRelativePath
+            ? file.webkitRelativePath
+            : file.name,
+        size: file.size,
+        mtime: new Date(file.lastModified).toISOString(),
+      });
+    });
+    formData.append("manifest", JSON.stringify(manifest));
+  }
+
+  for (let file of uploadType === "archive" ? [] : files) {
+    formData.append("files", file);
 
     processedFiles++;
 
@@ -156,7 +181,7 @@ async function uploadFiles() {
   }
 
   try {
-    const response = await fetch(`${API_BASE}/upload`, {
+    const response = await fetch(endpoint, {
       method: "POST",
       body: formData,
     });
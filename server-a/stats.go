@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxStatsRefreshes bounds how many breakdowns missing from the
+	// codebase list are computed in the background at once.
+	maxStatsRefreshes = 2
+	// summaryLanguages is how many languages the codebase list shows.
+	summaryLanguages = 3
+)
+
+// LanguageStats is what a codebase holds in one language.
+type LanguageStats struct {
+	Language   string  `json:"language"`
+	Files      int     `json:"files"`
+	Bytes      int64   `json:"bytes"`
+	Lines      int64   `json:"lines"`
+	Percentage float64 `json:"percentage"`
+}
+
+// CodebaseStats breaks a revision of a codebase down by language. Vendored,
+// generated, documentation and data files and files of no known language
+// are left out and counted by reason in Excluded.
+type CodebaseStats struct {
+	Languages  []LanguageStats `json:"languages"`
+	Excluded   map[string]int  `json:"excluded"`
+	ComputedAt time.Time       `json:"computed_at"`
+}
+
+// LanguageShare is a language's share of a codebase in the codebase list.
+type LanguageShare struct {
+	Language   string  `json:"language"`
+	Percentage float64 `json:"percentage"`
+}
+
+// statsRefresher tracks the breakdowns computed in the background.
+type statsRefresher struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// getCodebaseStats handles GET /codebases/{id}/stats?rev=n, breaking a
+// revision of a codebase, the latest by default, down by language.
+func (s *Server) getCodebaseStats(w http.ResponseWriter, r *http.Request) {
+	codebaseID, ok := s.existingCodebase(w, r)
+	if !ok {
+		return
+	}
+	revision, ok := requestedRevision(w, r)
+	if !ok {
+		return
+	}
+
+	var latest int
+	if err := s.db.QueryRow("SELECT revision FROM codebases WHERE id = $1", codebaseID).Scan(&latest); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to query codebase")
+		return
+	}
+	if revision == 0 {
+		revision = latest
+	}
+	if revision > latest {
+		respondWithError(w, http.StatusNotFound, "Revision not found")
+		return
+	}
+
+	stats, err := s.codebaseStats(r.Context(), codebaseID, revision)
+	var se *storageError
+	if errors.As(err, &se) {
+		respondWithError(w, se.Status, se.Message)
+		return
+	}
+	if err != nil {
+		log.Printf("Error computing language breakdown of codebase %s: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to compute codebase statistics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"directory_id": codebaseID,
+		"revision":     revision,
+		"languages":    stats.Languages,
+		"excluded":     stats.Excluded,
+		"computed_at":  stats.ComputedAt,
+	})
+}
+
+// codebaseStats returns the breakdown of a revision from codebase_stats,
+// or has storage compute it and caches it there. Cached breakdowns are
+// kept with the generation of the codebase, which every change bumps, so
+// one that is out of date is never returned.
+func (s *Server) codebaseStats(ctx context.Context, codebaseID string, revision int) (*CodebaseStats, error) {
+	var generation int
+	if err := s.db.QueryRow("SELECT generation FROM codebases WHERE id = $1", codebaseID).Scan(&generation); err != nil {
+		return nil, err
+	}
+
+	var cached []byte
+	var computedAt time.Time
+	err := s.db.QueryRow(`SELECT stats, computed_at FROM codebase_stats
+		WHERE codebase_id = $1 AND revision = $2 AND generation = $3`,
+		codebaseID, revision, generation).Scan(&cached, &computedAt)
+	if err == nil {
+		stats := &CodebaseStats{ComputedAt: computedAt}
+		if err := json.Unmarshal(cached, stats); err == nil {
+			return stats, nil
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	stats, err := s.fetchLanguageStats(ctx, codebaseID, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	// Storage may not have applied a recorded change yet, so what it
+	// reported could belong to an older generation
+	pending, err := hasPendingCommits(s.db, codebaseID)
+	if err != nil || pending {
+		return stats, nil
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.Exec(`INSERT INTO codebase_stats (codebase_id, revision, generation, stats, computed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (codebase_id, revision) DO UPDATE
+		SET generation = EXCLUDED.generation, stats = EXCLUDED.stats, computed_at = EXCLUDED.computed_at`,
+		codebaseID, revision, generation, data, stats.ComputedAt)
+	if err != nil {
+		// Deleted in the meantime, most likely
+		log.Printf("Error caching language breakdown of codebase %s: %v", codebaseID, err)
+	}
+	return stats, nil
+}
+
+// fetchLanguageStats has a replica of the codebase break a revision down.
+func (s *Server) fetchLanguageStats(ctx context.Context, codebaseID string, revision int) (*CodebaseStats, error) {
+	nodes, err := s.replicasOf(codebaseID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.getFromReplicas(ctx, nodes, fmt.Sprintf("/languages/%s?rev=%d", codebaseID, revision), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStorageError(resp)
+	}
+	stats := &CodebaseStats{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, fmt.Errorf("invalid response from storage server")
+	}
+	stats.ComputedAt = time.Now().UTC()
+	return stats, nil
+}
+
+// languageSummary returns the largest languages of a cached breakdown, or
+// nil if it cannot be read.
+func languageSummary(cached []byte) []LanguageShare {
+	var stats CodebaseStats
+	if err := json.Unmarshal(cached, &stats); err != nil {
+		return nil
+	}
+	shares := []LanguageShare{}
+	for _, language := range stats.Languages {
+		if len(shares) == summaryLanguages {
+			break
+		}
+		shares = append(shares, LanguageShare{Language: language.Language, Percentage: language.Percentage})
+	}
+	return shares
+}
+
+// refreshStats computes the breakdown of the latest revision of a codebase
+// in the background, unless it is already being computed or enough others
+// are; the codebase list asks again next time.
+func (s *Server) refreshStats(codebaseID string, revision int) {
+	s.statsRefresher.mu.Lock()
+	if s.statsRefresher.running == nil {
+		s.statsRefresher.running = make(map[string]bool)
+	}
+	if s.statsRefresher.running[codebaseID] || len(s.statsRefresher.running) >= maxStatsRefreshes {
+		s.statsRefresher.mu.Unlock()
+		return
+	}
+	s.statsRefresher.running[codebaseID] = true
+	s.statsRefresher.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.statsRefresher.mu.Lock()
+			delete(s.statsRefresher.running, codebaseID)
+			s.statsRefresher.mu.Unlock()
+		}()
+		if _, err := s.codebaseStats(context.Background(), codebaseID, revision); err != nil {
+			log.Printf("Error computing language breakdown of codebase %s: %v", codebaseID, err)
+		}
+	}()
+}
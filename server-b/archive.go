@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	MaxExtractedSize    = 1 << 30   // 1GB across all entries
+	MaxExtractedFile    = 256 << 20 // 256MB for a single entry
+	MaxArchiveEntries   = 100000
+	MaxCompressionRatio = 200
+
+	// tarEntryOverhead is what a tar entry may add to its content: the
+	// header block, long name records and the padding after the content
+	tarEntryOverhead = 2 << 10
+)
+
+var (
+	errUnsupportedArchive = errors.New("unsupported archive format")
+	errArchiveTooLarge    = errors.New("archive expands beyond the allowed size")
+	errTooManyEntries     = errors.New("archive contains too many entries")
+	errMalformedArchive   = errors.New("malformed archive")
+)
+
+// extractLimits tracks how much an archive has expanded so far so that
+// decompression bombs are stopped on actual bytes written rather than the
+// sizes claimed in archive headers.
+type extractLimits struct {
+	entries int
+	total   int64
+}
+
+func (l *extractLimits) addEntry() error {
+	l.entries++
+	if l.entries > MaxArchiveEntries {
+		return errTooManyEntries
+	}
+	return nil
+}
+
+// extractArchive receives a codebase ID and a single archive part, then
+// unpacks the archive into a stage for the codebase.
+func (s *StorageServer) extractArchive(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	part, err := reader.NextPart()
+	if err != nil || part.FormName() != "codebase_id" {
+		respondWithError(w, http.StatusBadRequest, "Codebase ID is required")
+		return
+	}
+	codebaseID, err := readFormValue(part)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Codebase ID is required")
+		return
+	}
+
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	// Server-wide exclude patterns may come before the archive
+	var excludes string
+	part, err = reader.NextPart()
+	if err == nil && part.FormName() == "exclude" {
+		if excludes, err = readFormValue(part); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid form data")
+			return
+		}
+		part, err = reader.NextPart()
+	}
+	if err != nil || part.FormName() != "archive" {
+		respondWithError(w, http.StatusBadRequest, "Archive is required")
+		return
+	}
+
+	if _, err := s.backend.Stat(treeKey(codebaseID)); err == nil {
+		respondWithError(w, http.StatusConflict, "Codebase already exists")
+		return
+	}
+
+	// Zip needs random access, so every archive is spooled to disk first
+	spool, err := os.CreateTemp(s.baseStorageDir, ".archive-*")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create temporary file")
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	archiveSize, err := io.Copy(spool, part)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+		return
+	}
+
+	// Extract into a stage that Server A commits once the files are recorded
+	st, err := s.newStage(codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create extraction directory")
+		return
+	}
+
+	files, err := extractInto(s.stageFilesDir(st.ID), spool, archiveSize, part.FileName())
+	if err != nil {
+		s.discardStage(st.ID)
+	}
+	switch {
+	case errors.Is(err, errUnsupportedArchive):
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported archive format (expected .zip, .tar, .tar.gz or .tar.zst)")
+		return
+	case errors.Is(err, errArchiveTooLarge), errors.Is(err, errTooManyEntries):
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Archive rejected: %v", err))
+		return
+	case errors.Is(err, errMalformedArchive):
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Archive rejected: %v", err))
+		return
+	case err != nil:
+		log.Printf("Error extracting archive for codebase %s: %v", codebaseID, err)
+		respondWithError(w, http.StatusBadRequest, "Failed to extract archive")
+		return
+	}
+
+	applyIgnoreRules(s.stageFilesDir(st.ID), files, excludes)
+	storedCount, totalSize := storedTotals(files)
+
+	if storedCount == 0 {
+		s.discardStage(st.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Archive contains no files that could be extracted",
+			"files":   files,
+		})
+		return
+	}
+
+	if err := s.recordStageFiles(st, files); err != nil {
+		log.Printf("Error recording stage %s: %v", st.ID, err)
+		s.discardStage(st.ID)
+		respondWithError(w, http.StatusInternalServerError, "Failed to stage extracted files")
+		return
+	}
+
+	log.Printf("Extracted archive %s for codebase %s into stage %s: %d files, %d bytes", part.FileName(), codebaseID, st.ID, storedCount, totalSize)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StoreResponse{
+		Success: true,
+		Message: fmt.Sprintf("Successfully extracted %d files (%d bytes total), %d rejected, %d ignored", storedCount, totalSize, countStatus(files, fileRejected), countStatus(files, fileIgnored)),
+		StageID: st.ID,
+		Files:   files,
+	})
+}
+
+// extractInto detects the archive format from its magic bytes, falling back
+// to the file name, and unpacks it into dir.
+func extractInto(dir string, archive *os.File, size int64, name string) ([]FileResult, error) {
+	header := make([]byte, 512)
+	n, _ := archive.ReadAt(header, 0)
+	header = header[:n]
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	lowerName := strings.ToLower(name)
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")), bytes.HasPrefix(header, []byte("PK\x05\x06")):
+		return extractZip(dir, archive, size)
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bufio.NewReader(archive))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return extractTar(dir, gz)
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(bufio.NewReader(archive))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return extractTar(dir, zr)
+	case len(header) > 262 && string(header[257:262]) == "ustar", strings.HasSuffix(lowerName, ".tar"):
+		return extractTar(dir, archive)
+	}
+
+	return nil, errUnsupportedArchive
+}
+
+func extractZip(dir string, archive *os.File, size int64) ([]FileResult, error) {
+	zr, err := zip.NewReader(archive, size)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := &extractLimits{}
+	var files []FileResult
+
+	for _, entry := range zr.File {
+		if err := limits.addEntry(); err != nil {
+			return nil, err
+		}
+
+		mode := entry.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			log.Printf("Skipping non-regular zip entry %s (%v)", entry.Name, mode)
+			files = append(files, rejectedResult(entry.Name, 0, "links and special files are not extracted"))
+			continue
+		}
+
+		// Reject entries whose declared ratio alone marks them as bombs
+		if entry.CompressedSize64 > 0 && entry.UncompressedSize64/entry.CompressedSize64 > MaxCompressionRatio {
+			return nil, fmt.Errorf("%w: %s has compression ratio above %d", errArchiveTooLarge, entry.Name, MaxCompressionRatio)
+		}
+
+		src, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+		result, err := writeEntry(dir, entry.Name, src, limits)
+		src.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, result)
+	}
+
+	return files, nil
+}
+
+// extractTar unpacks a tar stream into dir. Every byte of the stream counts
+// towards MaxExtractedSize, not only the content of the files written, so
+// a compressed stream is never decompressed much further than the files
+// it may yield.
+func extractTar(dir string, src io.Reader) ([]FileResult, error) {
+	tr := tar.NewReader(&cappedReader{r: src, n: MaxExtractedSize + MaxArchiveEntries*tarEntryOverhead})
+	limits := &extractLimits{}
+	var files []FileResult
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := limits.addEntry(); err != nil {
+			return nil, err
+		}
+
+		// Content of entries that are not extracted would still have to be
+		// read past
+		if header.Typeflag != tar.TypeReg && header.Size > 0 {
+			return nil, fmt.Errorf("%w: %s is not a regular file but has content", errMalformedArchive, header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			result, err := writeEntry(dir, header.Name, tr, limits)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, result)
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			// Directories are created on demand for the files inside them
+		default:
+			// Symlinks, hard links and device nodes are never materialised
+			log.Printf("Skipping non-regular tar entry %s (type %c)", header.Name, header.Typeflag)
+			files = append(files, rejectedResult(header.Name, 0, "links and special files are not extracted"))
+		}
+	}
+
+	return files, nil
+}
+
+// cappedReader reads from r, failing with errArchiveTooLarge once more
+// than n bytes have been read.
+type cappedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	if c.n < 0 {
+		return n, errArchiveTooLarge
+	}
+	return n, err
+}
+
+// writeEntry writes one archive entry below dir. Entries whose names escape
+// dir are rejected; exceeding the size limits aborts the whole extraction.
+func writeEntry(dir, name string, src io.Reader, limits *extractLimits) (FileResult, error) {
+	relativePath, ok := cleanRelativePath(strings.TrimLeft(filepath.FromSlash(name), string(filepath.Separator)))
+	if !ok {
+		log.Printf("Skipping archive entry with unsafe path: %s", name)
+		return rejectedResult(name, 0, "path escapes the codebase directory"), nil
+	}
+
+	fullPath := filepath.Join(dir, relativePath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return FileResult{}, err
+	}
+
+	// O_EXCL also refuses to follow anything already at the target path
+	dst, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		log.Printf("Skipping duplicate archive entry: %s", name)
+		return rejectedResult(relativePath, 0, "duplicate entry in archive"), nil
+	}
+	if err != nil {
+		return FileResult{}, err
+	}
+	defer dst.Close()
+
+	remaining := MaxExtractedSize - limits.total
+	if remaining > MaxExtractedFile {
+		remaining = MaxExtractedFile
+	}
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(dst, hasher), io.LimitReader(src, remaining+1))
+	if err != nil {
+		return FileResult{}, err
+	}
+	if written > remaining {
+		return FileResult{}, fmt.Errorf("%w: %s", errArchiveTooLarge, name)
+	}
+	limits.total += written
+
+	return storedResult(relativePath, written, hex.EncodeToString(hasher.Sum(nil))), nil
+}
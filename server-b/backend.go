@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend stores the objects that make up Server B's durable state: blobs,
+// codebase trees and data keys. Keys are slash separated paths such as
+// .trees/<id>.json. Uploads in progress are staged on local disk under
+// STORAGE_DIR whatever the backend. Get and Stat of a missing object fail
+// with an error for which os.IsNotExist is true.
+type Backend interface {
+	// Put stores size bytes read from r under key, replacing any object
+	// there. Readers see either the old or the new object.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens an object for reading.
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (ObjectInfo, error)
+	// List returns the objects whose key starts with prefix and has no
+	// slash after it, sorted by key.
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(key string) error
+	// Walk calls fn for every object whose key starts with prefix.
+	Walk(prefix string, fn func(ObjectInfo) error) error
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// fileMover is implemented by backends that can take over a local file
+// without copying it.
+type fileMover interface {
+	MoveFile(key, path string) error
+}
+
+func notFound(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
+
+// newBackend returns the backend chosen by STORAGE_BACKEND.
+func newBackend(kind, baseDir string) (Backend, error) {
+	switch kind {
+	case "", "local":
+		return &localBackend{root: baseDir}, nil
+	case "memory":
+		return newMemoryBackend(), nil
+	case "s3":
+		return newS3BackendFromEnv()
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, expected local, memory or s3", kind)
+}
+
+// putFile moves the local file at path into the backend as key.
+func putFile(b Backend, key, path string) error {
+	if m, ok := b.(fileMover); ok {
+		return m.MoveFile(key, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(key, f, info.Size()); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func readObject(b Backend, key string) ([]byte, error) {
+	r, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func writeObject(b Backend, key string, data []byte) error {
+	return b.Put(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// localBackend keeps objects as files under root, in the layout Server B
+// has always used.
+type localBackend struct {
+	root string
+}
+
+// localTempPrefix marks files being written by Put.
+const localTempPrefix = ".put-"
+
+func (l *localBackend) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+func (l *localBackend) Put(key string, r io.Reader, size int64) error {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), localTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (l *localBackend) MoveFile(key, path string) error {
+	dst := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, dst)
+}
+
+func (l *localBackend) Get(key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+func (l *localBackend) Stat(key string) (ObjectInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, notFound("stat", key)
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *localBackend) List(prefix string) ([]ObjectInfo, error) {
+	dir, namePrefix := path.Split(prefix)
+	entries, err := os.ReadDir(l.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, namePrefix) || strings.HasPrefix(name, localTempPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, ObjectInfo{Key: dir + name, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (l *localBackend) Delete(key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Drop directories like .revisions/<id> once empty; top level ones such
+	// as .trees stay, as a concurrent Put may be about to use them
+	if strings.Count(key, "/") >= 2 {
+		os.Remove(filepath.Dir(l.path(key)))
+	}
+	return nil
+}
+
+func (l *localBackend) Walk(prefix string, fn func(ObjectInfo) error) error {
+	dir, namePrefix := path.Split(prefix)
+	err := filepath.WalkDir(l.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localTempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, dir+namePrefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// memoryBackend keeps objects in memory. Nothing survives a restart, so it
+// is only meant for tests and trying the server out.
+type memoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{objects: make(map[string]memoryObject)}
+}
+
+func (m *memoryBackend) Put(key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *memoryBackend) Get(key string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, notFound("get", key)
+	}
+	// Objects are replaced, never modified, so the data can be shared
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func (m *memoryBackend) Stat(key string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, notFound("stat", key)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime}, nil
+}
+
+func (m *memoryBackend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	m.Walk(prefix, func(info ObjectInfo) error {
+		if !strings.Contains(info.Key[len(prefix):], "/") {
+			objects = append(objects, info)
+		}
+		return nil
+	})
+	return objects, nil
+}
+
+func (m *memoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryBackend) Walk(prefix string, fn func(ObjectInfo) error) error {
+	// Collect first, so fn may modify the backend
+	m.mu.RLock()
+	var objects []ObjectInfo
+	for key, object := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime})
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	for _, object := range objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend checks the behaviour every Backend must share.
+func testBackend(t *testing.T, b Backend) {
+	t.Helper()
+
+	objects := map[string]string{
+		".blobs/aa/one":       "first",
+		".blobs/aa/two":       "second",
+		".blobs/aa/three":     "third",
+		".blobs/bb/four":      "fourth",
+		".trees/x.json":       `{"files":{}}`,
+		".trees/y.json":       `{}`,
+		".trees/empty.json":   "",
+		".revisions/x/1.json": "revision one",
+	}
+	for key, data := range objects {
+		if err := writeObject(b, key, []byte(data)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	for key, data := range objects {
+		got, err := readObject(b, key)
+		if err != nil {
+			t.Fatalf("Get %s: %v", key, err)
+		}
+		if string(got) != data {
+			t.Errorf("Get %s = %q, want %q", key, got, data)
+		}
+		info, err := b.Stat(key)
+		if err != nil {
+			t.Fatalf("Stat %s: %v", key, err)
+		}
+		if info.Key != key || info.Size != int64(len(data)) {
+			t.Errorf("Stat %s = %+v, want size %d", key, info, len(data))
+		}
+	}
+
+	if err := writeObject(b, ".trees/x.json", []byte("replaced")); err != nil {
+		t.Fatalf("replacing Put: %v", err)
+	}
+	if got, _ := readObject(b, ".trees/x.json"); string(got) != "replaced" {
+		t.Errorf("Get after replacing Put = %q", got)
+	}
+
+	if _, err := b.Get(".trees/missing.json"); !os.IsNotExist(err) {
+		t.Errorf("Get of a missing object: %v, want a not exist error", err)
+	}
+	if _, err := b.Stat(".trees/missing.json"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing object: %v, want a not exist error", err)
+	}
+
+	listed, err := b.List(".blobs/aa/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	assertKeys(t, "List .blobs/aa/", keysOf(listed), []string{".blobs/aa/one", ".blobs/aa/three", ".blobs/aa/two"})
+
+	// Keys below a further slash are left out
+	listed, err = b.List(".trees/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	assertKeys(t, "List .trees/", keysOf(listed), []string{".trees/empty.json", ".trees/x.json", ".trees/y.json"})
+	if listed, err = b.List(".blobs/"); err != nil || len(listed) != 0 {
+		t.Errorf("List .blobs/ = %v, %v, want nothing", keysOf(listed), err)
+	}
+	if listed, err = b.List(".nothing/"); err != nil || len(listed) != 0 {
+		t.Errorf("List of a missing prefix = %v, %v, want nothing", keysOf(listed), err)
+	}
+
+	var walked []string
+	err = b.Walk(".blobs/", func(info ObjectInfo) error {
+		walked = append(walked, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	sort.Strings(walked)
+	assertKeys(t, "Walk .blobs/", walked, []string{".blobs/aa/one", ".blobs/aa/three", ".blobs/aa/two", ".blobs/bb/four"})
+
+	stop := fmt.Errorf("stop")
+	calls := 0
+	err = b.Walk(".blobs/", func(ObjectInfo) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Walk returned %v after %d calls, want the callback's error after 1", err, calls)
+	}
+
+	if err := b.Delete(".blobs/aa/two"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := b.Stat(".blobs/aa/two"); !os.IsNotExist(err) {
+		t.Errorf("Stat after Delete: %v, want a not exist error", err)
+	}
+	if err := b.Delete(".blobs/aa/two"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+	if err := b.Delete(".revisions/x/1.json"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if listed, err = b.List(".revisions/x/"); err != nil || len(listed) != 0 {
+		t.Errorf("List after deleting every object = %v, %v, want nothing", keysOf(listed), err)
+	}
+}
+
+func keysOf(objects []ObjectInfo) []string {
+	keys := make([]string, len(objects))
+	for i, object := range objects {
+		keys[i] = object.Key
+	}
+	return keys
+}
+
+func assertKeys(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	testBackend(t, &localBackend{root: t.TempDir()})
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, newMemoryBackend())
+}
+
+func TestS3Backend(t *testing.T) {
+	stub := newS3Stub(t)
+	testBackend(t, stub.backend("codebases/"))
+
+	// The prefix keeps every object of the backend apart
+	for key := range stub.objects {
+		if !strings.HasPrefix(key, "codebases/") {
+			t.Errorf("object %s stored outside the prefix", key)
+		}
+	}
+	if stub.listRequests < 2 {
+		t.Errorf("made %d list requests, want several pages", stub.listRequests)
+	}
+}
+
+func TestS3BackendPaginates(t *testing.T) {
+	stub := newS3Stub(t)
+	b := stub.backend("")
+
+	var want []string
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf(".blobs/%02d", i)
+		want = append(want, key)
+		if err := writeObject(b, key, []byte(key)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	stub.listRequests = 0
+	listed, err := b.List(".blobs/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	assertKeys(t, "List", keysOf(listed), want)
+	if stub.listRequests != 4 {
+		t.Errorf("List made %d requests for 7 keys in pages of %d, want 4", stub.listRequests, s3StubPageSize)
+	}
+
+	// Walk passes on each page before asking for the next
+	stub.listRequests = 0
+	b.Walk(".blobs/", func(info ObjectInfo) error {
+		if info.Key == ".blobs/01" {
+			return io.EOF
+		}
+		return nil
+	})
+	if stub.listRequests != 1 {
+		t.Errorf("Walk stopped on the first page made %d requests, want 1", stub.listRequests)
+	}
+}
+
+func TestS3BackendSigning(t *testing.T) {
+	stub := newS3Stub(t)
+	b := stub.backend("")
+	if err := writeObject(b, "signed", []byte("data")); err != nil {
+		t.Fatalf("signed Put: %v", err)
+	}
+	if stub.signedRequests == 0 {
+		t.Fatal("requests were not signed")
+	}
+
+	// Keys and queries with characters that must be escaped
+	for _, key := range []string{"a b/c+d", "ü/é~x", "semi;colon=&"} {
+		if err := writeObject(b, key, []byte(key)); err != nil {
+			t.Errorf("Put %q: %v", key, err)
+		}
+		if listed, err := b.List(key); err != nil || len(listed) != 1 {
+			t.Errorf("List %q = %v, %v", key, keysOf(listed), err)
+		}
+	}
+
+	wrong := stub.backend("")
+	wrong.secretKey = "not-the-secret"
+	err := writeObject(wrong, "forged", []byte("data"))
+	if err == nil || os.IsNotExist(err) || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Put with a wrong secret: %v, want SignatureDoesNotMatch", err)
+	}
+	if _, err := wrong.Get("signed"); err == nil || os.IsNotExist(err) {
+		t.Errorf("Get with a wrong secret: %v, want a signature error", err)
+	}
+}
+
+func TestS3BackendErrors(t *testing.T) {
+	stub := newS3Stub(t)
+	b := stub.backend("")
+
+	// A missing bucket is not a missing object
+	missing := stub.backend("")
+	missing.bucket = "other"
+	if _, err := missing.List(""); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Errorf("List of a missing bucket: %v, want NoSuchBucket", err)
+	}
+
+	stub.fail = http.StatusServiceUnavailable
+	_, err := b.Get("anything")
+	if err == nil || os.IsNotExist(err) || !strings.Contains(err.Error(), "SlowDown") {
+		t.Errorf("Get from a failing service: %v, want SlowDown", err)
+	}
+	if err := b.Delete("anything"); err == nil {
+		t.Error("Delete from a failing service succeeded")
+	}
+	if _, err := b.List(""); err == nil {
+		t.Error("List from a failing service succeeded")
+	}
+}
+
+// s3StubPageSize is how many keys the stub returns per ListObjectsV2 page,
+// small so listings span pages.
+const s3StubPageSize = 2
+
+const (
+	s3StubBucket    = "bucket"
+	s3StubRegion    = "eu-test-1"
+	s3StubAccessKey = "AKIDTEST"
+	s3StubSecretKey = "secret/key+test"
+)
+
+// s3Stub is an in-memory S3 service answering path style requests for one
+// bucket. It checks every request's Signature Version 4 signature on its
+// own, rather than with the signing code under test.
+type s3Stub struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu             sync.Mutex
+	objects        map[string][]byte
+	modTimes       map[string]time.Time
+	listRequests   int
+	signedRequests int
+	fail           int // answer every request with this status if set
+}
+
+func newS3Stub(t *testing.T) *s3Stub {
+	stub := &s3Stub{t: t, objects: make(map[string][]byte), modTimes: make(map[string]time.Time)}
+	stub.server = httptest.NewServer(http.HandlerFunc(stub.serve))
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func (s *s3Stub) backend(prefix string) *s3Backend {
+	endpoint, _ := url.Parse(s.server.URL)
+	return &s3Backend{
+		endpoint:  endpoint,
+		bucket:    s3StubBucket,
+		region:    s3StubRegion,
+		prefix:    prefix,
+		accessKey: s3StubAccessKey,
+		secretKey: s3StubSecretKey,
+		client:    s.server.Client(),
+	}
+}
+
+func (s *s3Stub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail != 0 {
+		s.error(w, s.fail, "SlowDown", "Please reduce your request rate.")
+		return
+	}
+	if err := s.verify(r); err != nil {
+		s.error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	s.signedRequests++
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s3StubBucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			s.error(w, http.StatusBadRequest, "IncompleteBody", "")
+			return
+		}
+		s.objects[key] = data
+		s.modTimes[key] = time.Now().UTC().Truncate(time.Second)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", s.modTimes[key].Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		// Like S3, deleting a missing object succeeds
+		delete(s.objects, key)
+		delete(s.modTimes, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+	}
+}
+
+// list answers ListObjectsV2, continuing after the key named by the
+// continuation token.
+func (s *s3Stub) list(w http.ResponseWriter, query url.Values) {
+	s.listRequests++
+	if query.Get("list-type") != "2" {
+		s.error(w, http.StatusBadRequest, "InvalidArgument", "only ListObjectsV2 is supported")
+		return
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	after := query.Get("continuation-token")
+
+	var keys []string
+	for key := range s.objects {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		if delimiter != "" && strings.Contains(key[len(prefix):], delimiter) {
+			// Would be one of the CommonPrefixes, which Server B ignores
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > s3StubPageSize {
+		keys = keys[:s3StubPageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         len(s.objects[key]),
+			LastModified: s.modTimes[key].Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *s3Stub) error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+// verify recomputes a request's Signature Version 4 signature from what
+// arrived over the wire.
+func (s *s3Stub) verify(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	amzDate := r.Header.Get("x-amz-date")
+	payload := r.Header.Get("x-amz-content-sha256")
+	if auth == "" || amzDate == "" || payload == "" {
+		return fmt.Errorf("request is not signed")
+	}
+	requestTime, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(requestTime).Abs() > 15*time.Minute {
+		return fmt.Errorf("invalid x-amz-date %q", amzDate)
+	}
+
+	date := amzDate[:8]
+	scope := date + "/" + s3StubRegion + "/s3/aws4_request"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	prefix := "AWS4-HMAC-SHA256 Credential=" + s3StubAccessKey + "/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature="
+	if !strings.HasPrefix(auth, prefix) {
+		return fmt.Errorf("unexpected credential or signed headers in %q", auth)
+	}
+
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		strings.Join(params, "&"),
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s3StubSecretKey)
+	for _, part := range []string{date, s3StubRegion, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(strings.TrimPrefix(auth, prefix))) {
+		return fmt.Errorf("the request signature does not match")
+	}
+	return nil
+}
+
+// awsEscape percent-encodes all but the unreserved characters.
+func awsEscape(s string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// blobStore keeps file bodies under .blobs/ in the storage backend, named
+// by their SHA-256, so a file uploaded into many codebases is stored once.
+// Reference counts are rebuilt from the codebase trees on startup and a
+// blob is removed when its last reference goes away. New blobs are
+// compressed with encoding, if set, and reading decompresses them
+// transparently.
+//
+// Blobs of encrypted codebases are encrypted with the codebase's data key
+// and named <name hash>-<codebase id>, where the name hash is an HMAC of the
+// content's SHA-256 keyed from the data key. They are only shared between
+// the revisions of one codebase, and their names cannot be used to confirm
+// what a codebase holds.
+type blobStore struct {
+	backend  Backend
+	encoding string
+	keys     *keyStore
+
+	mu   sync.Mutex // guards refs and adding or removing blobs
+	refs map[string]int
+}
+
+func newBlobStore(backend Backend, encoding string, keys *keyStore) *blobStore {
+	return &blobStore{
+		backend:  backend,
+		encoding: encoding,
+		keys:     keys,
+		refs:     make(map[string]int),
+	}
+}
+
+func validSum(sum string) bool {
+	if len(sum) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// blobName names a blob by the hash identifying it, the checksum of a plain
+// blob or the name hash of an encrypted one, and the codebase owner whose
+// data key it is encrypted with, unless owner is empty.
+func blobName(hash, owner string) string {
+	if owner == "" {
+		return hash
+	}
+	return hash + "-" + owner
+}
+
+// parseBlobName splits a blob name into its hash and owner.
+func parseBlobName(name string) (string, string, bool) {
+	hash, owner, encrypted := strings.Cut(name, "-")
+	if !validSum(hash) {
+		return "", "", false
+	}
+	if encrypted {
+		if _, err := uuid.Parse(owner); err != nil {
+			return "", "", false
+		}
+	}
+	return hash, owner, true
+}
+
+// blobName names the blob holding content sum in a codebase.
+func (s *StorageServer) blobName(codebaseID, sum string) string {
+	return s.keys.blobName(codebaseID, sum)
+}
+
+// openBlob opens the blob holding a file of a codebase, as blobStore.open
+// does.
+func (s *StorageServer) openBlob(codebaseID string, entry treeEntry) (io.ReadCloser, error) {
+	return s.blobs.open(s.blobName(codebaseID, entry.SHA256), entry.SHA256, entry.Size)
+}
+
+const blobsPrefix = ".blobs/"
+
+func (b *blobStore) key(name string) string {
+	return blobsPrefix + name[:2] + "/" + name
+}
+
+func (b *blobStore) encodedKey(name, encoding string) string {
+	if encoding == encodingNone {
+		return b.key(name)
+	}
+	return b.key(name) + "." + encoding
+}
+
+// find returns the object and encoding of a stored blob, or an
+// os.IsNotExist error.
+func (b *blobStore) find(name string) (ObjectInfo, string, error) {
+	if _, _, ok := parseBlobName(name); !ok {
+		return ObjectInfo{}, "", os.ErrNotExist
+	}
+	for _, encoding := range blobEncodings {
+		info, err := b.backend.Stat(b.encodedKey(name, encoding))
+		if err == nil {
+			return info, encoding, nil
+		}
+		if !os.IsNotExist(err) {
+			return ObjectInfo{}, "", err
+		}
+	}
+	return ObjectInfo{}, "", os.ErrNotExist
+}
+
+// findContent returns the name of a blob holding content sum that codebase
+// codebaseID may use, or an os.IsNotExist error: a plain blob, or one
+// encrypted with the codebase's own key. Blobs encrypted for other
+// codebases are never used, nor their existence revealed. codebaseID may
+// be empty for plain blobs only.
+func (b *blobStore) findContent(sum, codebaseID string) (string, error) {
+	if !validSum(sum) {
+		return "", os.ErrNotExist
+	}
+	names := []string{sum}
+	if name := b.keys.blobName(codebaseID, sum); name != sum {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		_, _, err := b.find(name)
+		if err == nil {
+			return name, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// encode writes src, compressed with encoding and encrypted if blob name
+// is, to a new temporary file in dir and returns its path. It returns ""
+// if compressing does not make the content smaller, in which case it is
+// better stored uncompressed.
+func (b *blobStore) encode(src io.Reader, dir, name, encoding string) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".encode-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	tmp.Chmod(0644)
+
+	size, compressed, err := b.encodeTo(tmp, src, name, encoding)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if encoding != encodingNone && compressed >= size {
+		os.Remove(tmp.Name())
+		return "", nil
+	}
+	return tmp.Name(), nil
+}
+
+// encodeTo writes src to dst as blob name stores it, returning the size of
+// src and of its compressed form.
+func (b *blobStore) encodeTo(dst io.Writer, src io.Reader, name, encoding string) (int64, int64, error) {
+	var encrypted io.WriteCloser = nopWriteCloser{dst}
+	if _, owner, _ := parseBlobName(name); owner != "" {
+		aead, err := b.keys.aead(owner)
+		if err != nil {
+			return 0, 0, err
+		}
+		if encrypted, err = newEncryptWriter(dst, aead, name); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	compressed := &countingWriter{w: encrypted}
+	enc, err := newEncoder(encoding, compressed)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := io.Copy(enc, src)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err == nil {
+		err = encrypted.Close()
+	}
+	return size, compressed.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// prepare compresses and encrypts the file at src into dir as the store
+// requires for blob name, returning the file and encoding to put. It
+// returns src itself if the blob is already stored, src is gone because a
+// previous attempt already stored it, or it is best stored as is. This
+// happens before mu is taken so commits do not wait for each other.
+func (b *blobStore) prepare(src, name, dir string) (string, string, error) {
+	_, owner, _ := parseBlobName(name)
+	if b.encoding == encodingNone && owner == "" {
+		return src, encodingNone, nil
+	}
+	if _, _, err := b.find(name); err == nil {
+		return src, encodingNone, nil
+	}
+
+	encode := func(encoding string) (string, error) {
+		f, err := os.Open(src)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return b.encode(f, dir, name, encoding)
+	}
+
+	encoded, err := encode(b.encoding)
+	if os.IsNotExist(err) {
+		return src, encodingNone, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if encoded != "" {
+		return encoded, b.encoding, nil
+	}
+	if owner == "" {
+		return src, encodingNone, nil
+	}
+	encoded, err = encode(encodingNone)
+	return encoded, encodingNone, err
+}
+
+// put moves the file at src, holding a blob with the given encoding, into
+// the store as blob name, or removes src if the blob is already stored.
+// src may be missing if a previous attempt already moved it. The caller
+// must hold mu.
+func (b *blobStore) put(src, name, encoding string) error {
+	if _, _, ok := parseBlobName(name); !ok {
+		return fmt.Errorf("invalid blob name %q", name)
+	}
+
+	if _, _, err := b.find(name); err == nil {
+		if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	return putFile(b.backend, b.encodedKey(name, encoding), src)
+}
+
+// link adds the file at src to the store as plain blob sum, leaving src in
+// place.
+func (b *blobStore) link(src, sum string) error {
+	if !validSum(sum) {
+		return fmt.Errorf("invalid blob checksum %q", sum)
+	}
+
+	if _, _, err := b.find(sum); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return b.backend.Put(b.key(sum), in, info.Size())
+}
+
+// has reports whether content sum is stored in a blob codebase codebaseID
+// may use.
+func (b *blobStore) has(sum, codebaseID string) bool {
+	_, err := b.findContent(sum, codebaseID)
+	return err == nil
+}
+
+var errBlobCorrupt = errors.New("blob content does not match its checksum")
+
+// open opens blob name, expected to hold content sum of size bytes, for
+// reading, or of unknown size if size is negative, decrypting and
+// decompressing it if needed. The returned reader hashes the content as it
+// is read and fails with errBlobCorrupt instead of io.EOF if the blob no
+// longer matches sum or size. A plain blob of the wrong size is reported as
+// corrupt right away.
+func (b *blobStore) open(name, sum string, size int64) (io.ReadCloser, error) {
+	object, encoding, err := b.find(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.openObject(object, name, sum, encoding, size)
+}
+
+func (b *blobStore) openObject(object ObjectInfo, name, sum, encoding string, size int64) (io.ReadCloser, error) {
+	_, owner, ok := parseBlobName(name)
+	if !ok {
+		return nil, fmt.Errorf("invalid blob name %q", name)
+	}
+	var aead cipher.AEAD
+	var err error
+	if owner != "" {
+		if aead, err = b.keys.aead(owner); err != nil {
+			return nil, err
+		}
+	}
+
+	if encoding == encodingNone && owner == "" && size >= 0 && object.Size != size {
+		return nil, fmt.Errorf("%w: %s is %d bytes, expected %d", errBlobCorrupt, sum, object.Size, size)
+	}
+	f, err := b.backend.Get(object.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var src io.Reader = f
+	if aead != nil {
+		if src, err = newDecryptReader(f, aead, name); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	dec, err := newDecoder(encoding, src)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %v", errBlobCorrupt, sum, err)
+	}
+	return &verifyingReader{file: f, r: dec, encoded: encoding != encodingNone, hash: sha256.New(), sum: sum, size: size}, nil
+}
+
+type verifyingReader struct {
+	file    io.Closer
+	r       io.ReadCloser // decrypts and decompresses file
+	encoded bool
+	hash    hash.Hash
+	sum     string
+	size    int64 // negative if unknown
+	read    int64
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	v.read += int64(n)
+
+	if v.size >= 0 && v.read > v.size {
+		return n, fmt.Errorf("%w: %s is longer than %d bytes", errBlobCorrupt, v.sum, v.size)
+	}
+	if err != nil && err != io.EOF && v.encoded && !errors.Is(err, errBlobCorrupt) {
+		// Undecodable compressed data
+		return n, fmt.Errorf("%w: %s: %v", errBlobCorrupt, v.sum, err)
+	}
+	if err == io.EOF && (hex.EncodeToString(v.hash.Sum(nil)) != v.sum || (v.size >= 0 && v.read != v.size)) {
+		return n, fmt.Errorf("%w: %s", errBlobCorrupt, v.sum)
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	v.r.Close()
+	return v.file.Close()
+}
+
+// checkout copies content sum from a blob codebase codebaseID may use to
+// a new temporary file in dir, verifying it on the way, so a stage can hold
+// it like an uploaded file, and returns the copy's path and size. The copy
+// is never linked to the blob, as staged files get their own mode and
+// mtime.
+func (b *blobStore) checkout(dir, sum, codebaseID string) (string, int64, error) {
+	name, err := b.findContent(sum, codebaseID)
+	if err != nil {
+		return "", 0, err
+	}
+	src, err := b.open(name, sum, -1)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer dst.Close()
+	dst.Chmod(0644)
+
+	size, err := io.Copy(dst, src)
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", 0, err
+	}
+	return dst.Name(), size, nil
+}
+
+// acquire records a new reference to a blob. The caller must hold mu.
+func (b *blobStore) acquire(name string) {
+	b.refs[name]++
+}
+
+// release drops a reference to a blob and removes the blob once nothing
+// refers to it. The caller must hold mu.
+func (b *blobStore) release(name string) error {
+	b.refs[name]--
+	if b.refs[name] > 0 {
+		return nil
+	}
+
+	delete(b.refs, name)
+	for _, encoding := range blobEncodings {
+		if err := b.backend.Delete(b.encodedKey(name, encoding)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk calls fn for every blob object in the store.
+func (b *blobStore) walk(fn func(name, encoding string, object ObjectInfo) error) error {
+	return b.backend.Walk(blobsPrefix, func(object ObjectInfo) error {
+		name, encoding, ok := splitBlobName(path.Base(object.Key))
+		if !ok {
+			return nil
+		}
+		return fn(name, encoding, object)
+	})
+}
+
+// loadBlobRefs counts the references every codebase tree holds, including
+// the trees of earlier revisions.
+func (s *StorageServer) loadBlobRefs() error {
+	ids, err := s.codebaseIDs()
+	if err != nil {
+		return err
+	}
+
+	s.blobs.mu.Lock()
+	defer s.blobs.mu.Unlock()
+
+	s.blobs.refs = make(map[string]int)
+	for _, id := range ids {
+		tree, err := s.loadTree(id)
+		if err != nil {
+			return fmt.Errorf("load tree of %s: %w", id, err)
+		}
+		revisions, err := s.revisionTrees(id)
+		if err != nil {
+			return fmt.Errorf("load revisions of %s: %w", id, err)
+		}
+		for _, t := range append(revisions, tree) {
+			for _, entry := range t.Files {
+				s.blobs.acquire(s.blobName(id, entry.SHA256))
+			}
+		}
+	}
+	return nil
+}
+
+// sweepBlobs removes blobs that no tree refers to, such as those left by a
+// commit that failed halfway. It must only run before requests are served.
+func (s *StorageServer) sweepBlobs() {
+	s.blobs.mu.Lock()
+	defer s.blobs.mu.Unlock()
+
+	removed := 0
+	err := s.blobs.walk(func(name, encoding string, object ObjectInfo) error {
+		if s.blobs.refs[name] > 0 {
+			return nil
+		}
+		if err := s.blobs.backend.Delete(object.Key); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error sweeping unreferenced blobs: %v", err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d unreferenced blobs", removed)
+	}
+}
+
+type blobCheckRequest struct {
+	SHA256     []string `json:"sha256"`
+	CodebaseID string   `json:"codebase_id,omitempty"` // the codebase to upload to, if it exists
+}
+
+// checkBlobs handles POST /blobs/check, telling which of the given SHA-256
+// checksums storage already has ("have") and which content has to be
+// uploaded ("want"). Files the client has can then be listed in an upload
+// manifest by checksum alone. Only plain blobs and those encrypted for the
+// given codebase count.
+func (s *StorageServer) checkBlobs(w http.ResponseWriter, r *http.Request) {
+	var req blobCheckRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxManifestSize)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.CodebaseID != "" {
+		if _, err := uuid.Parse(req.CodebaseID); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+			return
+		}
+	}
+
+	have := []string{}
+	want := []string{}
+	seen := make(map[string]bool, len(req.SHA256))
+	for _, sum := range req.SHA256 {
+		sum = strings.ToLower(sum)
+		if !validSum(sum) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid checksum: %s", sum))
+			return
+		}
+		if seen[sum] {
+			continue
+		}
+		seen[sum] = true
+
+		if s.blobs.has(sum, req.CodebaseID) {
+			have = append(have, sum)
+		} else {
+			want = append(want, sum)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"have":    have,
+		"want":    want,
+	})
+}
+
+// getStats reports how much space deduplication and compression save:
+// logical bytes are the sizes of all files of all revisions of all
+// codebases, physical bytes the sizes of the blobs actually stored.
+func (s *StorageServer) getStats(w http.ResponseWriter, r *http.Request) {
+	ids, err := s.codebaseIDs()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to list codebases")
+		return
+	}
+
+	var files, revisions, encrypted int
+	var logicalBytes int64
+	for _, id := range ids {
+		if s.keys.encrypted(id) {
+			encrypted++
+		}
+		tree, err := s.loadTree(id)
+		if os.IsNotExist(err) {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read codebase")
+			return
+		}
+		earlier, err := s.revisionTrees(id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to read codebase")
+			return
+		}
+		for _, t := range append(earlier, tree) {
+			revisions++
+			for _, entry := range t.Files {
+				files++
+				logicalBytes += entry.Size
+			}
+		}
+	}
+
+	var blobs int
+	var physicalBytes int64
+	err = s.blobs.walk(func(name, encoding string, object ObjectInfo) error {
+		blobs++
+		physicalBytes += object.Size
+		return nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read blob store")
+		return
+	}
+
+	dedupRatio := 1.0
+	if physicalBytes > 0 {
+		dedupRatio = float64(logicalBytes) / float64(physicalBytes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":             true,
+		"codebases":           len(ids),
+		"encrypted_codebases": encrypted,
+		"revisions":           revisions,
+		"files":               files,
+		"blobs":               blobs,
+		"logical_bytes":       logicalBytes,
+		"physical_bytes":      physicalBytes,
+		"dedup_ratio":         dedupRatio,
+		"compression":         compressionName(s.blobs.encoding),
+	})
+}
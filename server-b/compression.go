@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Blob encodings double as the file name suffix of compressed blobs, so a
+// stored .gz file is never mistaken for a compressed blob.
+const (
+	encodingNone = ""
+	encodingZstd = "zst"
+	encodingGzip = "gz"
+)
+
+var blobEncodings = []string{encodingNone, encodingZstd, encodingGzip}
+
+// parseCompression maps the STORAGE_COMPRESSION setting to a blob encoding.
+func parseCompression(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", "none":
+		return encodingNone, nil
+	case "zstd":
+		return encodingZstd, nil
+	case "gzip":
+		return encodingGzip, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, expected none, zstd or gzip", value)
+}
+
+func compressionName(encoding string) string {
+	switch encoding {
+	case encodingZstd:
+		return "zstd"
+	case encodingGzip:
+		return "gzip"
+	}
+	return "none"
+}
+
+// splitBlobName returns the blob name and encoding of a blob file name.
+func splitBlobName(filename string) (string, string, bool) {
+	name, encoding := filename, encodingNone
+	if i := strings.IndexByte(filename, '.'); i >= 0 {
+		name, encoding = filename[:i], filename[i+1:]
+		if encoding != encodingZstd && encoding != encodingGzip {
+			return "", "", false
+		}
+	}
+	_, _, ok := parseBlobName(name)
+	return name, encoding, ok
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		return zstd.NewWriter(w)
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case encodingGzip:
+		return gzip.NewReader(r)
+	}
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// migrateCompression re-encodes every stored blob with the configured
+// compression, verifying each on the way. It is run as
+// "server-b migrate-compression" while the server is stopped, and can be
+// rerun after an interruption. Encrypted blobs no tree refers to are left
+// alone, as their names do not tell the checksum to verify them against;
+// the next start removes them.
+func (s *StorageServer) migrateCompression() error {
+	type storedBlob struct {
+		name, encoding string
+		object         ObjectInfo
+	}
+
+	sums, err := s.blobSums()
+	if err != nil {
+		return err
+	}
+
+	target := s.blobs.encoding
+	var blobs []storedBlob
+	done := make(map[string]bool)
+	err = s.blobs.walk(func(name, encoding string, object ObjectInfo) error {
+		blobs = append(blobs, storedBlob{name, encoding, object})
+		if encoding == target {
+			done[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.stagingDir(), 0755); err != nil {
+		return err
+	}
+
+	var converted, skipped int
+	var before, after int64
+	for _, blob := range blobs {
+		if blob.encoding == target {
+			continue
+		}
+		if done[blob.name] {
+			// Left behind by an interrupted migration
+			if err := s.blobs.backend.Delete(blob.object.Key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sum, owner, _ := parseBlobName(blob.name)
+		if owner != "" {
+			if sum = sums[blob.name]; sum == "" {
+				skipped++
+				continue
+			}
+		}
+
+		encoding := target
+		tmp, err := s.reencodeBlob(blob.object, blob.name, sum, blob.encoding, encoding)
+		if err == nil && tmp == "" {
+			// Compressing does not pay off, so it is better stored as is
+			if blob.encoding == encodingNone {
+				skipped++
+				continue
+			}
+			encoding = encodingNone
+			tmp, err = s.reencodeBlob(blob.object, blob.name, sum, blob.encoding, encoding)
+		}
+		if err != nil {
+			return fmt.Errorf("re-encode blob %s: %w", blob.name, err)
+		}
+
+		info, err := os.Stat(tmp)
+		if err != nil {
+			return err
+		}
+		if err := putFile(s.blobs.backend, s.blobs.encodedKey(blob.name, encoding), tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := s.blobs.backend.Delete(blob.object.Key); err != nil {
+			return err
+		}
+
+		converted++
+		before += blob.object.Size
+		after += info.Size()
+	}
+
+	log.Printf("Re-encoded %d blobs as %s: %d bytes before, %d bytes after; %d left as they were",
+		converted, compressionName(target), before, after, skipped)
+	return nil
+}
+
+// reencodeBlob decodes a blob object, verifying it, and encodes it to a
+// temporary file in the staging directory, as blobStore.encode does.
+func (s *StorageServer) reencodeBlob(object ObjectInfo, name, sum, from, to string) (string, error) {
+	src, err := s.blobs.openObject(object, name, sum, from, -1)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	return s.blobs.encode(src, s.stagingDir(), name, to)
+}
+
+// blobSums maps the name of every blob an encrypted codebase refers to to
+// the checksum of its content.
+func (s *StorageServer) blobSums() (map[string]string, error) {
+	ids, err := s.codebaseIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string)
+	for _, id := range ids {
+		if !s.keys.encrypted(id) {
+			continue
+		}
+		tree, err := s.loadTree(id)
+		if err != nil {
+			return nil, fmt.Errorf("load tree of %s: %w", id, err)
+		}
+		revisions, err := s.revisionTrees(id)
+		if err != nil {
+			return nil, fmt.Errorf("load revisions of %s: %w", id, err)
+		}
+		for _, t := range append(revisions, tree) {
+			for _, entry := range t.Files {
+				sums[s.blobName(id, entry.SHA256)] = entry.SHA256
+			}
+		}
+	}
+	return sums, nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Files are classified when they are staged, from their name and the start
+// and end of their content. The tables are built in rather than read from
+// the system, so every storage node classifies a file the same way.
+const (
+	detectHeadSize = 8 << 10
+	detectTailSize = 1 << 10
+)
+
+const binaryMIMEType = "application/octet-stream"
+
+// extensionMIMETypes are the types of files whose content sniffing cannot
+// tell apart, mostly text formats.
+var extensionMIMETypes = map[string]string{
+	".c":        "text/x-c",
+	".h":        "text/x-c",
+	".cc":       "text/x-c++",
+	".cpp":      "text/x-c++",
+	".cxx":      "text/x-c++",
+	".hpp":      "text/x-c++",
+	".cs":       "text/x-csharp",
+	".css":      "text/css",
+	".csv":      "text/csv",
+	".go":       "text/x-go",
+	".htm":      "text/html",
+	".html":     "text/html",
+	".java":     "text/x-java",
+	".js":       "text/javascript",
+	".mjs":      "text/javascript",
+	".cjs":      "text/javascript",
+	".jsx":      "text/javascript",
+	".json":     "application/json",
+	".kt":       "text/x-kotlin",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".php":      "application/x-httpd-php",
+	".py":       "text/x-python",
+	".rb":       "text/x-ruby",
+	".rs":       "text/x-rust",
+	".scss":     "text/x-scss",
+	".sh":       "application/x-sh",
+	".sql":      "application/sql",
+	".svg":      "image/svg+xml",
+	".swift":    "text/x-swift",
+	".toml":     "application/toml",
+	".ts":       "text/x-typescript",
+	".tsx":      "text/x-typescript",
+	".txt":      "text/plain",
+	".xml":      "application/xml",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".wasm":     "application/wasm",
+	".woff":     "font/woff",
+	".woff2":    "font/woff2",
+	".ttf":      "font/ttf",
+	".otf":      "font/otf",
+	".ico":      "image/vnd.microsoft.icon",
+	".gz":       "application/gzip",
+	".tar":      "application/x-tar",
+	".jar":      "application/java-archive",
+}
+
+// textMIMETypes are types outside text/ whose files are text.
+var textMIMETypes = map[string]bool{
+	"application/json":        true,
+	"application/xml":         true,
+	"application/yaml":        true,
+	"application/toml":        true,
+	"application/sql":         true,
+	"application/x-sh":        true,
+	"application/x-httpd-php": true,
+	"image/svg+xml":           true,
+}
+
+// isTextMIMEType reports whether files of mimeType are text.
+func isTextMIMEType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") || textMIMETypes[mimeType]
+}
+
+// extensionLanguages maps file extensions to programming languages.
+var extensionLanguages = map[string]string{
+	".bash":     "Shell",
+	".sh":       "Shell",
+	".zsh":      "Shell",
+	".bat":      "Batchfile",
+	".cmd":      "Batchfile",
+	".c":        "C",
+	".h":        "C",
+	".cc":       "C++",
+	".cpp":      "C++",
+	".cxx":      "C++",
+	".hh":       "C++",
+	".hpp":      "C++",
+	".clj":      "Clojure",
+	".cljs":     "Clojure",
+	".cmake":    "CMake",
+	".cs":       "C#",
+	".css":      "CSS",
+	".dart":     "Dart",
+	".el":       "Emacs Lisp",
+	".erl":      "Erlang",
+	".ex":       "Elixir",
+	".exs":      "Elixir",
+	".fs":       "F#",
+	".fsx":      "F#",
+	".go":       "Go",
+	".gradle":   "Groovy",
+	".groovy":   "Groovy",
+	".graphql":  "GraphQL",
+	".hs":       "Haskell",
+	".htm":      "HTML",
+	".html":     "HTML",
+	".ini":      "INI",
+	".java":     "Java",
+	".jl":       "Julia",
+	".js":       "JavaScript",
+	".cjs":      "JavaScript",
+	".mjs":      "JavaScript",
+	".jsx":      "JavaScript",
+	".json":     "JSON",
+	".kt":       "Kotlin",
+	".kts":      "Kotlin",
+	".less":     "Less",
+	".lua":      "Lua",
+	".m":        "Objective-C",
+	".md":       "Markdown",
+	".markdown": "Markdown",
+	".mk":       "Makefile",
+	".ml":       "OCaml",
+	".mli":      "OCaml",
+	".php":      "PHP",
+	".pl":       "Perl",
+	".pm":       "Perl",
+	".proto":    "Protocol Buffers",
+	".ps1":      "PowerShell",
+	".py":       "Python",
+	".pyi":      "Python",
+	".r":        "R",
+	".rb":       "Ruby",
+	".rs":       "Rust",
+	".scala":    "Scala",
+	".scss":     "SCSS",
+	".sql":      "SQL",
+	".svelte":   "Svelte",
+	".swift":    "Swift",
+	".tf":       "HCL",
+	".toml":     "TOML",
+	".ts":       "TypeScript",
+	".tsx":      "TypeScript",
+	".vim":      "Vim Script",
+	".vue":      "Vue",
+	".xml":      "XML",
+	".yaml":     "YAML",
+	".yml":      "YAML",
+	".zig":      "Zig",
+}
+
+// filenameLanguages maps whole file names to programming languages.
+var filenameLanguages = map[string]string{
+	"CMakeLists.txt": "CMake",
+	"Dockerfile":     "Dockerfile",
+	"GNUmakefile":    "Makefile",
+	"Gemfile":        "Ruby",
+	"Jenkinsfile":    "Groovy",
+	"Makefile":       "Makefile",
+	"Rakefile":       "Ruby",
+	"makefile":       "Makefile",
+	".bashrc":        "Shell",
+	".profile":       "Shell",
+	".zshrc":         "Shell",
+}
+
+// interpreterLanguages maps the interpreters of shebang lines, without
+// version numbers, to programming languages.
+var interpreterLanguages = map[string]string{
+	"bash":    "Shell",
+	"dash":    "Shell",
+	"ksh":     "Shell",
+	"sh":      "Shell",
+	"zsh":     "Shell",
+	"deno":    "TypeScript",
+	"ts-node": "TypeScript",
+	"lua":     "Lua",
+	"node":    "JavaScript",
+	"perl":    "Perl",
+	"php":     "PHP",
+	"pwsh":    "PowerShell",
+	"python":  "Python",
+	"rscript": "R",
+	"ruby":    "Ruby",
+}
+
+// modelineLanguages maps the file types of Vim and Emacs modelines that do
+// not match a language name to programming languages.
+var modelineLanguages = map[string]string{
+	"bash":       "Shell",
+	"sh":         "Shell",
+	"zsh":        "Shell",
+	"c++":        "C++",
+	"cpp":        "C++",
+	"cs":         "C#",
+	"dockerfile": "Dockerfile",
+	"javascript": "JavaScript",
+	"js":         "JavaScript",
+	"make":       "Makefile",
+	"py":         "Python",
+	"rb":         "Ruby",
+	"rs":         "Rust",
+	"ts":         "TypeScript",
+	"yml":        "YAML",
+}
+
+var (
+	vimModeline   = regexp.MustCompile(`(?:^|\s)(?:vim?|ex):.*?\b(?:ft|filetype|syntax)=([\w+#-]+)`)
+	emacsModeline = regexp.MustCompile(`(?i)-\*-\s*(?:.*?\bmode:\s*([\w+#-]+)|([\w+#-]+)\s*-\*-)`)
+	versionSuffix = regexp.MustCompile(`[\d.]+$`)
+)
+
+// detectFile classifies the file at name, stored at the slash separated
+// path p, returning its MIME type and programming language, "" if it has
+// none.
+func detectFile(name, p string) (string, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, detectHeadSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", "", err
+	}
+	head = head[:n]
+
+	var tail []byte
+	if info, err := f.Stat(); err == nil && info.Size() > int64(n) {
+		offset := info.Size() - detectTailSize
+		if offset < int64(n) {
+			offset = int64(n)
+		}
+		tail = make([]byte, info.Size()-offset)
+		n, err := f.ReadAt(tail, offset)
+		if err != nil && err != io.EOF {
+			return "", "", err
+		}
+		tail = tail[:n]
+	}
+
+	mimeType, language := detectContent(p, head, tail)
+	return mimeType, language, nil
+}
+
+// storedType returns the MIME type and language of a stored file, read
+// whole, classifying files stored before they were classified on staging.
+func storedType(p string, entry treeEntry, content []byte) (string, string) {
+	if entry.MIMEType != "" {
+		return entry.MIMEType, entry.Language
+	}
+	return detectBytes(p, content)
+}
+
+// isTextContent reports whether content of mimeType can be shown as text.
+func isTextContent(mimeType string, content []byte) bool {
+	return isTextMIMEType(mimeType) && utf8.Valid(content)
+}
+
+// detectBytes classifies a file read whole.
+func detectBytes(p string, content []byte) (string, string) {
+	head, tail := content, content
+	if len(head) > detectHeadSize {
+		head = head[:detectHeadSize]
+	}
+	if len(tail) > detectTailSize {
+		tail = tail[len(tail)-detectTailSize:]
+	}
+	return detectContent(p, head, tail)
+}
+
+// detectContent classifies a file from its path and the start and end of
+// its content.
+func detectContent(p string, head, tail []byte) (string, string) {
+	mimeType := detectMIMEType(p, head)
+	if !isTextMIMEType(mimeType) {
+		return mimeType, ""
+	}
+	return mimeType, detectLanguage(p, head, tail)
+}
+
+// detectMIMEType trusts recognisable binary content over the extension,
+// and the extension over sniffing text, which cannot tell formats apart.
+func detectMIMEType(p string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if i := strings.IndexByte(sniffed, ';'); i >= 0 {
+		sniffed = sniffed[:i]
+	}
+
+	byExtension := extensionMIMETypes[strings.ToLower(path.Ext(p))]
+	if !strings.HasPrefix(sniffed, "text/") && sniffed != binaryMIMEType {
+		return sniffed
+	}
+
+	// Sniffing finds control bytes, isTextFile checks the encoding
+	text := sniffed != binaryMIMEType && isTextFile(trimPartialRune(head))
+	switch {
+	case byExtension != "" && isTextMIMEType(byExtension) == text:
+		return byExtension
+	case text:
+		return sniffed
+	}
+	return binaryMIMEType
+}
+
+// trimPartialRune drops a UTF-8 sequence cut off at the end of head.
+func trimPartialRune(head []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(head); i++ {
+		if utf8.RuneStart(head[len(head)-i]) {
+			if !utf8.FullRune(head[len(head)-i:]) {
+				return head[:len(head)-i]
+			}
+			break
+		}
+	}
+	return head
+}
+
+// detectLanguage looks at modelines, then the file name, the shebang line
+// and the extension.
+func detectLanguage(p string, head, tail []byte) string {
+	if language := modelineLanguage(head, tail); language != "" {
+		return language
+	}
+	name := path.Base(p)
+	if language, ok := filenameLanguages[name]; ok {
+		return language
+	}
+	if language := shebangLanguage(head); language != "" {
+		return language
+	}
+	return extensionLanguages[strings.ToLower(path.Ext(name))]
+}
+
+// modelineLanguage reads a Vim modeline in the first or last five lines or
+// an Emacs one on the first two.
+func modelineLanguage(head, tail []byte) string {
+	lines := bytes.SplitN(head, []byte("\n"), 6)
+	if len(lines) > 5 {
+		lines = lines[:5]
+	}
+	for i, line := range lines {
+		if i < 2 {
+			if m := emacsModeline.FindSubmatch(line); m != nil {
+				if language := languageNamed(string(m[1]) + string(m[2])); language != "" {
+					return language
+				}
+			}
+		}
+		if m := vimModeline.FindSubmatch(line); m != nil {
+			return languageNamed(string(m[1]))
+		}
+	}
+
+	if tail == nil {
+		tail = head
+	}
+	lines = bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	if len(lines) > 5 {
+		lines = lines[len(lines)-5:]
+	}
+	for _, line := range lines {
+		if m := vimModeline.FindSubmatch(line); m != nil {
+			return languageNamed(string(m[1]))
+		}
+	}
+	return ""
+}
+
+// shebangLanguage reads the interpreter of a #! line, looking past env.
+func shebangLanguage(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	line := string(head[2:])
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		interpreter = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") && !strings.Contains(field, "=") {
+				interpreter = field
+				break
+			}
+		}
+	}
+	interpreter = strings.ToLower(versionSuffix.ReplaceAllString(interpreter, ""))
+	return interpreterLanguages[interpreter]
+}
+
+// languageNamed returns the language a modeline names, by its name or an
+// editor's alias.
+func languageNamed(name string) string {
+	name = strings.ToLower(name)
+	if language, ok := modelineLanguages[name]; ok {
+		return language
+	}
+	for _, languages := range []map[string]string{extensionLanguages, filenameLanguages} {
+		for _, language := range languages {
+			if strings.ToLower(language) == name {
+				return language
+			}
+		}
+	}
+	return ""
+}
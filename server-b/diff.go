@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// MaxDiffFileSize is the largest file shown as a unified diff; larger files
+// are only compared by size and checksum.
+const MaxDiffFileSize = 1 << 20
+
+// MaxDiffResponseSize bounds the unified diffs of one response. Files
+// beyond it are listed without their diff.
+const MaxDiffResponseSize = 16 << 20
+
+const diffOverBudget = "diff too large for one response"
+
+// DiffFile describes one file that differs between two codebase trees.
+// Sizes and checksums of the side a file is missing from are left empty.
+type DiffFile struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	OldSize     int64  `json:"old_size,omitempty"`
+	OldSHA256   string `json:"old_sha256,omitempty"`
+	Diff        string `json:"diff,omitempty"`
+	DiffSkipped string `json:"diff_skipped,omitempty"`
+
+	mode uint32 // of added and removed files, for the patch
+}
+
+// getDiff handles GET /diff/{id}, comparing a codebase with the codebase
+// named by against, or with an earlier revision of itself. rev and
+// against_rev select revisions and default to the latest; without against
+// and against_rev the previous revision is used. format=patch returns all
+// file diffs as a single patch download instead of JSON. If this node does
+// not hold against, against_nodes lists the comma separated URLs of the
+// nodes to copy the revision to compare against from.
+func (s *StorageServer) getDiff(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	againstID := query.Get("against")
+	rev, againstRev := query.Get("rev"), query.Get("against_rev")
+	var againstNodes []string
+	if value := query.Get("against_nodes"); value != "" && againstID != "" && againstID != codebaseID {
+		againstNodes = strings.Split(value, ",")
+	}
+
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+	if againstID == "" {
+		againstID = codebaseID
+	} else if _, err := uuid.Parse(againstID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID to compare against")
+		return
+	}
+
+	// The codebases are only locked while their trees are read, so a large
+	// diff does not hold up changes
+	newTree, err := s.loadRevisionLocked(codebaseID, rev)
+	if err != nil {
+		respondWithTreeError(w, err, "Codebase not found")
+		return
+	}
+	if againstID == codebaseID && query.Get("against") == "" && againstRev == "" {
+		if newTree.revision() == 1 {
+			respondWithError(w, http.StatusBadRequest, "Nothing to compare against: give against or against_rev to diff the first revision")
+			return
+		}
+		againstRev = strconv.Itoa(newTree.revision() - 1)
+	}
+	readOld := s.readBlob
+	var oldTree *codebaseTree
+	if againstNodes != nil {
+		dir, err := os.MkdirTemp(s.baseStorageDir, ".diff-*")
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to create temporary directory")
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		oldTree, err = fetchRevision(r.Context(), againstNodes, againstID, againstRev, dir)
+		var pe *peerError
+		if errors.As(err, &pe) && pe.Status < 500 {
+			respondWithError(w, pe.Status, pe.Message)
+			return
+		}
+		if err != nil {
+			log.Printf("Error fetching codebase %s to diff against: %v", againstID, err)
+			respondWithError(w, http.StatusBadGateway, "Failed to fetch the codebase to compare against")
+			return
+		}
+		readOld = func(_ string, entry treeEntry) ([]byte, error) {
+			return os.ReadFile(filepath.Join(dir, entry.SHA256))
+		}
+	} else {
+		oldTree, err = s.loadRevisionLocked(againstID, againstRev)
+		if err != nil {
+			respondWithTreeError(w, err, "Codebase to compare against not found")
+			return
+		}
+	}
+
+	var added, removed, modified []DiffFile
+	unchanged := 0
+	for _, path := range newTree.sortedPaths() {
+		entry := newTree.Files[path]
+		old, ok := oldTree.Files[path]
+		switch {
+		case !ok:
+			added = append(added, DiffFile{Path: path, Size: entry.Size, SHA256: entry.SHA256, mode: entry.Mode})
+		case old.SHA256 != entry.SHA256:
+			modified = append(modified, DiffFile{Path: path, Size: entry.Size, SHA256: entry.SHA256, OldSize: old.Size, OldSHA256: old.SHA256})
+		default:
+			unchanged++
+		}
+	}
+	for _, path := range oldTree.sortedPaths() {
+		if _, ok := newTree.Files[path]; !ok {
+			old := oldTree.Files[path]
+			removed = append(removed, DiffFile{Path: path, OldSize: old.Size, OldSHA256: old.SHA256, mode: old.Mode})
+		}
+	}
+
+	budget := MaxDiffResponseSize
+	for _, files := range [][]DiffFile{added, removed, modified} {
+		for i := range files {
+			if budget <= 0 {
+				files[i].DiffSkipped = diffOverBudget
+				continue
+			}
+			err := s.fileDiff(&files[i], oldTree, newTree, readOld)
+			if errors.Is(err, fs.ErrNotExist) {
+				files[i].DiffSkipped = "file changed during the diff"
+				continue
+			}
+			if err != nil {
+				if errors.Is(err, errBlobCorrupt) {
+					log.Printf("ERROR: diff of codebase %s failed, a stored file is corrupt: %s: %v", codebaseID, files[i].Path, err)
+					respondWithError(w, http.StatusInternalServerError, "Stored file is corrupt")
+					return
+				}
+				respondWithError(w, http.StatusInternalServerError, "Failed to read file")
+				return
+			}
+			if len(files[i].Diff) > budget {
+				files[i].Diff, files[i].DiffSkipped = "", diffOverBudget
+				budget = 0
+				continue
+			}
+			budget -= len(files[i].Diff)
+		}
+	}
+
+	if query.Get("format") == "patch" {
+		filename := fmt.Sprintf("codebase-%s-r%d.patch", codebaseID, newTree.revision())
+		w.Header().Set("Content-Type", "text/x-patch; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+		writePatch(w, added, removed, modified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"directory_id":     codebaseID,
+		"revision":         newTree.revision(),
+		"against":          againstID,
+		"against_revision": oldTree.revision(),
+		"added":            nonNilDiffFiles(added),
+		"removed":          nonNilDiffFiles(removed),
+		"modified":         nonNilDiffFiles(modified),
+		"unchanged":        unchanged,
+	})
+}
+
+// loadRevisionLocked reads a tree like loadRevision, holding the codebase
+// read lock only while it does.
+func (s *StorageServer) loadRevisionLocked(id, rev string) (*codebaseTree, error) {
+	lock := codebaseLock(id)
+	lock.RLock()
+	defer lock.RUnlock()
+	return s.loadRevision(id, rev)
+}
+
+// fileDiff fills in the unified diff of a file if both of its sides are
+// text and small enough. readOld reads the content of the old side.
+func (s *StorageServer) fileDiff(f *DiffFile, oldTree, newTree *codebaseTree, readOld func(string, treeEntry) ([]byte, error)) error {
+	oldEntry, hasOld := oldTree.Files[f.Path]
+	newEntry, hasNew := newTree.Files[f.Path]
+	if oldEntry.Size > MaxDiffFileSize || newEntry.Size > MaxDiffFileSize {
+		f.DiffSkipped = "file too large"
+		return nil
+	}
+
+	oldName, newName := "/dev/null", "/dev/null"
+	var oldContent, newContent []byte
+	var err error
+	if hasOld {
+		oldName = "a/" + f.Path
+		if oldContent, err = readOld(oldTree.ID, oldEntry); err != nil {
+			return err
+		}
+	}
+	if hasNew {
+		newName = "b/" + f.Path
+		if newContent, err = s.readBlob(newTree.ID, newEntry); err != nil {
+			return err
+		}
+	}
+
+	isText := func(present bool, entry treeEntry, content []byte) bool {
+		if !present {
+			return true
+		}
+		mimeType, _ := storedType(f.Path, entry, content)
+		return isTextContent(mimeType, content)
+	}
+	if !isText(hasOld, oldEntry, oldContent) || !isText(hasNew, newEntry, newContent) {
+		f.DiffSkipped = "binary file"
+		return nil
+	}
+	f.Diff = unifiedDiff(oldName, newName, string(oldContent), string(newContent))
+	return nil
+}
+
+// writePatch writes the diffs of all files as a single patch that can be
+// applied with patch -p1 or git apply.
+func writePatch(w io.Writer, added, removed, modified []DiffFile) {
+	var files []DiffFile
+	files = append(files, added...)
+	files = append(files, removed...)
+	files = append(files, modified...)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	for _, f := range files {
+		fmt.Fprintf(w, "diff --git a/%s b/%s\n", f.Path, f.Path)
+		switch {
+		case f.OldSHA256 == "":
+			fmt.Fprintf(w, "new file mode %s\n", gitMode(f.mode))
+		case f.SHA256 == "":
+			fmt.Fprintf(w, "deleted file mode %s\n", gitMode(f.mode))
+		}
+		// git needs an index line to parse binary changes
+		fmt.Fprintf(w, "index %s..%s\n", shortSum(f.OldSHA256), shortSum(f.SHA256))
+		if f.Diff != "" {
+			io.WriteString(w, f.Diff)
+			continue
+		}
+		if f.DiffSkipped != "" {
+			oldName, newName := "a/"+f.Path, "b/"+f.Path
+			if f.OldSHA256 == "" {
+				oldName = "/dev/null"
+			}
+			if f.SHA256 == "" {
+				newName = "/dev/null"
+			}
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		}
+	}
+}
+
+// shortSum abbreviates a checksum like git abbreviates object names.
+func shortSum(sum string) string {
+	if len(sum) < 7 {
+		return "0000000"
+	}
+	return sum[:7]
+}
+
+// gitMode converts permission bits to the only two modes git records for
+// regular files.
+func gitMode(mode uint32) string {
+	if mode&0111 != 0 {
+		return "100755"
+	}
+	return "100644"
+}
+
+func nonNilDiffFiles(files []DiffFile) []DiffFile {
+	if files == nil {
+		return []DiffFile{}
+	}
+	return files
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Encrypted blobs are split into chunks sealed one by one with AES-256-GCM,
+// so files of any size are streamed rather than held in memory. A blob
+// starts with encryptionMagic and a random nonce prefix; each chunk's nonce
+// is the prefix followed by the chunk number. The blob name and whether the
+// chunk is the last one are authenticated with every chunk, so chunks
+// cannot be reordered, truncated or moved to another blob unnoticed.
+const (
+	encryptionMagic     = "CBE1"
+	encryptionChunkSize = 64 << 10
+	noncePrefixSize     = 8
+)
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	name    string
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	sealed  []byte
+}
+
+func newEncryptWriter(w io.Writer, aead cipher.AEAD, name string) (io.WriteCloser, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce[:noncePrefixSize]); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encryptionMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce[:noncePrefixSize]); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		name:  name,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it is not the last
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, which may be empty. It does not close the
+// underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	binary.BigEndian.PutUint32(e.nonce[noncePrefixSize:], e.counter)
+	e.counter++
+	e.sealed = e.aead.Seal(e.sealed[:0], e.nonce, e.buf, chunkData(e.name, last))
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	name    string
+	nonce   []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte // opened but not yet read
+	done    bool
+}
+
+// newDecryptReader reads a blob written by an encryptWriter with the same
+// key and name. Content that fails to authenticate is reported as
+// errBlobCorrupt.
+func newDecryptReader(r io.Reader, aead cipher.AEAD, name string) (io.Reader, error) {
+	header := make([]byte, len(encryptionMagic)+noncePrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %s has no encryption header", errBlobCorrupt, name)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("%w: %s has no encryption header", errBlobCorrupt, name)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(encryptionMagic):])
+	return &decryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		name:   name,
+		nonce:  nonce,
+		sealed: make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch err {
+	case nil:
+		_, err := d.r.Peek(1)
+		last = err == io.EOF
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[noncePrefixSize:], d.counter)
+	d.counter++
+	plain, err := d.aead.Open(d.sealed[:0], d.nonce, d.sealed[:n], chunkData(d.name, last))
+	if err != nil {
+		return fmt.Errorf("%w: %s chunk %d fails to decrypt", errBlobCorrupt, d.name, d.counter-1)
+	}
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+// chunkData is the additional data authenticated with every chunk.
+func chunkData(name string, last bool) []byte {
+	data := append([]byte(name), 0)
+	if last {
+		data[len(data)-1] = 1
+	}
+	return data
+}
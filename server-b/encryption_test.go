@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealedChunkSize is the size of a full chunk once sealed.
+const sealedChunkSize = encryptionChunkSize + 16
+
+func testDataKey(t *testing.T) *dataKey {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	k, err := newDataKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// encrypt seals plain as blob name in writes of at most step bytes.
+func encrypt(t *testing.T, key *dataKey, name string, plain []byte, step int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(&buf, key.aead, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(plain) > 0 {
+		n := min(step, len(plain))
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key *dataKey, name string, sealed []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(sealed), key.aead, name)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := testDataKey(t)
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		for _, step := range []int{1000, encryptionChunkSize, 1 << 20} {
+			sealed := encrypt(t, key, "blob", plain, step)
+			chunks := size/encryptionChunkSize + 1
+			if size > 0 && size%encryptionChunkSize == 0 {
+				chunks--
+			}
+			if want := len(encryptionMagic) + noncePrefixSize + size + chunks*16; len(sealed) != want {
+				t.Errorf("size %d: sealed %d bytes, want %d", size, len(sealed), want)
+			}
+			got, err := decrypt(key, "blob", sealed)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("size %d: round trip changed the content", size)
+			}
+		}
+	}
+}
+
+func TestEncryptionRejectsTampering(t *testing.T) {
+	key := testDataKey(t)
+	plain := make([]byte, 3*encryptionChunkSize+100)
+	rand.Read(plain)
+	sealed := encrypt(t, key, "blob", plain, len(plain))
+	header := len(encryptionMagic) + noncePrefixSize
+	chunk := func(i int) []byte {
+		return sealed[header+i*sealedChunkSize : min(header+(i+1)*sealedChunkSize, len(sealed))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[header+10] ^= 1
+
+	tests := []struct {
+		name   string
+		blob   string
+		sealed []byte
+	}{
+		{"empty", "blob", nil},
+		{"header only", "blob", sealed[:header]},
+		{"bad magic", "blob", join([]byte("XXXX"), sealed[len(encryptionMagic):])},
+		{"last chunk dropped", "blob", sealed[:header+3*sealedChunkSize]},
+		{"last two chunks dropped", "blob", sealed[:header+2*sealedChunkSize]},
+		{"cut within a chunk", "blob", sealed[:header+sealedChunkSize+100]},
+		{"cut within the last chunk", "blob", sealed[:len(sealed)-1]},
+		{"chunks swapped", "blob", join(sealed[:header], chunk(1), chunk(0), chunk(2), chunk(3))},
+		{"chunk repeated", "blob", join(sealed[:header], chunk(0), chunk(0), chunk(1), chunk(2), chunk(3))},
+		{"trailing data", "blob", join(sealed, []byte("x"))},
+		{"flipped bit", "blob", flipped},
+		{"other blob name", "other", sealed},
+	}
+	for _, tt := range tests {
+		got, err := decrypt(key, tt.blob, tt.sealed)
+		if !errors.Is(err, errBlobCorrupt) {
+			t.Errorf("%s: read %d bytes, err %v, want %v", tt.name, len(got), err, errBlobCorrupt)
+		}
+	}
+
+	if _, err := decrypt(testDataKey(t), "blob", sealed); !errors.Is(err, errBlobCorrupt) {
+		t.Errorf("other key: err %v, want %v", err, errBlobCorrupt)
+	}
+}
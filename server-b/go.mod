@@ -5,4 +5,5 @@ go 1.24.4
 require (
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/mux v1.8.1
-)
\ No newline at end of file
+	github.com/klauspost/compress v1.18.0
+)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxGrepPatternLength = 1000
+	defaultGrepResults   = 1000
+	maxGrepResults       = 10000
+	defaultGrepTimeout   = 10 * time.Second
+	maxGrepTimeout       = time.Minute
+)
+
+// GrepMatch is a line matching a grep, sent as soon as it is found.
+type GrepMatch struct {
+	Type   string `json:"type"` // "match"
+	Path   string `json:"path"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"` // of the first match, in bytes from 1
+	Text   string `json:"text"`
+}
+
+// GrepSummary ends every grep that got under way.
+type GrepSummary struct {
+	Type          string `json:"type"` // "summary"
+	Revision      int    `json:"revision"`
+	Matches       int    `json:"matches"`
+	FilesSearched int    `json:"files_searched"`
+	Truncated     bool   `json:"truncated"` // stopped at max_results
+	TimedOut      bool   `json:"timed_out"`
+}
+
+// GrepError reports a file that could not be searched.
+type GrepError struct {
+	Type  string `json:"type"` // "error"
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// grepCodebase handles GET /grep/{id}?pattern=..., running an RE2 regular
+// expression over every line of the text files of a revision of a codebase,
+// the latest by default. Matches are streamed as newline delimited JSON as
+// they are found, followed by a summary. include and exclude filter files
+// by glob, max_results stops the grep after that many matching lines and
+// timeout, a duration such as 5s, after that long.
+//
+// The codebase is only locked while its tree is read, so a long grep does
+// not hold up commits. Files a commit replaces meanwhile are skipped.
+func (s *StorageServer) grepCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	params := r.URL.Query()
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	pattern := params.Get("pattern")
+	if pattern == "" {
+		respondWithError(w, http.StatusBadRequest, "Pattern is required")
+		return
+	}
+	if len(pattern) > maxGrepPatternLength {
+		respondWithError(w, http.StatusBadRequest, "Pattern is too long")
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid pattern: %v", err))
+		return
+	}
+	maxResults, ok := boundedInt(params.Get("max_results"), defaultGrepResults, 1, maxGrepResults)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid max_results")
+		return
+	}
+	timeout := defaultGrepTimeout
+	if value := params.Get("timeout"); value != "" {
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 || timeout > maxGrepTimeout {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid timeout, expected a duration up to %s", maxGrepTimeout))
+			return
+		}
+	}
+	filter := newPathFilter(globPatterns(params["include"]), globPatterns(params["exclude"]))
+
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	tree, err := s.loadRevision(codebaseID, params.Get("rev"))
+	lock.RUnlock()
+	if err != nil {
+		respondWithTreeError(w, err, "Codebase not found")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(v interface{}) {
+		enc.Encode(v)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	summary := GrepSummary{Type: "summary", Revision: tree.revision()}
+files:
+	for _, p := range tree.sortedPaths() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !filter.allows(p) {
+			continue
+		}
+
+		content, err := s.searchableContent(codebaseID, p, tree.Files[p])
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if errors.Is(err, errBlobCorrupt) {
+			log.Printf("ERROR: file %s of codebase %s is corrupt: %v", p, codebaseID, err)
+			send(GrepError{Type: "error", Path: p, Error: "Stored file is corrupt"})
+			continue
+		}
+		if err != nil {
+			log.Printf("Error grepping file %s of codebase %s: %v", p, codebaseID, err)
+			send(GrepError{Type: "error", Path: p, Error: "Failed to read file"})
+			continue
+		}
+		if content == nil {
+			continue
+		}
+
+		summary.FilesSearched++
+		for i, line := range searchLines(content) {
+			if ctx.Err() != nil {
+				break files
+			}
+			loc := re.FindIndex(line)
+			if loc == nil {
+				continue
+			}
+			send(GrepMatch{Type: "match", Path: p, Line: i + 1, Column: loc[0] + 1, Text: snippet(line)})
+			summary.Matches++
+			if summary.Matches == maxResults {
+				summary.Truncated = true
+				break files
+			}
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && !summary.Truncated {
+		summary.TimedOut = true
+	}
+	send(summary)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Ignore files found in an upload, read in this order so that rules of an
+// .ignore file take precedence over those of a .gitignore next to it.
+var ignoreFileNames = []string{".gitignore", ".ignore"}
+
+const maxIgnoreFileSize = 1 << 20
+
+// ignoreRule is one pattern of an ignore file or of the server-wide
+// excludes, following the .gitignore syntax.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	reason  string
+}
+
+// ignoreMatcher decides which files of an upload are left out. The
+// server-wide excludes always apply; the rules of ignore files apply below
+// the directory holding them, deeper files overriding shallower ones.
+type ignoreMatcher struct {
+	excludes []ignoreRule
+	dirs     map[string][]ignoreRule // by the directory holding the ignore file, "" at the root
+}
+
+// parseIgnoreRules parses the lines of an ignore file. Invalid patterns are
+// skipped, as git does.
+func parseIgnoreRules(content, source string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		pattern := trimIgnorePattern(line)
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		rule := ignoreRule{reason: fmt.Sprintf("matches %q in %s", pattern, source)}
+		if strings.HasPrefix(pattern, "!") {
+			rule.negate = true
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		// A slash other than a trailing one anchors the pattern to the
+		// directory of the ignore file
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		if pattern == "" {
+			continue
+		}
+
+		expr, ok := ignorePatternRegexp(pattern, anchored)
+		if !ok {
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		rule.re = re
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// trimIgnorePattern removes trailing spaces that are not escaped.
+func trimIgnorePattern(line string) string {
+	end := len(line)
+	for end > 0 && line[end-1] == ' ' {
+		backslashes := 0
+		for i := end - 2; i >= 0 && line[i] == '\\'; i-- {
+			backslashes++
+		}
+		if backslashes%2 == 1 {
+			break
+		}
+		end--
+	}
+	return line[:end]
+}
+
+// ignorePatternRegexp translates a glob of the .gitignore syntax into a
+// regular expression matching slash separated paths. It reports false for a
+// bracket expression that is not closed, which git never matches.
+func ignorePatternRegexp(pattern string, anchored bool) (string, bool) {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**") && (i == 0 || pattern[i-1] == '/'):
+			rest := pattern[i+2:]
+			switch {
+			case rest == "":
+				b.WriteString(".*")
+				i++
+			case rest[0] == '/':
+				// Zero or more directories
+				b.WriteString("(?:.*/)?")
+				i += 2
+			default:
+				b.WriteString("[^/]*")
+				i++
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			class, n := ignoreClass(pattern[i:])
+			if n == 0 {
+				return "", false
+			}
+			b.WriteString(class)
+			i += n - 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String(), true
+}
+
+// ignoreClass translates the bracket expression at the start of pattern,
+// returning it and its length, or a length of 0 if it is not closed.
+func ignoreClass(pattern string) (string, int) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+	start := i
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	for i < len(pattern) && pattern[i] != ']' {
+		if pattern[i] == '\\' {
+			i += 2
+			continue
+		}
+		if strings.HasPrefix(pattern[i:], "[:") {
+			if end := strings.Index(pattern[i+2:], ":]"); end >= 0 {
+				i += end + 4
+				continue
+			}
+		}
+		i++
+	}
+	if i >= len(pattern) {
+		return "", 0
+	}
+
+	var b strings.Builder
+	b.WriteString("[")
+	if negate {
+		b.WriteString("^/")
+	}
+	for j := start; j < i; j++ {
+		if pattern[j] == '\\' && j+1 < i {
+			j++
+			b.WriteString(regexp.QuoteMeta(pattern[j : j+1]))
+			continue
+		}
+		if strings.HasPrefix(pattern[j:i], "[:") {
+			if end := strings.Index(pattern[j+2:i], ":]"); end >= 0 {
+				b.WriteString(pattern[j : j+end+4])
+				j += end + 3
+				continue
+			}
+		}
+		if pattern[j] == '[' {
+			b.WriteString(`\[`)
+			continue
+		}
+		if pattern[j] == ']' {
+			// Literal here, but it would close the class after the ^/
+			// added for a negation
+			b.WriteString(`\]`)
+			continue
+		}
+		b.WriteByte(pattern[j])
+	}
+	b.WriteString("]")
+	return b.String(), i + 1
+}
+
+// decide returns the last of rules matching p, relative to the directory
+// the rules belong to, or nil.
+func decide(rules []ignoreRule, p string, isDir bool) *ignoreRule {
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := &rules[i]
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(p) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// match returns why p, a file or directory, is left out, or "".
+func (m *ignoreMatcher) match(p string, isDir bool) string {
+	if rule := decide(m.excludes, p, isDir); rule != nil && !rule.negate {
+		return rule.reason
+	}
+
+	// The ignore file closest to p decides
+	dir := path.Dir(p)
+	for {
+		if dir == "." {
+			dir = ""
+		}
+		rel := p
+		if dir != "" {
+			rel = strings.TrimPrefix(p, dir+"/")
+		}
+		if rule := decide(m.dirs[dir], rel, isDir); rule != nil {
+			if rule.negate {
+				return ""
+			}
+			return rule.reason
+		}
+		if dir == "" {
+			return ""
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// ignored returns why the file at p is left out, or "". Files inside an
+// ignored directory are left out whatever their own rules say, as git does.
+func (m *ignoreMatcher) ignored(p string) string {
+	parts := strings.Split(p, "/")
+	for i := 1; i < len(parts); i++ {
+		if reason := m.match(strings.Join(parts[:i], "/"), true); reason != "" {
+			return reason
+		}
+	}
+	return m.match(p, false)
+}
+
+// applyIgnoreRules marks the stored files of results that the ignore files
+// among them or the server-wide excludes rule out as ignored. dir holds the
+// files under their paths; ignored files are left there, as only stored
+// files are ever committed, and an upload session whose stage is aborted
+// needs them back. excludes holds one pattern per line.
+func applyIgnoreRules(dir string, results []FileResult, excludes string) {
+	m := &ignoreMatcher{
+		excludes: parseIgnoreRules(excludes, "the server-wide excludes"),
+		dirs:     make(map[string][]ignoreRule),
+	}
+
+	var ignoreFiles []string
+	for _, result := range results {
+		if result.Status == fileStored && isIgnoreFile(result.Path) {
+			ignoreFiles = append(ignoreFiles, result.Path)
+		}
+	}
+	sort.Slice(ignoreFiles, func(i, j int) bool {
+		// Within a directory .gitignore is read before .ignore
+		di, dj := path.Dir(ignoreFiles[i]), path.Dir(ignoreFiles[j])
+		if di != dj {
+			return di < dj
+		}
+		return ignoreFileRank(ignoreFiles[i]) < ignoreFileRank(ignoreFiles[j])
+	})
+	for _, p := range ignoreFiles {
+		content, err := readIgnoreFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			log.Printf("Skipping ignore file %s: %v", p, err)
+			continue
+		}
+		base := path.Dir(p)
+		if base == "." {
+			base = ""
+		}
+		m.dirs[base] = append(m.dirs[base], parseIgnoreRules(content, p)...)
+	}
+	if len(m.excludes) == 0 && len(m.dirs) == 0 {
+		return
+	}
+
+	for i, result := range results {
+		if result.Status != fileStored {
+			continue
+		}
+		reason := m.ignored(result.Path)
+		if reason == "" {
+			continue
+		}
+		results[i] = ignoredResult(result.Path, result.Size, reason)
+	}
+}
+
+func isIgnoreFile(p string) bool {
+	return ignoreFileRank(p) >= 0
+}
+
+func ignoreFileRank(p string) int {
+	name := path.Base(p)
+	for i, ignoreName := range ignoreFileNames {
+		if name == ignoreName {
+			return i
+		}
+	}
+	return -1
+}
+
+func readIgnoreFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	content, err := io.ReadAll(io.LimitReader(f, maxIgnoreFileSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(content) > maxIgnoreFileSize {
+		return "", fmt.Errorf("larger than %d bytes", maxIgnoreFileSize)
+	}
+	return string(content), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// The expectations below were checked against git check-ignore.
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		rules   string
+		ignored []string
+		kept    []string
+	}{
+		{"*.log", []string{"a.log", "dir/a.log"}, []string{"a.log.txt"}},
+		// Anchoring
+		{"/build", []string{"build", "build/x.o"}, []string{"src/build", "build2"}},
+		{"doc/*.txt", []string{"doc/a.txt"}, []string{"doc/sub/a.txt", "x/doc/a.txt"}},
+		{"?.c", []string{"a.c", "d/e.c"}, []string{"ab.c"}},
+		// Directories only
+		{"build/", []string{"build/x.o", "src/build/x.o"}, []string{"build", "buildfile"}},
+		// **
+		{"**/foo", []string{"foo", "a/b/foo", "foo/x"}, []string{"a/foox"}},
+		{"**/foo/bar", []string{"foo/bar", "a/foo/bar"}, []string{"a/foo/baz"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"ab", "x/a/b"}},
+		{"abc/**", []string{"abc/z", "abc/x/y"}, []string{"abc", "abcd"}},
+		{"a**b", []string{"axxb", "ab"}, []string{"ax/b"}},
+		// Bracket expressions
+		{"[abc].txt", []string{"a.txt"}, []string{"d.txt"}},
+		{"[!abc].txt", []string{"d.txt"}, []string{"a.txt"}},
+		{"[^abc].txt", []string{"d.txt"}, []string{"a.txt"}},
+		{"[a-c]x", []string{"bx"}, []string{"dx"}},
+		{"[[:digit:]]*.tmp", []string{"1a.tmp"}, []string{"a.tmp"}},
+		{"[]]x", []string{"]x"}, []string{"x"}},
+		{`[\]]x`, []string{"]x"}, []string{`\x`}},
+		{"[!]]x", []string{"ax"}, []string{"]x"}},
+		{"[a[b]x", []string{"[x", "ax"}, nil},
+		{"[[:alpha:]x]y", []string{"ay", "xy"}, []string{"1y"}},
+		{"[unclosed", nil, []string{"[unclosed", "u"}},
+		// Escapes, comments and blank lines
+		{`\#hash`, []string{"#hash"}, nil},
+		{`\!bang`, []string{"!bang"}, nil},
+		{`a\*b`, []string{"a*b"}, []string{"axb"}},
+		{`space\ `, []string{"space "}, []string{"space"}},
+		{"# comment\n\n*.o   ", []string{"a.o"}, []string{"# comment"}},
+		{"*.o\r\n", []string{"a.o"}, nil},
+		// Negation
+		{"*.log\n!keep.log", []string{"a.log"}, []string{"keep.log", "x/keep.log"}},
+		{"!keep.log\n*.log", []string{"keep.log"}, nil},
+		{"logs/\n!logs/keep.log", []string{"logs/keep.log"}, nil},
+	}
+	for _, tt := range tests {
+		m := &ignoreMatcher{dirs: map[string][]ignoreRule{"": parseIgnoreRules(tt.rules, ".gitignore")}}
+		for _, p := range tt.ignored {
+			if m.ignored(p) == "" {
+				t.Errorf("%q: %s kept, want ignored", tt.rules, p)
+			}
+		}
+		for _, p := range tt.kept {
+			if reason := m.ignored(p); reason != "" {
+				t.Errorf("%q: %s ignored (%s), want kept", tt.rules, p, reason)
+			}
+		}
+	}
+}
+
+func TestIgnoreNested(t *testing.T) {
+	m := &ignoreMatcher{
+		excludes: parseIgnoreRules(".git/\n.DS_Store", "the server-wide excludes"),
+		dirs: map[string][]ignoreRule{
+			"":    parseIgnoreRules("*.tmp\n!.DS_Store", ".gitignore"),
+			"sub": parseIgnoreRules("!important.tmp\n/local", "sub/.gitignore"),
+		},
+	}
+	tests := []struct {
+		path   string
+		reason string
+	}{
+		{"a.tmp", `matches "*.tmp" in .gitignore`},
+		{"important.tmp", `matches "*.tmp" in .gitignore`},
+		{"sub/a.tmp", `matches "*.tmp" in .gitignore`},
+		{"sub/important.tmp", ""},
+		{"sub/local", `matches "/local" in sub/.gitignore`},
+		{"sub/x/local", ""},
+		{"local", ""},
+		// Ignore files cannot bring back what the excludes leave out
+		{".DS_Store", `matches ".DS_Store" in the server-wide excludes`},
+		{"sub/.DS_Store", `matches ".DS_Store" in the server-wide excludes`},
+		{".git/config", `matches ".git/" in the server-wide excludes`},
+		{"sub/.git/HEAD", `matches ".git/" in the server-wide excludes`},
+	}
+	for _, tt := range tests {
+		if got := m.ignored(tt.path); got != tt.reason {
+			t.Errorf("ignored(%s) = %q, want %q", tt.path, got, tt.reason)
+		}
+	}
+}
+
+func TestIgnorePatternRegexp(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		anchored bool
+		want     string
+	}{
+		{"foo", false, `^(?:.*/)?foo$`},
+		{"foo", true, `^foo$`},
+		{"*.go", false, `^(?:.*/)?[^/]*\.go$`},
+		{"a/?", true, `^a/[^/]$`},
+		{"**/foo", true, `^(?:.*/)?foo$`},
+		{"a/**/b", true, `^a/(?:.*/)?b$`},
+		{"a/**", true, `^a/.*$`},
+		{"a**", false, `^(?:.*/)?a[^/]*[^/]*$`},
+		{"[!a-c]", false, `^(?:.*/)?[^/a-c]$`},
+		{`\[x`, false, `^(?:.*/)?\[x$`},
+	}
+	for _, tt := range tests {
+		got, ok := ignorePatternRegexp(tt.pattern, tt.anchored)
+		if !ok || got != tt.want {
+			t.Errorf("ignorePatternRegexp(%q, %v) = %q, %v, want %q", tt.pattern, tt.anchored, got, ok, tt.want)
+		}
+		if _, err := regexp.Compile(got); err != nil {
+			t.Errorf("ignorePatternRegexp(%q, %v): %v", tt.pattern, tt.anchored, err)
+		}
+	}
+
+	if got, ok := ignorePatternRegexp("a[b", false); ok {
+		t.Errorf("ignorePatternRegexp(%q) = %q, want not ok", "a[b", got)
+	}
+}
+
+func TestIgnoreClass(t *testing.T) {
+	tests := []struct {
+		pattern string
+		class   string
+		n       int
+	}{
+		{"[abc]x", "[abc]", 5},
+		{"[!abc]", "[^/abc]", 6},
+		{"[^a]", "[^/a]", 4},
+		{"[]a]", `[\]a]`, 4},
+		{"[!]]", `[^/\]]`, 4},
+		{"[[:alpha:]]", "[[:alpha:]]", 11},
+		{"[[:alpha:]x]", "[[:alpha:]x]", 12},
+		{`[\]]`, `[\]]`, 4},
+		{"[a[b]", `[a\[b]`, 5},
+		{`[\]`, "", 0},
+		{"[abc", "", 0},
+		{"[", "", 0},
+		{"[[:alpha:]", "", 0},
+	}
+	for _, tt := range tests {
+		class, n := ignoreClass(tt.pattern)
+		if class != tt.class || n != tt.n {
+			t.Errorf("ignoreClass(%q) = %q, %d, want %q, %d", tt.pattern, class, n, tt.class, tt.n)
+		}
+	}
+}
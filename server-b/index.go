@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Every revision of a codebase has a trigram index for full-text search in
+// .index/<id>/<n>.idx, mapping each trigram of its text files' content to
+// the files holding it. Trigrams are taken of content lowercased in ASCII,
+// so one index serves searches with and without case. The index is only a
+// filter: search checks every file it picks against its content, and files
+// the index does not know, or knows with other content, are checked
+// whatever it says. Indexes therefore never need to be exactly up to date.
+// They are compressed, and encrypted like the blobs of encrypted codebases.
+const indexPrefix = ".index/"
+
+// maxSearchFileSize is the size above which files are neither indexed nor
+// searched.
+const maxSearchFileSize = 1 << 20
+
+func indexesPrefix(id string) string {
+	return indexPrefix + id + "/"
+}
+
+func indexKey(id string, revision int) string {
+	return indexesPrefix(id) + strconv.Itoa(revision) + ".idx"
+}
+
+type searchIndex struct {
+	Files    []indexedFile
+	Trigrams map[uint32][]uint32 // sorted numbers of the files holding each trigram
+}
+
+type indexedFile struct {
+	Path   string
+	SHA256 string
+}
+
+// trigramSet returns the distinct trigrams of content, sorted. Trigrams
+// spanning lines are left out, as searches match within a line.
+func trigramSet(content []byte) []uint32 {
+	seen := make(map[uint32]bool)
+	for i := 0; i+3 <= len(content); i++ {
+		if content[i] == '\n' || content[i+1] == '\n' || content[i+2] == '\n' {
+			continue
+		}
+		seen[trigram(content[i:i+3])] = true
+	}
+
+	set := make([]uint32, 0, len(seen))
+	for t := range seen {
+		set = append(set, t)
+	}
+	sort.Slice(set, func(i, j int) bool { return set[i] < set[j] })
+	return set
+}
+
+func trigram(p []byte) uint32 {
+	return uint32(lowerASCII(p[0]))<<16 | uint32(lowerASCII(p[1]))<<8 | uint32(lowerASCII(p[2]))
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// fileTrigrams inverts the index, returning the trigrams of every content
+// it holds by checksum.
+func (idx *searchIndex) fileTrigrams() map[string][]uint32 {
+	byFile := make([][]uint32, len(idx.Files))
+	for t, files := range idx.Trigrams {
+		for _, n := range files {
+			if int(n) < len(byFile) {
+				byFile[n] = append(byFile[n], t)
+			}
+		}
+	}
+
+	bySum := make(map[string][]uint32, len(idx.Files))
+	for n, file := range idx.Files {
+		bySum[file.SHA256] = byFile[n]
+	}
+	return bySum
+}
+
+// covers reports whether the index holds exactly the files of tree.
+func (idx *searchIndex) covers(tree *codebaseTree) bool {
+	if len(idx.Files) != len(tree.Files) {
+		return false
+	}
+	for _, file := range idx.Files {
+		if entry, ok := tree.Files[file.Path]; !ok || entry.SHA256 != file.SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns which files of tree may hold all of trigrams: those
+// the index says do, and those it does not know as they are in tree. idx
+// may be nil. It also reports whether the index missed any file.
+func (idx *searchIndex) candidates(tree *codebaseTree, trigrams []uint32) (map[string]bool, bool) {
+	known := make(map[string]uint32)
+	if idx != nil {
+		for n, file := range idx.Files {
+			if entry, ok := tree.Files[file.Path]; ok && entry.SHA256 == file.SHA256 {
+				known[file.Path] = uint32(n)
+			}
+		}
+	}
+
+	var matching map[uint32]bool
+	if len(known) > 0 && len(trigrams) > 0 {
+		lists := make([][]uint32, len(trigrams))
+		for i, t := range trigrams {
+			lists[i] = idx.Trigrams[t]
+		}
+		// Intersect starting from the rarest trigram
+		sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+		matching = make(map[uint32]bool, len(lists[0]))
+		for _, n := range lists[0] {
+			matching[n] = true
+		}
+		for _, list := range lists[1:] {
+			next := make(map[uint32]bool, len(matching))
+			for _, n := range list {
+				if matching[n] {
+					next[n] = true
+				}
+			}
+			matching = next
+		}
+	}
+
+	candidates := make(map[string]bool)
+	for p := range tree.Files {
+		n, ok := known[p]
+		if !ok || matching == nil || matching[n] {
+			candidates[p] = true
+		}
+	}
+	return candidates, len(known) < len(tree.Files)
+}
+
+// buildIndex indexes the files of tree, taking the trigrams of content
+// previous already holds from it rather than reading it again. previous
+// may be nil.
+func (s *StorageServer) buildIndex(tree *codebaseTree, previous *searchIndex) (*searchIndex, error) {
+	known := make(map[string][]uint32)
+	if previous != nil {
+		known = previous.fileTrigrams()
+	}
+
+	idx := &searchIndex{Trigrams: make(map[uint32][]uint32)}
+	for _, p := range tree.sortedPaths() {
+		entry := tree.Files[p]
+		n := uint32(len(idx.Files))
+		idx.Files = append(idx.Files, indexedFile{Path: p, SHA256: entry.SHA256})
+
+		set, ok := known[entry.SHA256]
+		if !ok {
+			content, err := s.searchableContent(tree.ID, p, entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			set = trigramSet(content)
+			known[entry.SHA256] = set
+		}
+		for _, t := range set {
+			idx.Trigrams[t] = append(idx.Trigrams[t], n)
+		}
+	}
+	return idx, nil
+}
+
+// searchableContent reads a file of a codebase, or returns nil for binary
+// files and files too large to search.
+func (s *StorageServer) searchableContent(codebaseID, p string, entry treeEntry) ([]byte, error) {
+	if entry.Size > maxSearchFileSize {
+		return nil, nil
+	}
+	if entry.MIMEType != "" && !isTextMIMEType(entry.MIMEType) {
+		return nil, nil
+	}
+
+	content, err := s.readBlob(codebaseID, entry)
+	if err != nil {
+		return nil, err
+	}
+	mimeType, _ := storedType(p, entry, content)
+	if !isTextContent(mimeType, content) {
+		return nil, nil
+	}
+	return content, nil
+}
+
+// loadIndex reads the index of a revision of a codebase. It returns an
+// os.IsNotExist error if there is none.
+func (s *StorageServer) loadIndex(id string, revision int) (*searchIndex, error) {
+	key := indexKey(id, revision)
+	f, err := s.backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var src io.Reader = f
+	if s.keys.encrypted(id) {
+		aead, err := s.keys.aead(id)
+		if err != nil {
+			return nil, err
+		}
+		if src, err = newDecryptReader(f, aead, key); err != nil {
+			return nil, err
+		}
+	}
+	dec, err := newDecoder(encodingZstd, src)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	var idx searchIndex
+	if err := gob.NewDecoder(dec).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return &idx, nil
+}
+
+func (s *StorageServer) saveIndex(id string, revision int, idx *searchIndex) error {
+	key := indexKey(id, revision)
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopWriteCloser{&buf}
+	if s.keys.encrypted(id) {
+		aead, err := s.keys.aead(id)
+		if err != nil {
+			return err
+		}
+		if dst, err = newEncryptWriter(&buf, aead, key); err != nil {
+			return err
+		}
+	}
+	enc, err := newEncoder(encodingZstd, dst)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(enc).Encode(idx); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return writeObject(s.backend, key, buf.Bytes())
+}
+
+// deleteIndexes removes the indexes of every revision of a codebase.
+func (s *StorageServer) deleteIndexes(id string) error {
+	objects, err := s.backend.List(indexesPrefix(id))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := s.backend.Delete(object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexLatest brings the index of the latest revision of a codebase up to
+// date, starting from its current index or that of the revision before.
+// The codebase is not locked while files are read, so commits need not
+// wait; one that releases a file being read fails the build, and the
+// index is updated again after it anyway.
+func (s *StorageServer) indexLatest(id string) error {
+	lock := codebaseLock(id)
+	lock.RLock()
+	tree, err := s.loadTree(id)
+	lock.RUnlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	revision := tree.revision()
+	previous, err := s.loadIndex(id, revision)
+	if err == nil && previous.covers(tree) {
+		return nil
+	}
+	if err != nil && revision > 1 {
+		previous, _ = s.loadIndex(id, revision-1)
+	}
+
+	idx, err := s.buildIndex(tree, previous)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Not once the codebase is deleted, which would leave the index behind
+	lock.RLock()
+	defer lock.RUnlock()
+	if _, err := s.backend.Stat(treeKey(id)); os.IsNotExist(err) {
+		return nil
+	}
+	return s.saveIndex(id, revision, idx)
+}
+
+// indexer tracks the indexes being updated in the background.
+type indexer struct {
+	mu      sync.Mutex
+	running map[string]bool
+	again   map[string]bool // changed while being indexed
+}
+
+// updateIndex indexes the latest revision of a codebase in the background,
+// once more after the build in progress if there is one.
+func (s *StorageServer) updateIndex(codebaseID string) {
+	s.indexer.mu.Lock()
+	if s.indexer.running == nil {
+		s.indexer.running = make(map[string]bool)
+		s.indexer.again = make(map[string]bool)
+	}
+	if s.indexer.running[codebaseID] {
+		s.indexer.again[codebaseID] = true
+		s.indexer.mu.Unlock()
+		return
+	}
+	s.indexer.running[codebaseID] = true
+	s.indexer.mu.Unlock()
+
+	go func() {
+		for {
+			if err := s.indexLatest(codebaseID); err != nil {
+				log.Printf("Error indexing codebase %s: %v", codebaseID, err)
+			}
+
+			s.indexer.mu.Lock()
+			if !s.indexer.again[codebaseID] {
+				delete(s.indexer.running, codebaseID)
+				s.indexer.mu.Unlock()
+				return
+			}
+			delete(s.indexer.again, codebaseID)
+			s.indexer.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// StoredFile is a file of a codebase as recorded in storage.
+type StoredFile struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type CodebaseInventory struct {
+	ID    string       `json:"directory_id"`
+	Files []StoredFile `json:"files"`
+}
+
+// getInventory lists every codebase in storage with the files it contains,
+// for Server A to reconcile against its metadata.
+func (s *StorageServer) getInventory(w http.ResponseWriter, r *http.Request) {
+	ids, err := s.codebaseIDs()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read storage directory")
+		return
+	}
+
+	codebases := []CodebaseInventory{}
+	for _, id := range ids {
+		tree, err := s.loadTree(id)
+		if os.IsNotExist(err) {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			log.Printf("Error listing codebase %s: %v", id, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to list codebase files")
+			return
+		}
+
+		files := []StoredFile{}
+		for _, path := range tree.sortedPaths() {
+			files = append(files, StoredFile{
+				Name:   filepath.Base(filepath.FromSlash(path)),
+				Path:   path,
+				Size:   tree.Files[path].Size,
+				SHA256: tree.Files[path].SHA256,
+			})
+		}
+
+		codebases = append(codebases, CodebaseInventory{
+			ID:    id,
+			Files: files,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"codebases": codebases,
+	})
+}
+
+// codebaseLocks guard codebase trees: requests reading a codebase hold its
+// read lock, while commits and deletions hold the write lock.
+var codebaseLocks sync.Map
+
+func codebaseLock(id string) *sync.RWMutex {
+	value, _ := codebaseLocks.LoadOrStore(id, &sync.RWMutex{})
+	return value.(*sync.RWMutex)
+}
+
+// deleteCodebase removes a codebase and releases its blobs. It waits for
+// downloads of the codebase in progress to finish.
+func (s *StorageServer) deleteCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	lock := codebaseLock(codebaseID)
+	lock.Lock()
+	err := s.deleteTree(codebaseID)
+	lock.Unlock()
+
+	if os.IsNotExist(err) {
+		respondWithError(w, http.StatusNotFound, "Codebase not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting codebase %s: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete codebase")
+		return
+	}
+
+	log.Printf("Deleted codebase: %s", codebaseID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
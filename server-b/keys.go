@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// wrappedKey is the data key of one codebase, sealed with a master key and
+// stored as .keys/<id>.json in the storage backend. Rotating the master key
+// only rewraps these files; the blobs keep their data keys.
+type wrappedKey struct {
+	MasterKeyID string `json:"master_key_id"`
+	DataKey     string `json:"data_key"`
+}
+
+const pendingKeySuffix = ".pending"
+
+// keyStore holds the data keys of encrypted codebases. With a master key
+// configured, every new codebase gets its own AES-256 data key and its
+// blobs, trees and search indexes are stored encrypted with it; codebases
+// without a key are stored in plain.
+type keyStore struct {
+	backend  Backend
+	master   cipher.AEAD // nil without a master key
+	masterID string
+
+	mu   sync.Mutex
+	keys map[string]*dataKey // by codebase
+}
+
+// dataKey is the data key of one codebase, ready for use: the AEAD its
+// objects are sealed with and the key its blob names are derived with.
+type dataKey struct {
+	aead  cipher.AEAD
+	names []byte
+}
+
+func newDataKey(key []byte) (*dataKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{aead: aead, names: hmacSHA256(key, "blob names")}, nil
+}
+
+func newKeyStore(backend Backend, master []byte) (*keyStore, error) {
+	k := &keyStore{backend: backend, keys: make(map[string]*dataKey)}
+	if master == nil {
+		return k, nil
+	}
+
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	k.master = aead
+	k.masterID = masterKeyID(master)
+	return k, nil
+}
+
+// readMasterKey reads a base64 encoded 32 byte key from the environment
+// variable name, or from the file named by name_FILE. It returns nil if
+// neither is set.
+func readMasterKey(name string) ([]byte, error) {
+	value := os.Getenv(name)
+	if file := os.Getenv(name + "_FILE"); value == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		value = string(data)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not base64: %w", name, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes, got %d", name, len(key))
+	}
+	return key, nil
+}
+
+// masterKeyID identifies a master key without revealing it.
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const keysPrefix = ".keys/"
+
+func (k *keyStore) key(id string) string {
+	return keysPrefix + id + ".json"
+}
+
+func (k *keyStore) pendingKey(id string) string {
+	return keysPrefix + id + pendingKeySuffix + ".json"
+}
+
+// enabled reports whether new codebases are encrypted.
+func (k *keyStore) enabled() bool {
+	return k.master != nil
+}
+
+// encrypted reports whether a codebase is encrypted.
+func (k *keyStore) encrypted(id string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.keys[id] != nil
+}
+
+// aead returns the data key of a codebase.
+func (k *keyStore) aead(id string) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key := k.keys[id]; key != nil {
+		return key.aead, nil
+	}
+	return nil, fmt.Errorf("no data key for codebase %s", id)
+}
+
+// blobName names the blob holding content sum in codebase id: sum itself
+// for plain codebases, an HMAC of it keyed from the data key and the
+// codebase ID for encrypted ones.
+func (k *keyStore) blobName(id, sum string) string {
+	k.mu.Lock()
+	key := k.keys[id]
+	k.mu.Unlock()
+	if key == nil {
+		return sum
+	}
+	return blobName(hex.EncodeToString(hmacSHA256(key.names, sum)), id)
+}
+
+// load unwraps the data keys of all encrypted codebases. It fails if any
+// of them cannot be unwrapped with the configured master key, so a wrong
+// or missing key is noticed on startup rather than on first read.
+func (k *keyStore) load() error {
+	objects, err := k.backend.List(keysPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		id := strings.TrimSuffix(name, ".json")
+		if _, err := uuid.Parse(id); err != nil || id == name {
+			// Pending keys are only used by encrypt-codebases
+			continue
+		}
+		wrapped, err := k.readWrappedKey(object.Key, id)
+		if err != nil {
+			return err
+		}
+		if k.master == nil {
+			return fmt.Errorf("codebase %s is encrypted but no master key is configured", id)
+		}
+		if wrapped.MasterKeyID != k.masterID {
+			return fmt.Errorf("data key of %s is wrapped with master key %s, not %s; run rotate-master-key", id, wrapped.MasterKeyID, k.masterID)
+		}
+		key, err := wrapped.unwrap(id, k.master)
+		if err != nil {
+			return err
+		}
+		if k.keys[id], err = newDataKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *keyStore) readWrappedKey(key, id string) (*wrappedKey, error) {
+	data, err := readObject(k.backend, key)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped wrappedKey
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("data key of %s: %w", id, err)
+	}
+	return &wrapped, nil
+}
+
+// unwrap opens the data key of codebase id with the master key it was
+// wrapped with.
+func (w *wrappedKey) unwrap(id string, master cipher.AEAD) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(w.DataKey)
+	if err != nil || len(sealed) < master.NonceSize() {
+		return nil, fmt.Errorf("data key of %s is malformed", id)
+	}
+	key, err := master.Open(nil, sealed[:master.NonceSize()], sealed[master.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("data key of %s fails to unwrap", id)
+	}
+	return key, nil
+}
+
+// writeWrappedKey wraps the data key of codebase id with the configured
+// master key and stores it under objectKey.
+func (k *keyStore) writeWrappedKey(objectKey, id string, key []byte) error {
+	nonce := make([]byte, k.master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	wrapped := wrappedKey{
+		MasterKeyID: k.masterID,
+		DataKey:     base64.StdEncoding.EncodeToString(k.master.Seal(nonce, nonce, key, []byte(id))),
+	}
+	data, err := json.Marshal(wrapped)
+	if err != nil {
+		return err
+	}
+	return writeObject(k.backend, objectKey, data)
+}
+
+// create gives a codebase a new data key. A key left by a commit that
+// failed before its tree was saved is reused.
+func (k *keyStore) create(id string) error {
+	if k.encrypted(id) {
+		return nil
+	}
+	key, err := k.newKey(k.key(id), id)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys[id] = key
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *keyStore) newKey(objectKey, id string) (*dataKey, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := k.writeWrappedKey(objectKey, id, key); err != nil {
+		return nil, err
+	}
+	return newDataKey(key)
+}
+
+// pending loads the data key a plain codebase is being encrypted with,
+// creating it on the first attempt. Blobs can be encrypted with it, but the
+// codebase stays plain until activate.
+func (k *keyStore) pending(id string) error {
+	var key *dataKey
+	wrapped, err := k.readWrappedKey(k.pendingKey(id), id)
+	switch {
+	case os.IsNotExist(err):
+		key, err = k.newKey(k.pendingKey(id), id)
+	case err == nil:
+		var raw []byte
+		if raw, err = wrapped.unwrap(id, k.master); err == nil {
+			key, err = newDataKey(raw)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys[id] = key
+	k.mu.Unlock()
+	return nil
+}
+
+// activate makes a pending key the key of its codebase.
+func (k *keyStore) activate(id string) error {
+	data, err := readObject(k.backend, k.pendingKey(id))
+	if err != nil {
+		return err
+	}
+	if err := writeObject(k.backend, k.key(id), data); err != nil {
+		return err
+	}
+	return k.backend.Delete(k.pendingKey(id))
+}
+
+// remove deletes the data key of a deleted codebase, so copies of its blobs
+// that survive elsewhere can no longer be read.
+func (k *keyStore) remove(id string) error {
+	k.mu.Lock()
+	delete(k.keys, id)
+	k.mu.Unlock()
+
+	return k.backend.Delete(k.key(id))
+}
+
+// rotateMasterKey rewraps every data key wrapped with the old master key
+// with the configured one. It is run as "server-b rotate-master-key" while
+// the server is stopped, with the old key in STORAGE_OLD_MASTER_KEY, and
+// can be rerun after an interruption. Blobs and trees are not touched, as
+// the data keys stay the same.
+func (k *keyStore) rotateMasterKey(old []byte) error {
+	if k.master == nil {
+		return errors.New("no new master key configured")
+	}
+	oldAEAD, err := newAEAD(old)
+	if err != nil {
+		return err
+	}
+	oldID := masterKeyID(old)
+
+	objects, err := k.backend.List(keysPrefix)
+	if err != nil {
+		return err
+	}
+
+	rewrapped, current := 0, 0
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimSuffix(name, ".json"), pendingKeySuffix)
+
+		wrapped, err := k.readWrappedKey(object.Key, id)
+		if err != nil {
+			return err
+		}
+		switch wrapped.MasterKeyID {
+		case k.masterID:
+			current++
+			continue
+		case oldID:
+		default:
+			return fmt.Errorf("data key of %s is wrapped with master key %s, neither the old nor the new one", id, wrapped.MasterKeyID)
+		}
+
+		key, err := wrapped.unwrap(id, oldAEAD)
+		if err != nil {
+			return err
+		}
+		if err := k.writeWrappedKey(object.Key, id, key); err != nil {
+			return err
+		}
+		rewrapped++
+	}
+
+	log.Printf("Rewrapped %d data keys with master key %s; %d already used it", rewrapped, k.masterID, current)
+	return nil
+}
+
+// encryptCodebases encrypts the blobs and trees of every plain codebase
+// with a new data key of its own. It is run as "server-b encrypt-codebases"
+// while the server is stopped, and can be rerun after an interruption. A
+// codebase only switches to its encrypted blobs once all of them are
+// written, and its trees are sealed right after; the plain blobs no
+// codebase uses any more are removed on the next start.
+func (s *StorageServer) encryptCodebases() error {
+	if !s.keys.enabled() {
+		return errors.New("no master key configured")
+	}
+	ids, err := s.codebaseIDs()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.stagingDir(), 0755); err != nil {
+		return err
+	}
+
+	encrypted := 0
+	for _, id := range ids {
+		if s.keys.encrypted(id) {
+			// Sealing its trees may have been interrupted
+			if err := s.sealTrees(id); err != nil {
+				return fmt.Errorf("seal trees of %s: %w", id, err)
+			}
+			continue
+		}
+		tree, err := s.loadTree(id)
+		if err != nil {
+			return fmt.Errorf("load tree of %s: %w", id, err)
+		}
+		revisions, err := s.revisionTrees(id)
+		if err != nil {
+			return fmt.Errorf("load revisions of %s: %w", id, err)
+		}
+		if err := s.keys.pending(id); err != nil {
+			return err
+		}
+
+		sums := make(map[string]bool)
+		for _, t := range append(revisions, tree) {
+			for _, entry := range t.Files {
+				sums[entry.SHA256] = true
+			}
+		}
+		for sum := range sums {
+			if err := s.encryptBlob(sum, s.blobName(id, sum)); err != nil {
+				return fmt.Errorf("encrypt blob %s of %s: %w", sum, id, err)
+			}
+		}
+
+		if err := s.keys.activate(id); err != nil {
+			return err
+		}
+		if err := s.sealTrees(id); err != nil {
+			return fmt.Errorf("seal trees of %s: %w", id, err)
+		}
+		// Search indexes are rebuilt sealed
+		if err := s.deleteIndexes(id); err != nil {
+			return err
+		}
+		encrypted++
+	}
+
+	log.Printf("Encrypted %d codebases; %d already were", encrypted, len(ids)-encrypted)
+	return nil
+}
+
+// encryptBlob stores plain blob sum again as encrypted blob name.
+func (s *StorageServer) encryptBlob(sum, name string) error {
+	if _, _, err := s.blobs.find(name); err == nil {
+		return nil
+	}
+	object, from, err := s.blobs.find(sum)
+	if err != nil {
+		return err
+	}
+
+	encode := func(encoding string) (string, error) {
+		src, err := s.blobs.openObject(object, sum, sum, from, -1)
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+		return s.blobs.encode(src, s.stagingDir(), name, encoding)
+	}
+	encoding := s.blobs.encoding
+	tmp, err := encode(encoding)
+	if err == nil && tmp == "" {
+		encoding = encodingNone
+		tmp, err = encode(encoding)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.blobs.mu.Lock()
+	defer s.blobs.mu.Unlock()
+	return s.blobs.put(tmp, name, encoding)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func testMasterKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testKeyStore(t *testing.T, b Backend, master []byte) *keyStore {
+	t.Helper()
+	k, err := newKeyStore(b, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	b := newMemoryBackend()
+	oldMaster, newMaster := testMasterKey(t), testMasterKey(t)
+	id, pendingID := uuid.NewString(), uuid.NewString()
+	plain := bytes.Repeat([]byte("old blob "), encryptionChunkSize/4)
+
+	// Blobs written under the old master key, by a codebase and by one
+	// being encrypted
+	k := testKeyStore(t, b, oldMaster)
+	if err := k.create(id); err != nil {
+		t.Fatal(err)
+	}
+	name := k.blobName(id, "sum")
+	sealed := encrypt(t, k.keys[id], name, plain, len(plain))
+	if err := k.pending(pendingID); err != nil {
+		t.Fatal(err)
+	}
+	pendingSealed := encrypt(t, k.keys[pendingID], "pending", plain, len(plain))
+
+	if err := testKeyStore(t, b, newMaster).load(); err == nil {
+		t.Fatal("load with the new master key before rotating succeeded")
+	}
+	if err := testKeyStore(t, b, newMaster).rotateMasterKey(testMasterKey(t)); err == nil {
+		t.Fatal("rotate from a wrong old master key succeeded")
+	}
+
+	for i := 0; i < 2; i++ {
+		// Rerunning after completion changes nothing
+		if err := testKeyStore(t, b, newMaster).rotateMasterKey(oldMaster); err != nil {
+			t.Fatalf("rotate %d: %v", i+1, err)
+		}
+
+		k := testKeyStore(t, b, newMaster)
+		if err := k.load(); err != nil {
+			t.Fatalf("load after rotate %d: %v", i+1, err)
+		}
+		if got := k.blobName(id, "sum"); got != name {
+			t.Errorf("blobName after rotate %d = %s, want %s", i+1, got, name)
+		}
+		got, err := decrypt(k.keys[id], name, sealed)
+		if err != nil {
+			t.Fatalf("read after rotate %d: %v", i+1, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("read after rotate %d changed the content", i+1)
+		}
+
+		if err := k.pending(pendingID); err != nil {
+			t.Fatalf("pending key after rotate %d: %v", i+1, err)
+		}
+		got, err = decrypt(k.keys[pendingID], "pending", pendingSealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("read with the pending key after rotate %d: %v", i+1, err)
+		}
+	}
+
+	if err := testKeyStore(t, b, oldMaster).load(); err == nil {
+		t.Error("load with the old master key after rotating succeeded")
+	}
+}
+
+func TestKeyStoreLoad(t *testing.T) {
+	b := newMemoryBackend()
+	master := testMasterKey(t)
+	id := uuid.NewString()
+	if err := testKeyStore(t, b, master).create(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testKeyStore(t, b, nil).load(); err == nil {
+		t.Error("load of an encrypted codebase without a master key succeeded")
+	}
+
+	// A data key moved to another codebase does not unwrap
+	data, err := readObject(b, keysPrefix+id+".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := uuid.NewString()
+	if err := writeObject(b, keysPrefix+other+".json", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := testKeyStore(t, b, master).load(); err == nil {
+		t.Errorf("load of a data key copied from %s to %s succeeded", id, other)
+	}
+}
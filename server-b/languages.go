@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Like GitHub's linguist, the language breakdown leaves out files that do
+// not say what a codebase is written in.
+const (
+	excludedVendored      = "vendored"
+	excludedGenerated     = "generated"
+	excludedDocumentation = "documentation"
+	excludedData          = "data"
+	excludedUnknown       = "unknown"
+)
+
+var (
+	vendoredPath = regexp.MustCompile(`(^|/)(vendor|node_modules|bower_components|jspm_packages|third[-_]?party|Godeps|Pods|Carthage|\.yarn)/` +
+		`|(^|/)[^/]*\.min\.(js|css)$|(^|/)jquery[^/]*\.js$`)
+	generatedPath = regexp.MustCompile(`\.pb\.(go|cc|h)$|_pb2(_grpc)?\.py$|\.(js|css)\.map$` +
+		`|(^|/)(package-lock\.json|yarn\.lock|pnpm-lock\.yaml|go\.sum|Cargo\.lock|Gemfile\.lock|composer\.lock|poetry\.lock)$`)
+	generatedHeader   = regexp.MustCompile(`(?i)code generated .*do not edit|@generated|<auto-generated|auto-?generated by|automatically generated`)
+	documentationPath = regexp.MustCompile(`(^|/)(docs?|Documentation)/`)
+)
+
+// dataLanguages describe data or prose rather than code.
+var dataLanguages = map[string]bool{
+	"INI":      true,
+	"JSON":     true,
+	"Markdown": true,
+	"TOML":     true,
+	"XML":      true,
+	"YAML":     true,
+}
+
+// generatedHeaderLines is how many lines at the start of a file are
+// searched for a generated code marker.
+const generatedHeaderLines = 5
+
+// LanguageStats is what a codebase holds in one language.
+type LanguageStats struct {
+	Language   string  `json:"language"`
+	Files      int     `json:"files"`
+	Bytes      int64   `json:"bytes"`
+	Lines      int64   `json:"lines"`
+	Percentage float64 `json:"percentage"`
+}
+
+// lineCounter counts the lines written to it, keeping the start of the
+// content to classify it.
+type lineCounter struct {
+	lines int64
+	size  int64
+	last  byte
+	head  []byte
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if room := detectHeadSize - len(c.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.head = append(c.head, p[:room]...)
+	}
+	c.lines += int64(bytes.Count(p, []byte("\n")))
+	c.size += int64(len(p))
+	c.last = p[len(p)-1]
+	return len(p), nil
+}
+
+// total counts a last line without a newline.
+func (c *lineCounter) total() int64 {
+	if c.size > 0 && c.last != '\n' {
+		return c.lines + 1
+	}
+	return c.lines
+}
+
+// getLanguages handles GET /languages/{id}?rev=n, breaking a revision of a
+// codebase, the latest by default, down by language. The codebase is only
+// locked while its tree is read, so a large codebase does not hold up
+// changes; files whose blobs are released in the meantime are left out.
+func (s *StorageServer) getLanguages(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	tree, err := s.loadRevision(codebaseID, r.URL.Query().Get("rev"))
+	lock.RUnlock()
+	if err != nil {
+		respondWithTreeError(w, err, "Codebase not found")
+		return
+	}
+
+	languages, excluded, err := s.languageBreakdown(tree)
+	if errors.Is(err, errBlobCorrupt) {
+		log.Printf("ERROR: a file of codebase %s is corrupt: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Stored file is corrupt")
+		return
+	}
+	if err != nil {
+		log.Printf("Error breaking down codebase %s by language: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to read codebase")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"directory_id": codebaseID,
+		"revision":     tree.revision(),
+		"languages":    languages,
+		"excluded":     excluded,
+	})
+}
+
+// languageBreakdown counts the files, bytes and lines of every language in
+// tree, largest first, and how many files were left out for each reason.
+func (s *StorageServer) languageBreakdown(tree *codebaseTree) ([]LanguageStats, map[string]int, error) {
+	byLanguage := make(map[string]*LanguageStats)
+	excluded := make(map[string]int)
+	var totalBytes int64
+
+	for _, p := range tree.sortedPaths() {
+		entry := tree.Files[p]
+		switch {
+		case vendoredPath.MatchString(p):
+			excluded[excludedVendored]++
+			continue
+		case generatedPath.MatchString(p):
+			excluded[excludedGenerated]++
+			continue
+		case documentationPath.MatchString(p):
+			excluded[excludedDocumentation]++
+			continue
+		case entry.MIMEType != "" && entry.Language == "":
+			excluded[excludedUnknown]++
+			continue
+		case dataLanguages[entry.Language]:
+			excluded[excludedData]++
+			continue
+		}
+
+		counter := &lineCounter{}
+		err := s.copyBlob(counter, tree.ID, entry)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Replaced since the tree was read
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		_, language := storedType(p, entry, counter.head)
+		switch {
+		case language == "":
+			excluded[excludedUnknown]++
+			continue
+		case dataLanguages[language]:
+			excluded[excludedData]++
+			continue
+		case isGenerated(counter.head):
+			excluded[excludedGenerated]++
+			continue
+		}
+
+		stats, ok := byLanguage[language]
+		if !ok {
+			stats = &LanguageStats{Language: language}
+			byLanguage[language] = stats
+		}
+		stats.Files++
+		stats.Bytes += entry.Size
+		stats.Lines += counter.total()
+		totalBytes += entry.Size
+	}
+
+	languages := []LanguageStats{}
+	for _, stats := range byLanguage {
+		if totalBytes > 0 {
+			stats.Percentage = float64(int64(float64(stats.Bytes)*10000/float64(totalBytes)+0.5)) / 100
+		}
+		languages = append(languages, *stats)
+	}
+	sort.Slice(languages, func(i, j int) bool {
+		if languages[i].Bytes != languages[j].Bytes {
+			return languages[i].Bytes > languages[j].Bytes
+		}
+		return languages[i].Language < languages[j].Language
+	})
+	return languages, excluded, nil
+}
+
+// isGenerated looks for a generated code marker at the start of a file.
+func isGenerated(head []byte) bool {
+	lines := bytes.SplitN(head, []byte("\n"), generatedHeaderLines+1)
+	if len(lines) > generatedHeaderLines {
+		lines = lines[:generatedHeaderLines]
+	}
+	for _, line := range lines {
+		if generatedHeader.Match(line) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/google/uuid"
@@ -18,15 +25,93 @@ import (
 
 const (
 	MaxUploadSize = 100 << 20
+	MaxFieldSize  = 4 << 10
 )
 
 type StorageServer struct {
-	baseStorageDir string
+	baseStorageDir string // uploads in progress
+	backend        Backend
+	blobs          *blobStore
+	keys           *keyStore
+	indexer        indexer
 }
 
 type StoreResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool         `json:"success"`
+	Message string       `json:"message"`
+	StageID string       `json:"stage_id,omitempty"`
+	Files   []FileResult `json:"files"`
+}
+
+const (
+	fileStored   = "stored"
+	fileRejected = "rejected"
+	fileIgnored  = "ignored"
+)
+
+// FileResult reports what happened to a single uploaded file.
+type FileResult struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+func storedResult(path string, size int64, sum string) FileResult {
+	return FileResult{
+		Name:   filepath.Base(path),
+		Path:   filepath.ToSlash(path),
+		Status: fileStored,
+		Size:   size,
+		SHA256: sum,
+	}
+}
+
+func rejectedResult(path string, size int64, reason string) FileResult {
+	return FileResult{
+		Name:   filepath.Base(path),
+		Path:   filepath.ToSlash(path),
+		Status: fileRejected,
+		Reason: reason,
+		Size:   size,
+	}
+}
+
+func ignoredResult(path string, size int64, reason string) FileResult {
+	return FileResult{
+		Name:   filepath.Base(path),
+		Path:   filepath.ToSlash(path),
+		Status: fileIgnored,
+		Reason: reason,
+		Size:   size,
+	}
+}
+
+// storedTotals counts the stored files of results and their bytes.
+func storedTotals(results []FileResult) (int, int64) {
+	var count int
+	var size int64
+	for _, f := range results {
+		if f.Status == fileStored {
+			count++
+			size += f.Size
+		}
+	}
+	return count, size
+}
+
+func countStatus(results []FileResult, status string) int {
+	n := 0
+	for _, f := range results {
+		if f.Status == status {
+			n++
+		}
+	}
+	return n
 }
 
 func NewStorageServer() *StorageServer {
@@ -39,116 +124,383 @@ func NewStorageServer() *StorageServer {
 		log.Fatalf("Failed to create base storage directory: %v", err)
 	}
 
+	compression, err := parseCompression(os.Getenv("STORAGE_COMPRESSION"))
+	if err != nil {
+		log.Fatalf("Invalid STORAGE_COMPRESSION: %v", err)
+	}
+
+	backend, err := newBackend(os.Getenv("STORAGE_BACKEND"), baseDir)
+	if err != nil {
+		log.Fatalf("Invalid storage backend: %v", err)
+	}
+
+	masterKey, err := readMasterKey("STORAGE_MASTER_KEY")
+	if err != nil {
+		log.Fatalf("Invalid master key: %v", err)
+	}
+	keys, err := newKeyStore(backend, masterKey)
+	if err != nil {
+		log.Fatalf("Invalid master key: %v", err)
+	}
+
 	return &StorageServer{
 		baseStorageDir: baseDir,
+		backend:        backend,
+		blobs:          newBlobStore(backend, compression, keys),
+		keys:           keys,
 	}
 }
 
+// pendingFile is an uploaded file written to a temporary name inside the
+// codebase directory until its relative path is known.
+type pendingFile struct {
+	part     int            // index among the "files" parts
+	ref      *manifestEntry // set for content copied from the blob store
+	fileName string
+	tempPath string
+	size     int64
+	sha256   string
+	rejected string
+}
+
 func (s *StorageServer) storeFiles(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
-	
-	if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
-		respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid form data")
 		return
 	}
 
-	codebaseID := r.FormValue("codebase_id")
-	if codebaseID == "" {
+	// The codebase ID must come first so files can be written as they arrive
+	part, err := reader.NextPart()
+	if err != nil || part.FormName() != "codebase_id" {
 		respondWithError(w, http.StatusBadRequest, "Codebase ID is required")
 		return
 	}
-
-	if _, err := uuid.Parse(codebaseID); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+	codebaseID, err := readFormValue(part)
+	if err != nil || codebaseID == "" {
+		respondWithError(w, http.StatusBadRequest, "Codebase ID is required")
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		respondWithError(w, http.StatusBadRequest, "No files provided")
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
 		return
 	}
 
-	storageDir := filepath.Join(s.baseStorageDir, codebaseID)
-	if err := os.MkdirAll(storageDir, 0755); err != nil {
+	// Files are staged until Server A has recorded them and commits
+	st, err := s.newStage(codebaseID)
+	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to create storage directory")
 		return
 	}
+	filesDir := s.stageFilesDir(st.ID)
 
-	var storedFiles []string
-	var totalSize int64
+	var pending []pendingFile
+	var manifest *uploadManifest
+	var excludes string
+	paths := make(map[string]string)
 
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			log.Printf("Error opening file %s: %v", fileHeader.Filename, err)
-			continue
+			s.discardStage(st.ID)
+			respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+			return
 		}
-		defer file.Close()
 
-		fileName := filepath.Base(fileHeader.Filename)
-		if fileName == "" || fileName == "." || fileName == ".." {
-			log.Printf("Invalid filename: %s", fileHeader.Filename)
-			continue
+		formName := part.FormName()
+		switch {
+		case formName == "manifest":
+			if len(pending) > 0 || manifest != nil {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "The manifest must be sent once, before any file")
+				return
+			}
+			manifest, err = readManifest(part)
+			if errors.Is(err, errInvalidManifest) {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if err != nil {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "Invalid form data")
+				return
+			}
+
+		case formName == "revision":
+			if len(pending) > 0 || manifest != nil || st.Revision != 0 {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "The revision must be sent once, before the manifest and any file")
+				return
+			}
+			value, err := readFormValue(part)
+			if err == nil {
+				st.Revision, err = strconv.Atoi(value)
+			}
+			if err != nil || st.Revision < 2 {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "Invalid revision")
+				return
+			}
+
+		case formName == "files" && part.FileName() != "":
+			pf, err := receiveFile(filesDir, part)
+			if err != nil {
+				log.Printf("Error receiving file %s: %v", part.FileName(), err)
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "File too large or invalid form data")
+				return
+			}
+			pf.part = len(pending)
+			pending = append(pending, pf)
+
+		case strings.HasPrefix(formName, "path_"):
+			value, err := readFormValue(part)
+			if err != nil {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "Invalid form data")
+				return
+			}
+			paths[strings.TrimPrefix(formName, "path_")] = value
+
+		case formName == "exclude":
+			// Server-wide exclude patterns, one per line
+			excludes, err = readFormValue(part)
+			if err != nil {
+				s.discardStage(st.ID)
+				respondWithError(w, http.StatusBadRequest, "Invalid form data")
+				return
+			}
 		}
 
-		// Get the relative path from form data - this preserves directory structure
-		relativePath := r.FormValue("path_" + fileHeader.Filename)
-		if relativePath == "" {
-			relativePath = fileName
+		part.Close()
+	}
+
+	if len(pending) == 0 && manifest == nil {
+		s.discardStage(st.ID)
+		respondWithError(w, http.StatusBadRequest, "No files provided")
+		return
+	}
+
+	var results []FileResult
+	received := len(pending)
+
+	// Content the manifest names by checksum is copied from the blob store
+	// and stored like an uploaded file
+	if manifest != nil {
+		for _, entry := range manifest.references() {
+			pf := pendingFile{part: -1, fileName: filepath.Base(entry.Path), ref: entry, sha256: entry.SHA256}
+			if !s.blobs.has(entry.SHA256, codebaseID) {
+				pf.size = entry.Size
+				pf.rejected = "content not in storage, upload it"
+			} else {
+				pf.tempPath, pf.size, err = s.blobs.checkout(filesDir, entry.SHA256, codebaseID)
+				if err != nil {
+					log.Printf("Error copying blob %s for %s: %v", entry.SHA256, entry.Path, err)
+					pf.rejected = "failed to copy stored content"
+				}
+			}
+			pending = append(pending, pf)
+		}
+	}
+
+	byPath := make(map[string]int)
+
+	for _, pf := range pending {
+		var entry *manifestEntry
+		var requestedPath string
+
+		if manifest != nil {
+			entry = pf.ref
+			if entry == nil {
+				entry = manifest.byPart[pf.part]
+			}
+			if entry == nil {
+				os.Remove(pf.tempPath)
+				results = append(results, rejectedResult(pf.fileName, pf.size, "part is not listed in the manifest"))
+				continue
+			}
+			requestedPath = entry.Path
+		} else {
+			fileName := filepath.Base(pf.fileName)
+			if fileName == "" || fileName == "." || fileName == ".." {
+				log.Printf("Invalid filename: %s", pf.fileName)
+				os.Remove(pf.tempPath)
+				results = append(results, rejectedResult(pf.fileName, pf.size, "invalid file name"))
+				continue
+			}
+
+			// Legacy form: the relative path comes from the path_<filename> field
+			requestedPath = paths[pf.fileName]
+			if requestedPath == "" {
+				requestedPath = fileName
+			}
+		}
+
+		if pf.rejected != "" {
+			results = append(results, rejectedResult(requestedPath, pf.size, pf.rejected))
+			continue
 		}
 
 		// Clean the path and ensure it's safe
-		relativePath = filepath.Clean(relativePath)
-		if strings.HasPrefix(relativePath, "..") {
-			log.Printf("Invalid path (directory traversal attempt): %s", relativePath)
+		relativePath, ok := cleanRelativePath(requestedPath)
+		if !ok {
+			log.Printf("Invalid path (directory traversal attempt): %s", requestedPath)
+			os.Remove(pf.tempPath)
+			results = append(results, rejectedResult(requestedPath, pf.size, "path escapes the codebase directory"))
 			continue
 		}
 
+		if entry != nil {
+			if reason := entry.verify(pf.size, pf.sha256); reason != "" {
+				os.Remove(pf.tempPath)
+				results = append(results, rejectedResult(relativePath, pf.size, reason))
+				continue
+			}
+		}
+
 		// Create the full path maintaining directory structure
-		fullPath := filepath.Join(storageDir, relativePath)
-		
+		fullPath := filepath.Join(filesDir, relativePath)
+
 		// Create all necessary parent directories
 		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
 			log.Printf("Error creating directory for %s: %v", fullPath, err)
+			os.Remove(pf.tempPath)
+			results = append(results, rejectedResult(relativePath, pf.size, "failed to create directory"))
 			continue
 		}
 
-		// Create and write the file
-		dst, err := os.Create(fullPath)
-		if err != nil {
-			log.Printf("Error creating file %s: %v", fullPath, err)
+		if err := os.Rename(pf.tempPath, fullPath); err != nil {
+			log.Printf("Error writing file %s: %v", fullPath, err)
+			os.Remove(pf.tempPath)
+			results = append(results, rejectedResult(relativePath, pf.size, "failed to write file"))
 			continue
 		}
-		defer dst.Close()
+		if entry != nil {
+			entry.apply(fullPath)
+		}
 
-		written, err := io.Copy(dst, file)
-		if err != nil {
-			log.Printf("Error writing file %s: %v", fullPath, err)
-			os.Remove(fullPath)
-			continue
+		// The legacy form keys paths by file name, so the last file with a
+		// given path wins and the earlier one is reported as replaced
+		if previous, ok := byPath[relativePath]; ok {
+			results[previous] = rejectedResult(relativePath, results[previous].Size, "replaced by a later file with the same path")
+		}
+		byPath[relativePath] = len(results)
+
+		results = append(results, storedResult(relativePath, pf.size, pf.sha256))
+		log.Printf("Stored file: %s (%d bytes)", relativePath, pf.size)
+	}
+
+	if manifest != nil {
+		for _, entry := range manifest.Files {
+			if entry.Part != nil && *entry.Part >= received {
+				results = append(results, rejectedResult(entry.Path, entry.Size, "part missing from upload"))
+			}
 		}
+	}
 
-		totalSize += written
-		storedFiles = append(storedFiles, relativePath)
-		log.Printf("Stored file: %s (%d bytes)", relativePath, written)
+	// Ignore files may arrive after the files they rule out, so they are
+	// applied once the whole upload is in
+	applyIgnoreRules(filesDir, results, excludes)
+	storedCount, totalSize := storedTotals(results)
+
+	if storedCount == 0 {
+		s.discardStage(st.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "No valid files were stored",
+			"files":   results,
+		})
+		return
 	}
 
-	if len(storedFiles) == 0 {
-		os.RemoveAll(storageDir)
-		respondWithError(w, http.StatusBadRequest, "No valid files were stored")
+	if err := s.recordStageFiles(st, results); err != nil {
+		log.Printf("Error recording stage %s: %v", st.ID, err)
+		s.discardStage(st.ID)
+		respondWithError(w, http.StatusInternalServerError, "Failed to stage files")
 		return
 	}
 
 	response := StoreResponse{
 		Success: true,
-		Message: fmt.Sprintf("Successfully stored %d files (%d bytes total)", len(storedFiles), totalSize),
+		Message: fmt.Sprintf("Successfully stored %d files (%d bytes total), %d rejected, %d ignored", storedCount, totalSize, countStatus(results, fileRejected), countStatus(results, fileIgnored)),
+		StageID: st.ID,
+		Files:   results,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
-	
-	log.Printf("Files stored for codebase %s: %d files, %d bytes", codebaseID, len(storedFiles), totalSize)
+
+	log.Printf("Files staged for codebase %s in stage %s: %d files, %d bytes", codebaseID, st.ID, storedCount, totalSize)
+}
+
+// receiveFile streams a file part to a temporary file in dir, hashing it on
+// the way. Failing to write locally rejects just this file; failing to read
+// the part means the request itself is broken and is returned as an error.
+func receiveFile(dir string, part *multipart.Part) (pendingFile, error) {
+	pf := pendingFile{fileName: part.FileName()}
+
+	dst, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		log.Printf("Error creating file for %s: %v", part.FileName(), err)
+		pf.rejected = "failed to create file"
+		_, err := io.Copy(io.Discard, part)
+		return pf, err
+	}
+	defer dst.Close()
+	// Temporary files are private, stored files are not
+	dst.Chmod(0644)
+
+	hasher := sha256.New()
+	buf := make([]byte, 32<<10)
+	var writeErr error
+	for {
+		n, readErr := part.Read(buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			if writeErr == nil {
+				_, writeErr = dst.Write(buf[:n])
+			}
+			pf.size += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			os.Remove(dst.Name())
+			return pf, readErr
+		}
+	}
+
+	if writeErr != nil {
+		log.Printf("Error writing file %s: %v", part.FileName(), writeErr)
+		os.Remove(dst.Name())
+		pf.rejected = "failed to write file"
+		return pf, nil
+	}
+
+	pf.tempPath = dst.Name()
+	pf.sha256 = hex.EncodeToString(hasher.Sum(nil))
+	return pf, nil
+}
+
+func readFormValue(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, MaxFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > MaxFieldSize {
+		return "", fmt.Errorf("field %s too large", part.FormName())
+	}
+	return string(value), nil
 }
 
 func (s *StorageServer) getFileContent(w http.ResponseWriter, r *http.Request) {
@@ -160,6 +512,11 @@ func (s *StorageServer) getFileContent(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
 		return
 	}
+
+	// Keep the codebase from being changed or deleted while it is read
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	defer lock.RUnlock()
 	
 	if filePath == "" {
 		respondWithError(w, http.StatusBadRequest, "File path is required")
@@ -173,44 +530,47 @@ func (s *StorageServer) getFileContent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Build the full path
-	baseDir := filepath.Join(s.baseStorageDir, codebaseID)
-	fullPath := filepath.Join(baseDir, cleanPath)
-	
-	// Ensure the path is within the base directory
-	if !strings.HasPrefix(fullPath, baseDir) {
-		respondWithError(w, http.StatusBadRequest, "Invalid file path")
+	tree, err := s.loadRevision(codebaseID, r.URL.Query().Get("rev"))
+	if err != nil {
+		respondWithTreeError(w, err, "File not found")
 		return
 	}
-	
-	// Check if file exists
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
-		respondWithError(w, http.StatusNotFound, "File not found")
+
+	entry, ok := tree.lookup(cleanPath)
+	if !ok && tree.isDir(cleanPath) {
+		respondWithError(w, http.StatusBadRequest, "Cannot read directory as file")
 		return
 	}
-	
-	if fileInfo.IsDir() {
-		respondWithError(w, http.StatusBadRequest, "Cannot read directory as file")
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "File not found")
 		return
 	}
-	
+
 	// Read file content
-	content, err := os.ReadFile(fullPath)
+	content, err := s.readBlob(codebaseID, entry)
+	if errors.Is(err, errBlobCorrupt) {
+		log.Printf("ERROR: file %s of codebase %s is corrupt: %v", cleanPath, codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Stored file is corrupt")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to read file")
 		return
 	}
 	
-	// Determine if file is text or binary
-	isText := isTextFile(content)
+	mimeType, language := storedType(filepath.ToSlash(cleanPath), entry, content)
+	isText := isTextContent(mimeType, content)
 	
 	response := map[string]interface{}{
 		"success":   true,
 		"file_path": cleanPath,
-		"size":      fileInfo.Size(),
+		"size":      entry.Size,
 		"is_text":   isText,
-		"modified":  fileInfo.ModTime(),
+		"mime_type": mimeType,
+		"modified":  entry.MTime,
+	}
+	if language != "" {
+		response["language"] = language
 	}
 	
 	if isText {
@@ -233,6 +593,11 @@ func (s *StorageServer) downloadFile(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
 		return
 	}
+
+	// Keep the codebase from being changed or deleted while it is read
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	defer lock.RUnlock()
 	
 	if filePath == "" {
 		respondWithError(w, http.StatusBadRequest, "File path is required")
@@ -246,30 +611,38 @@ func (s *StorageServer) downloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Build the full path
-	baseDir := filepath.Join(s.baseStorageDir, codebaseID)
-	fullPath := filepath.Join(baseDir, cleanPath)
-	
-	// Ensure the path is within the base directory
-	if !strings.HasPrefix(fullPath, baseDir) {
-		respondWithError(w, http.StatusBadRequest, "Invalid file path")
+	tree, err := s.loadRevision(codebaseID, r.URL.Query().Get("rev"))
+	if err != nil {
+		respondWithTreeError(w, err, "File not found")
 		return
 	}
-	
-	// Check if file exists
-	fileInfo, err := os.Stat(fullPath)
-	if os.IsNotExist(err) {
+
+	entry, ok := tree.lookup(cleanPath)
+	if !ok && tree.isDir(cleanPath) {
+		respondWithError(w, http.StatusBadRequest, "Cannot download directory")
+		return
+	}
+	if !ok {
 		respondWithError(w, http.StatusNotFound, "File not found")
 		return
 	}
-	
-	if fileInfo.IsDir() {
-		respondWithError(w, http.StatusBadRequest, "Cannot download directory")
+
+	// The checksum identifies the content, so it doubles as the ETag
+	etag := fmt.Sprintf("\"%s\"", entry.SHA256)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Digest", "sha-256="+digestValue(entry.SHA256))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	
+
 	// Open file for reading
-	file, err := os.Open(fullPath)
+	file, err := s.openBlob(codebaseID, entry)
+	if errors.Is(err, errBlobCorrupt) {
+		log.Printf("ERROR: file %s of codebase %s is corrupt: %v", cleanPath, codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Stored file is corrupt")
+		return
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to open file")
 		return
@@ -280,12 +653,18 @@ func (s *StorageServer) downloadFile(w http.ResponseWriter, r *http.Request) {
 	filename := filepath.Base(cleanPath)
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", entry.Size))
 	
-	// Stream file content
+	// Stream file content, verifying it on the way
 	_, err = io.Copy(w, file)
+	if errors.Is(err, errBlobCorrupt) {
+		// The body is already on its way, so the only way to tell the
+		// client is to break the connection
+		log.Printf("ERROR: file %s of codebase %s is corrupt: %v", cleanPath, codebaseID, err)
+		panic(http.ErrAbortHandler)
+	}
 	if err != nil {
-		log.Printf("Error streaming file %s: %v", fullPath, err)
+		log.Printf("Error streaming file %s of codebase %s: %v", cleanPath, codebaseID, err)
 		return
 	}
 	
@@ -300,22 +679,32 @@ func (s *StorageServer) downloadZip(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
 		return
 	}
+
+	// Keep the codebase from being changed or deleted while it is read
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	defer lock.RUnlock()
 	
-	storageDir := filepath.Join(s.baseStorageDir, codebaseID)
-	
-	// Check if codebase directory exists
-	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
-		respondWithError(w, http.StatusNotFound, "Codebase not found")
+	tree, err := s.loadRevision(codebaseID, r.URL.Query().Get("rev"))
+	if err != nil {
+		respondWithTreeError(w, err, "Codebase not found")
 		return
 	}
 	
 	// Set headers for ZIP download
 	filename := fmt.Sprintf("codebase-%s.zip", codebaseID)
+	if r.URL.Query().Get("rev") != "" {
+		filename = fmt.Sprintf("codebase-%s-r%d.zip", codebaseID, tree.revision())
+	}
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 	
 	// Create ZIP archive and stream it
-	err := createZipArchive(w, storageDir)
+	err = s.createZipArchive(w, tree)
+	if errors.Is(err, errBlobCorrupt) {
+		log.Printf("ERROR: ZIP of codebase %s aborted, a stored file is corrupt: %v", codebaseID, err)
+		panic(http.ErrAbortHandler)
+	}
 	if err != nil {
 		log.Printf("Error creating ZIP for codebase %s: %v", codebaseID, err)
 		return
@@ -324,51 +713,68 @@ func (s *StorageServer) downloadZip(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Downloaded ZIP archive for codebase: %s", codebaseID)
 }
 
-func createZipArchive(w io.Writer, sourceDir string) error {
+// createZipArchive writes the files of tree to w as a ZIP archive, with an
+// entry for every directory as well.
+func (s *StorageServer) createZipArchive(w io.Writer, tree *codebaseTree) error {
 	zipWriter := zip.NewWriter(w)
 	defer zipWriter.Close()
-	
-	return filepath.WalkDir(sourceDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		
-		// Get relative path from source directory
-		relativePath, err := filepath.Rel(sourceDir, path)
-		if err != nil {
-			return err
-		}
-		
-		// Skip the root directory itself
-		if relativePath == "." {
-			return nil
-		}
-		
-		// Convert to forward slashes for ZIP compatibility
-		relativePath = strings.ReplaceAll(relativePath, "\\", "/")
-		
-		if d.IsDir() {
-			// Create directory entry in ZIP
-			_, err := zipWriter.Create(relativePath + "/")
-			return err
+
+	dirs := make(map[string]bool)
+	for _, relativePath := range tree.sortedPaths() {
+		// Create directory entries in ZIP
+		for i, c := range relativePath {
+			if c != '/' || dirs[relativePath[:i]] {
+				continue
+			}
+			dirs[relativePath[:i]] = true
+			if _, err := zipWriter.Create(relativePath[:i+1]); err != nil {
+				return err
+			}
 		}
-		
+
 		// Create file entry in ZIP
 		zipFile, err := zipWriter.Create(relativePath)
 		if err != nil {
 			return err
 		}
-		
+
 		// Copy file content to ZIP
-		sourceFile, err := os.Open(path)
-		if err != nil {
-			return err
+		if err := s.copyBlob(zipFile, tree.ID, tree.Files[relativePath]); err != nil {
+			return fmt.Errorf("%s: %w", relativePath, err)
 		}
-		defer sourceFile.Close()
-		
-		_, err = io.Copy(zipFile, sourceFile)
+	}
+	return nil
+}
+
+func (s *StorageServer) copyBlob(dst io.Writer, codebaseID string, entry treeEntry) error {
+	src, err := s.openBlob(codebaseID, entry)
+	if err != nil {
 		return err
-	})
+	}
+	defer src.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (s *StorageServer) readBlob(codebaseID string, entry treeEntry) ([]byte, error) {
+	src, err := s.openBlob(codebaseID, entry)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	return io.ReadAll(src)
+}
+
+// digestValue converts a hex SHA-256 to the base64 form used by the Digest
+// header.
+func digestValue(sum string) string {
+	raw, err := hex.DecodeString(sum)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
 }
 
 func isTextFile(content []byte) bool {
@@ -415,6 +821,20 @@ func isTextFile(content []byte) bool {
 	return true
 }
 
+// cleanRelativePath normalises a client supplied path and reports whether
+// it stays inside the directory it is joined to.
+func cleanRelativePath(path string) (string, bool) {
+	if path == "" || filepath.IsAbs(path) {
+		return "", false
+	}
+
+	cleanPath := filepath.Clean(path)
+	if cleanPath == "." || cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return cleanPath, true
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -426,14 +846,102 @@ func respondWithError(w http.ResponseWriter, code int, message string) {
 
 func main() {
 	server := NewStorageServer()
+
+	stageTimeout := time.Hour
+	if value := os.Getenv("STAGE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("Invalid STAGE_TIMEOUT %q", value)
+		}
+		stageTimeout = timeout
+	}
+
+	sessionTTL := 24 * time.Hour
+	if value := os.Getenv("SESSION_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid SESSION_TTL %q", value)
+		}
+		sessionTTL = ttl
+	}
+
+	// Maintenance commands run instead of the server
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	if command == "rotate-master-key" {
+		oldKey, err := readMasterKey("STORAGE_OLD_MASTER_KEY")
+		if err != nil || oldKey == nil {
+			log.Fatalf("Invalid or missing old master key: %v", err)
+		}
+		if err := server.keys.rotateMasterKey(oldKey); err != nil {
+			log.Fatalf("Failed to rotate master key: %v", err)
+		}
+		return
+	}
+
+	if err := server.keys.load(); err != nil {
+		log.Fatalf("Failed to load data keys: %v", err)
+	}
+	if err := server.migrateCodebaseDirs(); err != nil {
+		log.Fatalf("Failed to migrate codebases into the blob store: %v", err)
+	}
+	switch command {
+	case "migrate-compression":
+		if err := server.migrateCompression(); err != nil {
+			log.Fatalf("Failed to migrate blob compression: %v", err)
+		}
+		return
+	case "encrypt-codebases":
+		if err := server.encryptCodebases(); err != nil {
+			log.Fatalf("Failed to encrypt codebases: %v", err)
+		}
+		return
+	}
+	if err := server.loadBlobRefs(); err != nil {
+		log.Fatalf("Failed to load codebase trees: %v", err)
+	}
+	server.recoverStages()
+	server.sweepBlobs()
+	go server.reapStages(stageTimeout)
+	go server.reapSessions(sessionTTL)
 	
 	r := mux.NewRouter()
 	
 	// Storage routes
 	r.HandleFunc("/store", server.storeFiles).Methods("POST")
+	r.HandleFunc("/blobs/check", server.checkBlobs).Methods("POST")
+	r.HandleFunc("/extract", server.extractArchive).Methods("POST")
 	r.HandleFunc("/content/{id}", server.getFileContent).Methods("GET")
 	r.HandleFunc("/download/{id}", server.downloadFile).Methods("GET")
 	r.HandleFunc("/zip/{id}", server.downloadZip).Methods("GET")
+	r.HandleFunc("/diff/{id}", server.getDiff).Methods("GET")
+	r.HandleFunc("/languages/{id}", server.getLanguages).Methods("GET")
+	r.HandleFunc("/search/{id}", server.searchCodebase).Methods("GET")
+	r.HandleFunc("/grep/{id}", server.grepCodebase).Methods("GET")
+
+	// Resumable upload sessions
+	r.HandleFunc("/sessions/{id}", server.createSession).Methods("POST")
+	r.HandleFunc("/sessions/{id}", server.getSession).Methods("GET")
+	r.HandleFunc("/sessions/{id}", server.deleteSession).Methods("DELETE")
+	r.HandleFunc("/sessions/{id}/chunk", server.writeChunk).Methods("PUT")
+	r.HandleFunc("/sessions/{id}/stage", server.stageSession).Methods("POST")
+
+	// Maintenance
+	r.HandleFunc("/inventory", server.getInventory).Methods("GET")
+	r.HandleFunc("/stats", server.getStats).Methods("GET")
+	r.HandleFunc("/codebase/{id}", server.deleteCodebase).Methods("DELETE")
+
+	// Moving codebases between storage nodes
+	r.HandleFunc("/export/{id}", server.exportCodebase).Methods("GET")
+	r.HandleFunc("/import/{id}", server.importCodebase).Methods("POST")
+
+	// Two-phase commit of staged files
+	r.HandleFunc("/stages", server.createStage).Methods("POST")
+	r.HandleFunc("/stages", server.listStages).Methods("GET")
+	r.HandleFunc("/stages/{id}/commit", server.commitStage).Methods("POST")
+	r.HandleFunc("/stages/{id}", server.abortStage).Methods("DELETE")
 	
 	// Health check
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ManifestVersion is the upload format described by a manifest field.
+	// Version 1 is the legacy form with one path_<filename> field per file.
+	ManifestVersion = 2
+	MaxManifestSize = 8 << 20
+)
+
+var errInvalidManifest = errors.New("invalid manifest")
+
+// uploadManifest describes every file part of an upload by its index among
+// the "files" parts, so paths no longer depend on client file names. An
+// entry without a part names content storage already has by its SHA-256
+// instead of uploading it again.
+type uploadManifest struct {
+	Version int             `json:"version"`
+	Files   []manifestEntry `json:"files"`
+
+	byPart map[int]*manifestEntry
+}
+
+type manifestEntry struct {
+	Part   *int       `json:"part,omitempty"`
+	Path   string     `json:"path"`
+	Size   int64      `json:"size"`
+	SHA256 string     `json:"sha256,omitempty"`
+	Mode   uint32     `json:"mode,omitempty"`
+	MTime  *time.Time `json:"mtime,omitempty"`
+}
+
+// readManifest parses and validates the manifest field. Entry paths are
+// checked per file when the parts are stored, but part indexes and paths
+// must be unique.
+func readManifest(part *multipart.Part) (*uploadManifest, error) {
+	data, err := io.ReadAll(io.LimitReader(part, MaxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxManifestSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", errInvalidManifest, MaxManifestSize)
+	}
+
+	var m uploadManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidManifest, err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidManifest, m.Version)
+	}
+
+	m.byPart = make(map[int]*manifestEntry, len(m.Files))
+	paths := make(map[string]bool, len(m.Files))
+	for i := range m.Files {
+		entry := &m.Files[i]
+		entry.SHA256 = strings.ToLower(entry.SHA256)
+		if entry.Size < 0 || (entry.Part != nil && *entry.Part < 0) {
+			return nil, fmt.Errorf("%w: entry %d is malformed", errInvalidManifest, i)
+		}
+		if entry.Part == nil && !validSum(entry.SHA256) {
+			return nil, fmt.Errorf("%w: entry %d needs a part or a sha256", errInvalidManifest, i)
+		}
+		if entry.Part != nil {
+			if _, ok := m.byPart[*entry.Part]; ok {
+				return nil, fmt.Errorf("%w: part %d is listed twice", errInvalidManifest, *entry.Part)
+			}
+		}
+		if clean, ok := cleanRelativePath(entry.Path); ok {
+			if paths[clean] {
+				return nil, fmt.Errorf("%w: path %s is listed twice", errInvalidManifest, entry.Path)
+			}
+			paths[clean] = true
+		}
+		if entry.Part != nil {
+			m.byPart[*entry.Part] = entry
+		}
+	}
+	return &m, nil
+}
+
+// references returns the entries that refer to stored content rather than
+// to a part of the upload.
+func (m *uploadManifest) references() []*manifestEntry {
+	var refs []*manifestEntry
+	for i := range m.Files {
+		if m.Files[i].Part == nil {
+			refs = append(refs, &m.Files[i])
+		}
+	}
+	return refs
+}
+
+// verify compares a received file with what the manifest declared and
+// returns the reason for rejecting it, if any.
+func (e *manifestEntry) verify(size int64, sum string) string {
+	if size != e.Size {
+		return fmt.Sprintf("size mismatch: manifest declares %d bytes, received %d", e.Size, size)
+	}
+	if e.SHA256 != "" && e.SHA256 != sum {
+		return "checksum mismatch"
+	}
+	return ""
+}
+
+// apply sets the permission bits and modification time the manifest
+// declares. The owner always keeps read and write access so storage can
+// serve and replace the file.
+func (e *manifestEntry) apply(path string) {
+	if e.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(e.Mode).Perm()|0600); err != nil {
+			log.Printf("Error setting mode of %s: %v", path, err)
+		}
+	}
+	if e.MTime != nil {
+		if err := os.Chtimes(path, *e.MTime, *e.MTime); err != nil {
+			log.Printf("Error setting mtime of %s: %v", path, err)
+		}
+	}
+}
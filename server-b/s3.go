@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Backend keeps objects in a bucket of an S3 compatible service such as
+// MinIO, addressed path style and signed with AWS Signature Version 4.
+// Objects are limited to the 5 GiB of a single PUT.
+type s3Backend struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	prefix    string // prepended to every key
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3BackendFromEnv configures an S3 backend from S3_ENDPOINT, S3_BUCKET,
+// S3_REGION, S3_PREFIX, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY. Without
+// credentials requests are sent unsigned.
+func newS3BackendFromEnv() (*s3Backend, error) {
+	endpoint, err := url.Parse(os.Getenv("S3_ENDPOINT"))
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("S3_ENDPOINT must be a URL such as http://localhost:9000")
+	}
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET is required")
+	}
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3Backend{
+		endpoint:  endpoint,
+		bucket:    bucket,
+		region:    region,
+		prefix:    os.Getenv("S3_PREFIX"),
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		client:    newHTTPClient(time.Minute),
+	}, nil
+}
+
+func (b *s3Backend) Put(key string, r io.Reader, size int64) error {
+	if size == 0 {
+		r = http.NoBody
+	}
+	resp, err := b.do(http.MethodPut, key, nil, r, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *s3Backend) Get(key string) (io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *s3Backend) Stat(key string) (ObjectInfo, error) {
+	resp, err := b.do(http.MethodHead, key, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (b *s3Backend) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := b.list(prefix, "/", func(info ObjectInfo) error {
+		objects = append(objects, info)
+		return nil
+	})
+	return objects, err
+}
+
+func (b *s3Backend) Delete(key string) error {
+	resp, err := b.do(http.MethodDelete, key, nil, nil, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (b *s3Backend) Walk(prefix string, fn func(ObjectInfo) error) error {
+	return b.list(prefix, "", fn)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list pages through ListObjectsV2. Keys are returned in order, and each
+// page is passed to fn before the next is requested.
+func (b *s3Backend) list(prefix, delimiter string, fn func(ObjectInfo) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {b.prefix + prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := b.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+
+		var objects []ObjectInfo
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(c.Key, b.prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		for _, object := range objects {
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for an object, or for the bucket if key is
+// empty. A missing object is reported as an os.IsNotExist error and any
+// other failure status as an error carrying S3's error code.
+func (b *s3Backend) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.bucket
+	if key != "" {
+		u.Path += "/" + b.prefix + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	b.sign(req, time.Now().UTC())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, notFound(strings.ToLower(method), key)
+	}
+	var s3err s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3err)
+	if s3err.Code == "" {
+		s3err.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, s3err.Code, s3err.Message)
+}
+
+// sign adds an AWS Signature Version 4 authorization header. The payload
+// is left unsigned so bodies can be streamed.
+func (b *s3Backend) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payload)
+	if b.accessKey == "" {
+		return
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payload + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters, as
+// Signature Version 4 requires.
+func s3Escape(s string) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return sb.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes a query sorted by name, as signing requires.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
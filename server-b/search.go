@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxSearchQueryLength = 256
+	defaultSearchResults = 100
+	maxSearchResults     = 1000
+	defaultSearchContext = 2
+	maxSearchContext     = 10
+	// maxSnippetLength cuts long lines, such as those of minified code,
+	// in search results.
+	maxSnippetLength = 500
+)
+
+// SearchResult lists the matching lines of one file.
+type SearchResult struct {
+	Path     string        `json:"path"`
+	Language string        `json:"language,omitempty"`
+	Matches  []SearchMatch `json:"matches"`
+}
+
+// SearchMatch is a matching line with the lines around it.
+type SearchMatch struct {
+	Line   int      `json:"line"`
+	Column int      `json:"column"` // of the first match, in bytes from 1
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// searchQuery finds the files holding every term of a query, and the lines
+// of those files holding any. Terms are separated by spaces; a phrase in
+// double quotes is one term.
+type searchQuery struct {
+	terms         []string
+	caseSensitive bool
+	each          []*regexp.Regexp
+	any           *regexp.Regexp
+}
+
+func parseSearchQuery(q string, caseSensitive bool) *searchQuery {
+	query := &searchQuery{terms: splitSearchTerms(q), caseSensitive: caseSensitive}
+	if len(query.terms) == 0 {
+		return query
+	}
+
+	flags := "(?i)"
+	if caseSensitive {
+		flags = ""
+	}
+	quoted := make([]string, len(query.terms))
+	for i, term := range query.terms {
+		quoted[i] = regexp.QuoteMeta(term)
+		query.each = append(query.each, regexp.MustCompile(flags+quoted[i]))
+	}
+	query.any = regexp.MustCompile(flags + strings.Join(quoted, "|"))
+	return query
+}
+
+func splitSearchTerms(q string) []string {
+	var terms []string
+	for len(q) > 0 {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if q == "" {
+			break
+		}
+		var term string
+		if q[0] == '"' {
+			if end := strings.IndexByte(q[1:], '"'); end >= 0 {
+				term, q = q[1:end+1], q[end+2:]
+			} else {
+				term, q = q[1:], ""
+			}
+		} else if end := strings.IndexFunc(q, unicode.IsSpace); end >= 0 {
+			term, q = q[:end], q[end:]
+		} else {
+			term, q = q, ""
+		}
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// trigrams returns the trigrams a file must hold to match. Without case,
+// a trigram holding a letter that folds to one outside ASCII, like k to
+// the Kelvin sign or s to the long s, says nothing about the file, as the
+// index only lowercases ASCII.
+func (q *searchQuery) trigrams() []uint32 {
+	seen := make(map[uint32]bool)
+	var trigrams []uint32
+	for _, term := range q.terms {
+		for i := 0; i+3 <= len(term); i++ {
+			p := []byte(term[i : i+3])
+			if !q.caseSensitive && (foldsBeyondASCII(p[0]) || foldsBeyondASCII(p[1]) || foldsBeyondASCII(p[2])) {
+				continue
+			}
+			if t := trigram(p); !seen[t] {
+				seen[t] = true
+				trigrams = append(trigrams, t)
+			}
+		}
+	}
+	return trigrams
+}
+
+func foldsBeyondASCII(c byte) bool {
+	c = lowerASCII(c)
+	return c >= 0x80 || c == 'k' || c == 's'
+}
+
+// match returns the lines of content holding any term, with up to
+// contextLines lines around each, or nil unless content holds every term.
+func (q *searchQuery) match(content []byte, contextLines, limit int) []SearchMatch {
+	for _, re := range q.each {
+		if !re.Match(content) {
+			return nil
+		}
+	}
+
+	lines := searchLines(content)
+	var matches []SearchMatch
+	for i, line := range lines {
+		if len(matches) == limit {
+			break
+		}
+		loc := q.any.FindIndex(line)
+		if loc == nil {
+			continue
+		}
+		matches = append(matches, SearchMatch{
+			Line:   i + 1,
+			Column: loc[0] + 1,
+			Text:   snippet(line),
+			Before: snippets(lines[max(0, i-contextLines):i]),
+			After:  snippets(lines[i+1 : min(len(lines), i+1+contextLines)]),
+		})
+	}
+	return matches
+}
+
+func searchLines(content []byte) [][]byte {
+	lines := bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+	return lines
+}
+
+func snippet(line []byte) string {
+	if len(line) > maxSnippetLength {
+		line = trimPartialRune(line[:maxSnippetLength])
+	}
+	return string(line)
+}
+
+func snippets(lines [][]byte) []string {
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = snippet(line)
+	}
+	return texts
+}
+
+// pathFilter selects files by .gitignore style globs: those matching one
+// of include, if any, and none of exclude.
+type pathFilter struct {
+	include, exclude *ignoreMatcher
+}
+
+func newPathFilter(include, exclude []string) *pathFilter {
+	f := &pathFilter{}
+	if len(include) > 0 {
+		f.include = &ignoreMatcher{excludes: parseIgnoreRules(strings.Join(include, "\n"), "include")}
+	}
+	if len(exclude) > 0 {
+		f.exclude = &ignoreMatcher{excludes: parseIgnoreRules(strings.Join(exclude, "\n"), "exclude")}
+	}
+	return f
+}
+
+func (f *pathFilter) allows(p string) bool {
+	if f.include != nil && f.include.ignored(p) == "" {
+		return false
+	}
+	return f.exclude == nil || f.exclude.ignored(p) == ""
+}
+
+// globPatterns collects the comma separated globs of repeated query
+// parameters.
+func globPatterns(values []string) []string {
+	var patterns []string
+	for _, value := range values {
+		for _, pattern := range strings.Split(value, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
+}
+
+// boundedInt parses an optional integer query parameter.
+func boundedInt(value string, def, lo, hi int) (int, bool) {
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < lo || n > hi {
+		return 0, false
+	}
+	return n, true
+}
+
+// searchCodebase handles GET /search/{id}?q=..., listing the text files of
+// a revision of a codebase, the latest by default, that hold every term of
+// q, with their matching lines. path filters files by glob, language by
+// language, and case_sensitive=true matches case. context sets how many
+// lines are shown around matches and limit how many matching lines are
+// returned; truncated is set when more matched than that.
+//
+// As with grep, the codebase is only locked while its tree is read, and
+// files a commit replaces meanwhile are skipped.
+func (s *StorageServer) searchCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	params := r.URL.Query()
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	q := params.Get("q")
+	if len(q) > maxSearchQueryLength {
+		respondWithError(w, http.StatusBadRequest, "Query is too long")
+		return
+	}
+	caseSensitive := false
+	if value := params.Get("case_sensitive"); value != "" {
+		var err error
+		if caseSensitive, err = strconv.ParseBool(value); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid case_sensitive")
+			return
+		}
+	}
+	query := parseSearchQuery(q, caseSensitive)
+	if len(query.terms) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Query is empty")
+		return
+	}
+	contextLines, ok := boundedInt(params.Get("context"), defaultSearchContext, 0, maxSearchContext)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid context")
+		return
+	}
+	limit, ok := boundedInt(params.Get("limit"), defaultSearchResults, 1, maxSearchResults)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid limit")
+		return
+	}
+	filter := newPathFilter(globPatterns(params["path"]), nil)
+	language := params.Get("language")
+
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	tree, err := s.loadRevision(codebaseID, params.Get("rev"))
+	lock.RUnlock()
+	if err != nil {
+		respondWithTreeError(w, err, "Codebase not found")
+		return
+	}
+
+	idx, err := s.loadIndex(codebaseID, tree.revision())
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading index of codebase %s: %v", codebaseID, err)
+	}
+	candidates, missed := idx.candidates(tree, query.trigrams())
+	if missed && params.Get("rev") == "" {
+		s.updateIndex(codebaseID)
+	}
+
+	results := []SearchResult{}
+	found := 0
+	truncated := false
+	for _, p := range tree.sortedPaths() {
+		entry := tree.Files[p]
+		if truncated {
+			break
+		}
+		if !candidates[p] || !filter.allows(p) {
+			continue
+		}
+		if language != "" && entry.MIMEType != "" && !strings.EqualFold(entry.Language, language) {
+			continue
+		}
+
+		content, err := s.searchableContent(codebaseID, p, entry)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Replaced by a commit since the tree was read
+			continue
+		}
+		if errors.Is(err, errBlobCorrupt) {
+			log.Printf("ERROR: file %s of codebase %s is corrupt: %v", p, codebaseID, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error searching file %s of codebase %s: %v", p, codebaseID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to read codebase")
+			return
+		}
+		if content == nil {
+			continue
+		}
+		_, fileLanguage := storedType(p, entry, content)
+		if language != "" && !strings.EqualFold(fileLanguage, language) {
+			continue
+		}
+
+		// One line past the limit tells whether results were cut short
+		matches := query.match(content, contextLines, limit-found+1)
+		if len(matches) > limit-found {
+			matches = matches[:limit-found]
+			truncated = true
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		found += len(matches)
+		results = append(results, SearchResult{Path: p, Language: fileLanguage, Matches: matches})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":      true,
+		"directory_id": codebaseID,
+		"revision":     tree.revision(),
+		"query":        q,
+		"results":      results,
+		"matches":      found,
+		"truncated":    truncated,
+	})
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	MaxSessionSize = 10 << 30 // 10GB
+	MaxChunkSize   = 16 << 20 // 16MB
+)
+
+// uploadSession is the persisted state of a resumable upload. File bodies
+// are written under the session's data directory, which becomes a stage for
+// the codebase once every file is complete. The session itself is kept
+// until that stage is committed; if the stage is aborted instead, the data
+// directory is moved back, so the session can be finalized again.
+type uploadSession struct {
+	ID        string         `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Files     []*sessionFile `json:"files"`
+	Stage     string         `json:"stage,omitempty"` // the stage holding the files while being finalized
+}
+
+type sessionFile struct {
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	Received [][2]int64 `json:"received"`
+	Complete bool       `json:"complete"`
+}
+
+type createSessionRequest struct {
+	Files []struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	} `json:"files"`
+}
+
+type stageSessionRequest struct {
+	CodebaseID string `json:"codebase_id"`
+	Exclude    string `json:"exclude,omitempty"` // server-wide exclude patterns, one per line
+}
+
+// idLocks serialises operations on a single upload session or stage.
+var idLocks sync.Map
+
+func lockID(id string) func() {
+	value, _ := idLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (s *StorageServer) sessionDir(id string) string {
+	return filepath.Join(s.baseStorageDir, ".sessions", id)
+}
+
+func (s *StorageServer) loadSession(id string) (*uploadSession, error) {
+	data, err := os.ReadFile(filepath.Join(s.sessionDir(id), "session.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var session uploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *StorageServer) saveSession(session *uploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated state file
+	statePath := filepath.Join(s.sessionDir(session.ID), "session.json")
+	if err := os.WriteFile(statePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+func (session *uploadSession) file(path string) *sessionFile {
+	for _, f := range session.Files {
+		if f.Path == path {
+			return f
+		}
+	}
+	return nil
+}
+
+// addRange records [start, end) as received, merging overlapping and
+// adjacent ranges.
+func (f *sessionFile) addRange(start, end int64) {
+	if end <= start {
+		return
+	}
+
+	ranges := append(f.Received, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	merged := ranges[:1]
+	for _, rg := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if rg[0] <= last[1] {
+			if rg[1] > last[1] {
+				last[1] = rg[1]
+			}
+			continue
+		}
+		merged = append(merged, rg)
+	}
+
+	f.Received = merged
+	f.Complete = len(merged) == 1 && merged[0][0] == 0 && merged[0][1] == f.Size
+}
+
+// contiguousOffset returns the end of the received range starting at zero,
+// i.e. the offset from which a sequential client should resume.
+func (f *sessionFile) contiguousOffset() int64 {
+	if len(f.Received) > 0 && f.Received[0][0] == 0 {
+		return f.Received[0][1]
+	}
+	return 0
+}
+
+func (s *StorageServer) createSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	var req createSessionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxUploadSize)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session request")
+		return
+	}
+
+	if len(req.Files) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No files provided")
+		return
+	}
+
+	session := &uploadSession{
+		ID:        sessionID,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var totalSize int64
+	for _, f := range req.Files {
+		relativePath, ok := cleanRelativePath(f.Path)
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid file path: %s", f.Path))
+			return
+		}
+		if f.Size < 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid size for %s", f.Path))
+			return
+		}
+		if session.file(relativePath) != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Duplicate file path: %s", f.Path))
+			return
+		}
+
+		totalSize += f.Size
+		session.Files = append(session.Files, &sessionFile{
+			Path:     relativePath,
+			Size:     f.Size,
+			Received: [][2]int64{},
+			Complete: f.Size == 0,
+		})
+	}
+
+	if totalSize > MaxSessionSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload session too large")
+		return
+	}
+
+	unlock := lockID(sessionID)
+	defer unlock()
+
+	dataDir := filepath.Join(s.sessionDir(sessionID), "data")
+	if _, err := os.Stat(s.sessionDir(sessionID)); err == nil {
+		respondWithError(w, http.StatusConflict, "Session already exists")
+		return
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create session directory")
+		return
+	}
+
+	if err := s.saveSession(session); err != nil {
+		os.RemoveAll(s.sessionDir(sessionID))
+		respondWithError(w, http.StatusInternalServerError, "Failed to save session")
+		return
+	}
+
+	log.Printf("Created upload session %s: %d files, %d bytes", sessionID, len(session.Files), totalSize)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"session": session,
+	})
+}
+
+func (s *StorageServer) getSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	unlock := lockID(sessionID)
+	session, err := s.loadSession(sessionID)
+	unlock()
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"session": session,
+	})
+}
+
+func (s *StorageServer) writeChunk(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	relativePath, ok := cleanRelativePath(r.URL.Query().Get("file"))
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid file path")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid offset")
+		return
+	}
+
+	unlock := lockID(sessionID)
+	defer unlock()
+
+	session, err := s.loadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if session.Stage != "" {
+		respondWithError(w, http.StatusConflict, "Session is being finalized")
+		return
+	}
+
+	file := session.file(relativePath)
+	if file == nil {
+		respondWithError(w, http.StatusNotFound, "File not part of session")
+		return
+	}
+
+	if offset > file.Size || r.ContentLength > file.Size-offset {
+		respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Chunk exceeds declared file size")
+		return
+	}
+
+	dataPath := filepath.Join(s.sessionDir(sessionID), "data", relativePath)
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create staging directory")
+		return
+	}
+
+	dst, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to open staging file")
+		return
+	}
+
+	// Never accept more than the chunk limit or the bytes left in the file
+	limit := file.Size - offset
+	if limit > MaxChunkSize {
+		limit = MaxChunkSize
+	}
+	written, copyErr := io.Copy(io.NewOffsetWriter(dst, offset), io.LimitReader(r.Body, limit))
+	if err := dst.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	// Record whatever made it to disk so an interrupted chunk still counts
+	file.addRange(offset, offset+written)
+	if err := s.saveSession(session); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save session")
+		return
+	}
+
+	if copyErr != nil {
+		log.Printf("Chunk for %s in session %s interrupted after %d bytes: %v", relativePath, sessionID, written, copyErr)
+		respondWithError(w, http.StatusBadRequest, "Chunk upload interrupted")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(file.contiguousOffset(), 10))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"file":    file,
+	})
+}
+
+// stageSession turns a complete session into a stage for the given codebase.
+// The session's data directory becomes the stage's files directory, so no
+// file body is copied. Until the stage is committed or aborted the session
+// accepts no more chunks and cannot be staged again.
+func (s *StorageServer) stageSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	var req stageSessionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxFieldSize)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid stage request")
+		return
+	}
+	if _, err := uuid.Parse(req.CodebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	unlock := lockID(sessionID)
+	defer unlock()
+
+	session, err := s.loadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+
+	if session.Stage != "" {
+		respondWithError(w, http.StatusConflict, "Session is already being finalized")
+		return
+	}
+	for _, f := range session.Files {
+		if !f.Complete {
+			respondWithError(w, http.StatusConflict, fmt.Sprintf("File %s is incomplete", f.Path))
+			return
+		}
+	}
+
+	dataDir := filepath.Join(s.sessionDir(sessionID), "data")
+	var results []FileResult
+
+	for _, f := range session.Files {
+		dataPath := filepath.Join(dataDir, f.Path)
+
+		// Empty files never receive a chunk
+		if f.Size == 0 {
+			if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err == nil {
+				err = os.WriteFile(dataPath, nil, 0644)
+			}
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Failed to create empty file")
+				return
+			}
+		}
+
+		sum, err := hashFile(dataPath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read %s", f.Path))
+			return
+		}
+
+		results = append(results, storedResult(f.Path, f.Size, sum))
+	}
+
+	applyIgnoreRules(dataDir, results, req.Exclude)
+	storedCount, totalSize := storedTotals(results)
+	if storedCount == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"error":   "Every file of the session is ignored",
+			"files":   results,
+		})
+		return
+	}
+
+	st, err := s.newStage(req.CodebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+
+	// The session names its stage before the files move, so however far
+	// this gets, aborting the stage gives the files back
+	st.SessionID = sessionID
+	err = s.saveStage(st)
+	if err == nil {
+		session.Stage = st.ID
+		err = s.saveSession(session)
+	}
+	if err != nil {
+		log.Printf("Error staging session %s: %v", sessionID, err)
+		s.discardStage(st.ID)
+		respondWithError(w, http.StatusInternalServerError, "Failed to stage session files")
+		return
+	}
+
+	filesDir := s.stageFilesDir(st.ID)
+	if err := os.Remove(filesDir); err == nil {
+		err = os.Rename(dataDir, filesDir)
+	}
+	if err == nil {
+		err = s.recordStageFiles(st, results)
+	}
+	if err != nil {
+		log.Printf("Error staging session %s: %v", sessionID, err)
+		if err := s.restoreSession(session, st); err != nil {
+			log.Printf("Error restoring session %s from stage %s: %v", sessionID, st.ID, err)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to stage session files")
+		return
+	}
+
+	log.Printf("Staged session %s for codebase %s in stage %s: %d files, %d bytes", sessionID, req.CodebaseID, st.ID, storedCount, totalSize)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"stage_id": st.ID,
+		"files":    results,
+	})
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (s *StorageServer) deleteSession(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(sessionID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	unlock := lockID(sessionID)
+	defer unlock()
+
+	if _, err := os.Stat(s.sessionDir(sessionID)); os.IsNotExist(err) {
+		respondWithError(w, http.StatusNotFound, "Session not found")
+		return
+	}
+	if s.sessionStaged(sessionID) {
+		respondWithError(w, http.StatusConflict, "Session is being finalized")
+		return
+	}
+
+	if err := os.RemoveAll(s.sessionDir(sessionID)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete session")
+		return
+	}
+	idLocks.Delete(sessionID)
+
+	log.Printf("Aborted upload session %s", sessionID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// sessionStaged reports whether a session's files are in a stage that is
+// neither committed nor aborted yet. The caller must hold the session's
+// lock.
+func (s *StorageServer) sessionStaged(sessionID string) bool {
+	session, err := s.loadSession(sessionID)
+	if err != nil || session.Stage == "" {
+		return false
+	}
+	_, err = os.Stat(s.stageDir(session.Stage))
+	return err == nil
+}
+
+// restoreSession moves the files of an aborted stage back into the session
+// they came from and discards the stage. The caller must hold the session's
+// lock.
+func (s *StorageServer) restoreSession(session *uploadSession, st *stage) error {
+	dataDir := filepath.Join(s.sessionDir(session.ID), "data")
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		if err := os.Rename(s.stageFilesDir(st.ID), dataDir); err != nil {
+			return err
+		}
+	}
+	session.Stage = ""
+	if err := s.saveSession(session); err != nil {
+		return err
+	}
+	return s.discardStage(st.ID)
+}
+
+// releaseStage hands the files of a stage that is being aborted back to the
+// upload session they came from, if any, and discards the stage.
+func (s *StorageServer) releaseStage(st *stage) error {
+	if st.SessionID == "" {
+		return s.discardStage(st.ID)
+	}
+
+	unlock := lockID(st.SessionID)
+	defer unlock()
+
+	session, err := s.loadSession(st.SessionID)
+	if err != nil || session.Stage != st.ID {
+		// The session was reaped meanwhile
+		return s.discardStage(st.ID)
+	}
+	if err := s.restoreSession(session, st); err != nil {
+		return err
+	}
+	log.Printf("Returned the files of stage %s to upload session %s", st.ID, st.SessionID)
+	return nil
+}
+
+// finishSession removes the upload session a committed stage was made
+// from.
+func (s *StorageServer) finishSession(st *stage) {
+	if st.SessionID == "" {
+		return
+	}
+
+	unlock := lockID(st.SessionID)
+	defer unlock()
+
+	session, err := s.loadSession(st.SessionID)
+	if err != nil || session.Stage != st.ID {
+		return
+	}
+	if err := os.RemoveAll(s.sessionDir(st.SessionID)); err != nil {
+		log.Printf("Error removing finalized upload session %s: %v", st.SessionID, err)
+		return
+	}
+	idLocks.Delete(st.SessionID)
+}
+
+// reapSessions periodically removes upload sessions created more than ttl
+// ago, which their client has evidently abandoned. Sessions whose files are
+// in a stage are left for that stage's commit or abort.
+func (s *StorageServer) reapSessions(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := os.ReadDir(filepath.Join(s.baseStorageDir, ".sessions"))
+		if err != nil {
+			continue
+		}
+
+		cutoff := time.Now().Add(-ttl)
+		for _, entry := range entries {
+			if _, err := uuid.Parse(entry.Name()); err != nil || !entry.IsDir() {
+				continue
+			}
+
+			unlock := lockID(entry.Name())
+			if s.sessionExpired(entry, cutoff) && !s.sessionStaged(entry.Name()) {
+				if err := os.RemoveAll(s.sessionDir(entry.Name())); err != nil {
+					log.Printf("Error reaping upload session %s: %v", entry.Name(), err)
+				} else {
+					idLocks.Delete(entry.Name())
+					log.Printf("Reaped abandoned upload session %s", entry.Name())
+				}
+			}
+			unlock()
+		}
+	}
+}
+
+// sessionExpired reports whether the session in entry was created before
+// cutoff. Sessions without a readable state file, left by a crash while
+// being created, go by the directory's modification time.
+func (s *StorageServer) sessionExpired(entry os.DirEntry, cutoff time.Time) bool {
+	if session, err := s.loadSession(entry.Name()); err == nil {
+		return session.CreatedAt.Before(cutoff)
+	}
+	info, err := entry.Info()
+	return err == nil && info.ModTime().Before(cutoff)
+}
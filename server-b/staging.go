@@ -0,0 +1,549 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	stagePrepared   = "prepared"
+	stageCommitting = "committing"
+)
+
+// stage is a set of files written for a codebase but not yet visible in it.
+// Server A commits a stage once its metadata transaction has succeeded, or
+// aborts it. Only Server A knows whether a stage was committed in its
+// metadata, so it also aborts the stages nobody resolved.
+type stage struct {
+	ID         string               `json:"id"`
+	CodebaseID string               `json:"codebase_id"`
+	CreatedAt  time.Time            `json:"created_at"`
+	State      string               `json:"state"`
+	Files      map[string]treeEntry `json:"files,omitempty"`   // staged files by path
+	Deletes    []string             `json:"deletes,omitempty"` // paths removed from the codebase on commit
+
+	// DeleteCodebase removes the whole codebase on commit
+	DeleteCodebase bool `json:"delete_codebase,omitempty"`
+
+	// Revision, if set, makes the staged files the complete file set of a
+	// new revision of the codebase instead of changing the latest one
+	Revision int `json:"revision,omitempty"`
+
+	// Trees, if set, replaces the codebase with a copy imported from
+	// another node holding these revisions, the latest last. The staged
+	// files are then the copy's blobs, named by checksum
+	Trees []*codebaseTree `json:"trees,omitempty"`
+
+	// SessionID is the upload session the staged files came from, which
+	// gets them back if the stage is aborted
+	SessionID string `json:"session_id,omitempty"`
+}
+
+func (s *StorageServer) stagingDir() string {
+	return filepath.Join(s.baseStorageDir, ".staging")
+}
+
+func (s *StorageServer) stageDir(id string) string {
+	return filepath.Join(s.stagingDir(), id)
+}
+
+// stageFilesDir is where staged files live, laid out exactly as they will
+// be in the codebase directory.
+func (s *StorageServer) stageFilesDir(id string) string {
+	return filepath.Join(s.stageDir(id), "files")
+}
+
+func (s *StorageServer) committedMarker(id string) string {
+	return filepath.Join(s.stagingDir(), id+".committed")
+}
+
+// newStage creates an empty stage for codebaseID.
+func (s *StorageServer) newStage(codebaseID string) (*stage, error) {
+	st := &stage{
+		ID:         uuid.New().String(),
+		CodebaseID: codebaseID,
+		CreatedAt:  time.Now().UTC(),
+		State:      stagePrepared,
+	}
+
+	if err := os.MkdirAll(s.stageFilesDir(st.ID), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.saveStage(st); err != nil {
+		os.RemoveAll(s.stageDir(st.ID))
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *StorageServer) loadStage(id string) (*stage, error) {
+	data, err := os.ReadFile(filepath.Join(s.stageDir(id), "stage.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var st stage
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *StorageServer) saveStage(st *stage) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(s.stageDir(st.ID), "stage.json")
+	if err := os.WriteFile(statePath+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+// discardStage removes a stage and everything written into it.
+func (s *StorageServer) discardStage(id string) error {
+	return os.RemoveAll(s.stageDir(id))
+}
+
+// recordStageFiles saves the checksum, size, mode, modification time, MIME
+// type and language of every stored file in the stage, so committing never
+// has to read the files back. The stored results get the MIME type and
+// language as well.
+func (s *StorageServer) recordStageFiles(st *stage, results []FileResult) error {
+	st.Files = make(map[string]treeEntry)
+	for i, result := range results {
+		if result.Status != fileStored {
+			continue
+		}
+
+		name := filepath.Join(s.stageFilesDir(st.ID), filepath.FromSlash(result.Path))
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		mimeType, language, err := detectFile(name, result.Path)
+		if err != nil {
+			return err
+		}
+		results[i].MIMEType = mimeType
+		results[i].Language = language
+		st.Files[result.Path] = treeEntry{
+			SHA256:   result.SHA256,
+			Size:     result.Size,
+			Mode:     uint32(info.Mode().Perm()),
+			MTime:    info.ModTime().UTC(),
+			MIMEType: mimeType,
+			Language: language,
+		}
+	}
+	return s.saveStage(st)
+}
+
+// applyStage moves every staged file into the blob store and updates the
+// codebase tree, removing the stage's deleted paths and replacing files
+// already there, or deletes the codebase altogether. The stage is marked as
+// committing first so an interrupted commit is rolled forward on restart
+// instead of leaving the codebase half updated.
+func (s *StorageServer) applyStage(st *stage) (int, error) {
+	if st.State != stageCommitting {
+		st.State = stageCommitting
+		if err := s.saveStage(st); err != nil {
+			return 0, err
+		}
+	}
+
+	// Readers never see a partially applied stage
+	lock := codebaseLock(st.CodebaseID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if st.DeleteCodebase {
+		if err := s.deleteTree(st.CodebaseID); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	} else if st.Trees != nil {
+		if err := s.importTrees(st); err != nil {
+			return 0, err
+		}
+	} else if err := s.updateTree(st); err != nil {
+		return 0, err
+	}
+
+	if err := os.WriteFile(s.committedMarker(st.ID), []byte(st.CodebaseID), 0644); err != nil {
+		return 0, err
+	}
+	return len(st.Files), s.discardStage(st.ID)
+}
+
+// updateTree applies a stage's files and deletions to its codebase tree,
+// or replaces the tree with a new revision after keeping the current one.
+// Blobs are referenced as soon as they are stored, so a commit that fails
+// halfway can only leave references too high; they are recounted from the
+// trees on restart.
+func (s *StorageServer) updateTree(st *stage) error {
+	tree, err := s.loadTree(st.CodebaseID)
+	if os.IsNotExist(err) {
+		tree = &codebaseTree{ID: st.CodebaseID, Revision: st.Revision, Files: make(map[string]treeEntry)}
+		if s.keys.enabled() {
+			if err := s.keys.create(st.CodebaseID); err != nil {
+				return fmt.Errorf("create data key: %w", err)
+			}
+		}
+	} else if err != nil {
+		return err
+	} else if st.Revision > 0 {
+		if tree.revision() >= st.Revision {
+			// Applied before the commit was interrupted
+			return nil
+		}
+		// The kept revision holds on to the blob references of the tree
+		if err := s.saveRevision(tree); err != nil {
+			return err
+		}
+		tree = &codebaseTree{ID: st.CodebaseID, Revision: st.Revision, Files: make(map[string]treeEntry)}
+	}
+
+	if st.Files == nil {
+		// Staged by a version that did not record the files
+		if st.Files, err = scanStagedFiles(s.stageFilesDir(st.ID)); err != nil {
+			return err
+		}
+	}
+
+	// Compress and encrypt outside the blob lock; the stage directory
+	// keeps the results until the stage is discarded
+	filesDir := s.stageFilesDir(st.ID)
+	type preparedBlob struct{ name, path, encoding string }
+	prepared := make(map[string]preparedBlob, len(st.Files))
+	for path, entry := range st.Files {
+		name := s.blobName(st.CodebaseID, entry.SHA256)
+		src, encoding, err := s.blobs.prepare(filepath.Join(filesDir, filepath.FromSlash(path)), name, s.stageDir(st.ID))
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", path, err)
+		}
+		prepared[path] = preparedBlob{name, src, encoding}
+	}
+
+	s.blobs.mu.Lock()
+	defer s.blobs.mu.Unlock()
+
+	var released []string
+	for _, relativePath := range st.Deletes {
+		key := filepath.ToSlash(relativePath)
+		if old, ok := tree.Files[key]; ok {
+			released = append(released, s.blobName(st.CodebaseID, old.SHA256))
+			delete(tree.Files, key)
+		}
+	}
+
+	for path, entry := range st.Files {
+		blob := prepared[path]
+		if err := s.blobs.put(blob.path, blob.name, blob.encoding); err != nil {
+			return fmt.Errorf("store %s: %w", path, err)
+		}
+		s.blobs.acquire(blob.name)
+
+		if old, ok := tree.Files[path]; ok {
+			released = append(released, s.blobName(st.CodebaseID, old.SHA256))
+		}
+		tree.Files[path] = entry
+	}
+
+	if err := s.saveTree(tree); err != nil {
+		return err
+	}
+
+	for _, name := range released {
+		if err := s.blobs.release(name); err != nil {
+			log.Printf("Error releasing blob %s of codebase %s: %v", name, st.CodebaseID, err)
+		}
+	}
+	return nil
+}
+
+func scanStagedFiles(filesDir string) (map[string]treeEntry, error) {
+	files := make(map[string]treeEntry)
+	err := filepath.WalkDir(filesDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(filesDir, path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(relativePath)] = treeEntry{
+			SHA256: sum,
+			Size:   info.Size(),
+			Mode:   uint32(info.Mode().Perm()),
+			MTime:  info.ModTime().UTC(),
+		}
+		return nil
+	})
+	return files, err
+}
+
+type createStageRequest struct {
+	CodebaseID     string   `json:"codebase_id"`
+	Delete         []string `json:"delete"`
+	DeleteCodebase bool     `json:"delete_codebase"`
+}
+
+// createStage handles POST /stages, staging the removal of files from an
+// existing codebase or of the whole codebase. Like any stage it takes
+// effect when committed.
+func (s *StorageServer) createStage(w http.ResponseWriter, r *http.Request) {
+	var req createStageRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxManifestSize)).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid stage request")
+		return
+	}
+
+	if _, err := uuid.Parse(req.CodebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	if len(req.Delete) == 0 && !req.DeleteCodebase {
+		respondWithError(w, http.StatusBadRequest, "No files to delete")
+		return
+	}
+
+	deletes := make([]string, 0, len(req.Delete))
+	for _, path := range req.Delete {
+		relativePath, ok := cleanRelativePath(path)
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid file path: %s", path))
+			return
+		}
+		deletes = append(deletes, relativePath)
+	}
+
+	st, err := s.newStage(req.CodebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+	st.Deletes = deletes
+	st.DeleteCodebase = req.DeleteCodebase
+	if err := s.saveStage(st); err != nil {
+		s.discardStage(st.ID)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"stage_id": st.ID,
+	})
+}
+
+func (s *StorageServer) commitStage(w http.ResponseWriter, r *http.Request) {
+	stageID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(stageID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid stage ID")
+		return
+	}
+
+	unlock := lockID(stageID)
+	defer unlock()
+
+	st, err := s.loadStage(stageID)
+	if os.IsNotExist(err) {
+		// A retried commit whose first attempt succeeded
+		if _, err := os.Stat(s.committedMarker(stageID)); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"message": "Stage already committed",
+			})
+			return
+		}
+		respondWithError(w, http.StatusNotFound, "Stage not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to load stage")
+		return
+	}
+
+	moved, err := s.applyStage(st)
+	if err != nil {
+		log.Printf("Error committing stage %s for codebase %s: %v", stageID, st.CodebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to commit stage")
+		return
+	}
+
+	message := fmt.Sprintf("Committed %d files, removed %d", moved, len(st.Deletes))
+	if st.DeleteCodebase {
+		message = "Deleted codebase"
+	} else if st.Trees != nil {
+		message = fmt.Sprintf("Imported codebase with %d revisions", len(st.Trees))
+	}
+	if !st.DeleteCodebase {
+		s.updateIndex(st.CodebaseID)
+	}
+	s.finishSession(st)
+	log.Printf("Committed stage %s into codebase %s: %s", stageID, st.CodebaseID, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": message,
+	})
+}
+
+func (s *StorageServer) abortStage(w http.ResponseWriter, r *http.Request) {
+	stageID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(stageID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid stage ID")
+		return
+	}
+
+	unlock := lockID(stageID)
+	defer unlock()
+
+	st, err := s.loadStage(stageID)
+	if os.IsNotExist(err) {
+		respondWithError(w, http.StatusNotFound, "Stage not found")
+		return
+	}
+	if err == nil && st.State == stageCommitting {
+		respondWithError(w, http.StatusConflict, "Stage is already being committed")
+		return
+	}
+
+	if err == nil {
+		err = s.releaseStage(st)
+	} else {
+		err = s.discardStage(stageID)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to abort stage")
+		return
+	}
+
+	log.Printf("Aborted stage %s", stageID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+	})
+}
+
+// recoverStages finishes commits that were interrupted by a restart.
+func (s *StorageServer) recoverStages() {
+	entries, err := os.ReadDir(s.stagingDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		st, err := s.loadStage(entry.Name())
+		if err != nil || st.State != stageCommitting {
+			continue
+		}
+
+		moved, err := s.applyStage(st)
+		if err != nil {
+			log.Printf("Error recovering stage %s: %v", st.ID, err)
+			continue
+		}
+		s.finishSession(st)
+		log.Printf("Recovered interrupted commit of stage %s into codebase %s: %d files", st.ID, st.CodebaseID, moved)
+	}
+}
+
+// listStages handles GET /stages, listing the prepared stages so Server A
+// can abort those its metadata never committed.
+func (s *StorageServer) listStages(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(s.stagingDir())
+	if err != nil && !os.IsNotExist(err) {
+		respondWithError(w, http.StatusInternalServerError, "Failed to list stages")
+		return
+	}
+
+	type stageInfo struct {
+		ID         string    `json:"id"`
+		CodebaseID string    `json:"codebase_id"`
+		CreatedAt  time.Time `json:"created_at"`
+	}
+	stages := []stageInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		st, err := s.loadStage(entry.Name())
+		if err != nil || st.State != stagePrepared {
+			continue
+		}
+		stages = append(stages, stageInfo{ID: st.ID, CodebaseID: st.CodebaseID, CreatedAt: st.CreatedAt})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"stages":  stages,
+	})
+}
+
+// reapStages periodically removes stages that never finished being
+// created, along with commit markers that no retry will ask about any more.
+// Prepared stages are left for Server A to commit or abort, as Server A may
+// have committed them in its metadata however old they are.
+func (s *StorageServer) reapStages(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		entries, err := os.ReadDir(s.stagingDir())
+		if err != nil {
+			continue
+		}
+
+		cutoff := time.Now().Add(-timeout)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			if !entry.IsDir() {
+				os.Remove(filepath.Join(s.stagingDir(), entry.Name()))
+				continue
+			}
+
+			unlock := lockID(entry.Name())
+			if _, err := s.loadStage(entry.Name()); err != nil && os.IsNotExist(err) {
+				s.discardStage(entry.Name())
+				log.Printf("Reaped unfinished stage %s", entry.Name())
+			}
+			unlock()
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Codebases move between storage nodes as tar streams holding the content
+// of every blob the codebase refers to, decrypted and decompressed, as
+// blobs/<sha256>, followed by the tree of every revision as
+// trees/<revision>.json, the latest last. The receiving node encodes the
+// blobs as it is configured to, with a data key of its own.
+const (
+	exportBlobsDir = "blobs/"
+	exportTreesDir = "trees/"
+)
+
+var errInvalidExport = errors.New("invalid codebase export")
+
+// exportCodebase handles GET /export/{id}, streaming a codebase with all
+// its revisions to another storage node. Given rev, it only streams that
+// revision, or the latest if rev is empty, for a node that diffs against
+// it. Commits to the codebase wait until the export is done.
+func (s *StorageServer) exportCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	lock := codebaseLock(codebaseID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	query := r.URL.Query()
+	tree, err := s.loadRevision(codebaseID, query.Get("rev"))
+	if err != nil {
+		respondWithTreeError(w, err, "Codebase not found")
+		return
+	}
+	trees := []*codebaseTree{tree}
+	if !query.Has("rev") {
+		revisions, err := s.revisionTrees(codebaseID)
+		if err != nil {
+			log.Printf("Error reading revisions of codebase %s: %v", codebaseID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to read codebase")
+			return
+		}
+		sort.Slice(revisions, func(i, j int) bool { return revisions[i].revision() < revisions[j].revision() })
+		trees = append(revisions, tree)
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := s.writeExport(w, codebaseID, trees); err != nil {
+		if errors.Is(err, errBlobCorrupt) {
+			log.Printf("ERROR: export of codebase %s aborted, a stored file is corrupt: %v", codebaseID, err)
+		} else {
+			log.Printf("Error exporting codebase %s: %v", codebaseID, err)
+		}
+		// The truncated stream fails the import on the other end
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Printf("Exported codebase %s: %d revisions", codebaseID, len(trees))
+}
+
+func (s *StorageServer) writeExport(w io.Writer, codebaseID string, trees []*codebaseTree) error {
+	tw := tar.NewWriter(w)
+
+	written := make(map[string]bool)
+	for _, tree := range trees {
+		for _, path := range tree.sortedPaths() {
+			entry := tree.Files[path]
+			if written[entry.SHA256] {
+				continue
+			}
+			written[entry.SHA256] = true
+
+			header := &tar.Header{
+				Name:     exportBlobsDir + entry.SHA256,
+				Mode:     0644,
+				Size:     entry.Size,
+				Typeflag: tar.TypeReg,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if err := s.copyBlob(tw, codebaseID, entry); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	for _, tree := range trees {
+		data, err := json.Marshal(tree)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:     exportTreesDir + strconv.Itoa(tree.revision()) + ".json",
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// importCodebase handles POST /import/{id}, staging a copy of a codebase
+// exported by another storage node. Committing the stage replaces whatever
+// this node holds of the codebase with the copy.
+func (s *StorageServer) importCodebase(w http.ResponseWriter, r *http.Request) {
+	codebaseID := mux.Vars(r)["id"]
+	if _, err := uuid.Parse(codebaseID); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid codebase ID")
+		return
+	}
+
+	st, err := s.newStage(codebaseID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+
+	trees, err := receiveExport(s.stageFilesDir(st.ID), codebaseID, r.Body)
+	if err == nil {
+		st.Trees = trees
+		err = s.saveStage(st)
+	}
+	if err != nil {
+		s.discardStage(st.ID)
+		if errors.Is(err, errInvalidExport) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("Error importing codebase %s: %v", codebaseID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to import codebase")
+		return
+	}
+
+	latest := trees[len(trees)-1]
+	files := []FileResult{}
+	for _, path := range latest.sortedPaths() {
+		files = append(files, storedResult(path, latest.Files[path].Size, latest.Files[path].SHA256))
+	}
+
+	log.Printf("Staged import of codebase %s as stage %s: %d revisions", codebaseID, st.ID, len(trees))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"stage_id": st.ID,
+		"revision": latest.revision(),
+		"files":    files,
+	})
+}
+
+// receiveExport reads an export of codebaseID into dir, verifying every
+// blob against its checksum and every tree against the blobs, and returns
+// the trees in revision order.
+func receiveExport(dir, codebaseID string, body io.Reader) ([]*codebaseTree, error) {
+	blobs := make(map[string]int64)
+	var trees []*codebaseTree
+
+	tr := tar.NewReader(body)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidExport, err)
+		}
+
+		switch name := header.Name; {
+		case strings.HasPrefix(name, exportBlobsDir):
+			sum := strings.TrimPrefix(name, exportBlobsDir)
+			if !validSum(sum) {
+				return nil, fmt.Errorf("%w: bad blob name %q", errInvalidExport, name)
+			}
+			size, err := receiveBlob(dir, sum, tr)
+			if err != nil {
+				return nil, err
+			}
+			blobs[sum] = size
+		case strings.HasPrefix(name, exportTreesDir):
+			data, err := io.ReadAll(io.LimitReader(tr, MaxManifestSize+1))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidExport, err)
+			}
+			if len(data) > MaxManifestSize {
+				return nil, fmt.Errorf("%w: tree %s too large", errInvalidExport, name)
+			}
+			tree, err := decodeTree(data)
+			if err != nil || tree.ID != codebaseID {
+				return nil, fmt.Errorf("%w: bad tree %s", errInvalidExport, name)
+			}
+			trees = append(trees, tree)
+		default:
+			return nil, fmt.Errorf("%w: unexpected entry %q", errInvalidExport, name)
+		}
+	}
+
+	if len(trees) == 0 {
+		return nil, fmt.Errorf("%w: no trees", errInvalidExport)
+	}
+	for i, tree := range trees {
+		if i > 0 && tree.revision() <= trees[i-1].revision() {
+			return nil, fmt.Errorf("%w: revisions out of order", errInvalidExport)
+		}
+		for path, entry := range tree.Files {
+			if clean, ok := cleanRelativePath(path); !ok || filepath.ToSlash(clean) != path {
+				return nil, fmt.Errorf("%w: invalid file path %q", errInvalidExport, path)
+			}
+			if size, ok := blobs[entry.SHA256]; !ok || size != entry.Size {
+				return nil, fmt.Errorf("%w: content of %s in revision %d is missing", errInvalidExport, path, tree.revision())
+			}
+		}
+	}
+	return trees, nil
+}
+
+// receiveBlob writes one blob of an export to dir as <sha256> and returns
+// its size.
+func receiveBlob(dir, sum string, r io.Reader) (int64, error) {
+	dst, err := os.Create(filepath.Join(dir, sum))
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hasher), r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidExport, err)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != sum {
+		return 0, fmt.Errorf("%w: blob %s does not match its checksum", errInvalidExport, sum)
+	}
+	return size, dst.Close()
+}
+
+// peerClient fetches exports from other storage nodes. A node that
+// accepts no connection, or does not start answering within a minute, is
+// given up on; the export itself streams for as long as it needs.
+var peerClient = newHTTPClient(time.Minute)
+
+// newHTTPClient returns a client that gives up on a server that takes more
+// than 10s to connect to, or more than responseTimeout to start answering
+// a request it has received. Bodies are not bounded, as they may be large.
+func newHTTPClient(responseTimeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: responseTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}
+}
+
+// peerError is an error response from another storage node.
+type peerError struct {
+	Status  int
+	Message string
+}
+
+func (e *peerError) Error() string {
+	return fmt.Sprintf("storage node answered %d: %s", e.Status, e.Message)
+}
+
+// fetchRevision copies a revision of a codebase held by other storage
+// nodes, trying each of nodes in turn, and returns its tree. The files are
+// written to dir named by checksum. A client error from a node, such as an
+// unknown codebase or revision, is returned as a *peerError.
+func fetchRevision(ctx context.Context, nodes []string, codebaseID, rev, dir string) (*codebaseTree, error) {
+	target := fmt.Sprintf("/export/%s?%s", codebaseID, url.Values{"rev": {rev}}.Encode())
+	err := errors.New("no storage node to fetch from")
+	for _, node := range nodes {
+		var tree *codebaseTree
+		if tree, err = fetchExportedRevision(ctx, strings.TrimSuffix(node, "/")+target, codebaseID, dir); err == nil {
+			return tree, nil
+		}
+		var pe *peerError
+		if (errors.As(err, &pe) && pe.Status < 500) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("Error fetching codebase %s from %s: %v", codebaseID, node, err)
+	}
+	return nil, err
+}
+
+func fetchExportedRevision(ctx context.Context, url, codebaseID, dir string) (*codebaseTree, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+		return nil, &peerError{Status: resp.StatusCode, Message: body.Error}
+	}
+
+	trees, err := receiveExport(dir, codebaseID, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return trees[len(trees)-1], nil
+}
+
+// importTrees replaces a codebase with the revisions staged by an import.
+// The caller must hold the codebase write lock. The latest tree is saved
+// last, so a commit interrupted before then is simply redone, and one
+// interrupted after then is already complete.
+func (s *StorageServer) importTrees(st *stage) error {
+	latest := st.Trees[len(st.Trees)-1]
+	tree, err := s.loadTree(st.CodebaseID)
+	switch {
+	case err == nil && sameTree(tree, latest):
+		return nil
+	case err == nil:
+		// A copy left by an earlier move, outdated by now
+		if err := s.deleteTree(st.CodebaseID); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if s.keys.enabled() {
+		if err := s.keys.create(st.CodebaseID); err != nil {
+			return fmt.Errorf("create data key: %w", err)
+		}
+	}
+
+	// Encode outside the blob lock, as updateTree does
+	filesDir := s.stageFilesDir(st.ID)
+	type preparedBlob struct{ name, path, encoding string }
+	prepared := make(map[string]preparedBlob)
+	for _, t := range st.Trees {
+		for _, entry := range t.Files {
+			if _, ok := prepared[entry.SHA256]; ok {
+				continue
+			}
+			name := s.blobName(st.CodebaseID, entry.SHA256)
+			src, encoding, err := s.blobs.prepare(filepath.Join(filesDir, entry.SHA256), name, s.stageDir(st.ID))
+			if err != nil {
+				return fmt.Errorf("encode blob %s: %w", entry.SHA256, err)
+			}
+			prepared[entry.SHA256] = preparedBlob{name, src, encoding}
+		}
+	}
+
+	s.blobs.mu.Lock()
+	defer s.blobs.mu.Unlock()
+
+	for sum, blob := range prepared {
+		if err := s.blobs.put(blob.path, blob.name, blob.encoding); err != nil {
+			return fmt.Errorf("store blob %s: %w", sum, err)
+		}
+	}
+	for _, t := range st.Trees {
+		for _, entry := range t.Files {
+			s.blobs.acquire(prepared[entry.SHA256].name)
+		}
+	}
+
+	for _, t := range st.Trees[:len(st.Trees)-1] {
+		if err := s.saveRevision(t); err != nil {
+			return err
+		}
+	}
+	return s.saveTree(latest)
+}
+
+// sameTree reports whether two trees are the same revision with the same
+// files.
+func sameTree(a, b *codebaseTree) bool {
+	if a.revision() != b.revision() || len(a.Files) != len(b.Files) {
+		return false
+	}
+	for path, entry := range a.Files {
+		other, ok := b.Files[path]
+		if !ok || other.SHA256 != entry.SHA256 || other.Size != entry.Size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// treeEntry records one file of a codebase and the blob holding its body.
+type treeEntry struct {
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Mode     uint32    `json:"mode"`
+	MTime    time.Time `json:"mtime"`
+	MIMEType string    `json:"mime_type,omitempty"`
+	Language string    `json:"language,omitempty"`
+}
+
+// codebaseTree maps the slash separated paths of a codebase's files to
+// their blobs. The latest revision of a codebase lives in .trees/<id>.json
+// and is only ever replaced whole, so readers see either the old or the new
+// version. Earlier revisions are kept unchanged in .revisions/<id>/<n>.json.
+// Trees of encrypted codebases are sealed with the codebase's data key like
+// its blobs, as they list every path and checksum.
+type codebaseTree struct {
+	ID       string               `json:"directory_id"`
+	Revision int                  `json:"revision,omitempty"`
+	Files    map[string]treeEntry `json:"files"`
+}
+
+var (
+	errInvalidRevision  = errors.New("invalid revision")
+	errRevisionNotFound = errors.New("revision not found")
+)
+
+// revision returns the revision number of the tree; trees written before
+// codebases had revisions are revision 1.
+func (t *codebaseTree) revision() int {
+	if t.Revision < 1 {
+		return 1
+	}
+	return t.Revision
+}
+
+const treesPrefix = ".trees/"
+
+func treeKey(id string) string {
+	return treesPrefix + id + ".json"
+}
+
+func revisionsPrefix(id string) string {
+	return ".revisions/" + id + "/"
+}
+
+func revisionKey(id string, revision int) string {
+	return revisionsPrefix(id) + strconv.Itoa(revision) + ".json"
+}
+
+// loadTree reads the tree of a codebase. It returns an os.IsNotExist error
+// if there is no such codebase.
+func (s *StorageServer) loadTree(id string) (*codebaseTree, error) {
+	return s.readTree(id, treeKey(id))
+}
+
+// readTree reads the tree object key of codebase id, opening it with the
+// codebase's data key if it is sealed. Trees of encrypted codebases that
+// are not sealed yet, because encrypt-codebases was interrupted, are read
+// as they are.
+func (s *StorageServer) readTree(id, key string) (*codebaseTree, error) {
+	data, err := readObject(s.backend, key)
+	if err != nil {
+		return nil, err
+	}
+	if sealedTree(data) {
+		aead, err := s.keys.aead(id)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newDecryptReader(bytes.NewReader(data), aead, key)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return decodeTree(data)
+}
+
+func sealedTree(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptionMagic))
+}
+
+func decodeTree(data []byte) (*codebaseTree, error) {
+	var tree codebaseTree
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	if tree.Files == nil {
+		tree.Files = make(map[string]treeEntry)
+	}
+	return &tree, nil
+}
+
+// loadRevision reads the tree of the given revision of a codebase, or of
+// its latest revision if rev is empty. It returns an os.IsNotExist error if
+// there is no such codebase, errRevisionNotFound if the codebase has no
+// such revision and errInvalidRevision if rev is not a revision number.
+func (s *StorageServer) loadRevision(id, rev string) (*codebaseTree, error) {
+	tree, err := s.loadTree(id)
+	if err != nil || rev == "" {
+		return tree, err
+	}
+
+	revision, err := strconv.Atoi(rev)
+	if err != nil || revision < 1 {
+		return nil, errInvalidRevision
+	}
+	if revision == tree.revision() {
+		return tree, nil
+	}
+
+	tree, err = s.readTree(id, revisionKey(id, revision))
+	if os.IsNotExist(err) {
+		return nil, errRevisionNotFound
+	}
+	return tree, err
+}
+
+// respondWithTreeError reports why loadRevision failed, using notFound as
+// the message if the codebase does not exist.
+func respondWithTreeError(w http.ResponseWriter, err error, notFound string) {
+	switch {
+	case os.IsNotExist(err):
+		respondWithError(w, http.StatusNotFound, notFound)
+	case errors.Is(err, errInvalidRevision):
+		respondWithError(w, http.StatusBadRequest, "Invalid revision")
+	case errors.Is(err, errRevisionNotFound):
+		respondWithError(w, http.StatusNotFound, "Revision not found")
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Failed to read codebase")
+	}
+}
+
+// revisionTrees returns the trees of every earlier revision of a codebase.
+func (s *StorageServer) revisionTrees(id string) ([]*codebaseTree, error) {
+	objects, err := s.backend.List(revisionsPrefix(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var trees []*codebaseTree
+	for _, object := range objects {
+		if path.Ext(object.Key) != ".json" {
+			continue
+		}
+		tree, err := s.readTree(id, object.Key)
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", object.Key, err)
+		}
+		trees = append(trees, tree)
+	}
+	return trees, nil
+}
+
+func (s *StorageServer) saveTree(tree *codebaseTree) error {
+	return s.writeTree(treeKey(tree.ID), tree)
+}
+
+// saveRevision keeps tree as an earlier revision of its codebase.
+func (s *StorageServer) saveRevision(tree *codebaseTree) error {
+	return s.writeTree(revisionKey(tree.ID, tree.revision()), tree)
+}
+
+// writeTree stores tree as object key, sealed with the data key of an
+// encrypted codebase. The object key is authenticated with the tree, so a
+// sealed tree cannot be passed off as another revision or codebase.
+func (s *StorageServer) writeTree(key string, tree *codebaseTree) error {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	if !s.keys.encrypted(tree.ID) {
+		return writeObject(s.backend, key, data)
+	}
+
+	aead, err := s.keys.aead(tree.ID)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc, err := newEncryptWriter(&buf, aead, key)
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(data); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return writeObject(s.backend, key, buf.Bytes())
+}
+
+// sealTrees rewrites the trees of an encrypted codebase that are still
+// stored in plain.
+func (s *StorageServer) sealTrees(id string) error {
+	objects, err := s.backend.List(revisionsPrefix(id))
+	if err != nil {
+		return err
+	}
+	keys := []string{treeKey(id)}
+	for _, object := range objects {
+		if path.Ext(object.Key) == ".json" {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	for _, key := range keys {
+		data, err := readObject(s.backend, key)
+		if err != nil {
+			return err
+		}
+		if sealedTree(data) {
+			continue
+		}
+		tree, err := decodeTree(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if err := s.writeTree(key, tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// codebaseIDs lists every codebase that has a tree.
+func (s *StorageServer) codebaseIDs() ([]string, error) {
+	objects, err := s.backend.List(treesPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, object := range objects {
+		name := path.Base(object.Key)
+		id := strings.TrimSuffix(name, ".json")
+		if id == name {
+			continue
+		}
+		if _, err := uuid.Parse(id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// deleteTree removes a codebase with all its revisions and releases their
+// blobs. The caller must hold the codebase write lock.
+func (s *StorageServer) deleteTree(id string) error {
+	tree, err := s.loadTree(id)
+	if err != nil {
+		return err
+	}
+	revisions, err := s.revisionTrees(id)
+	if err != nil {
+		return err
+	}
+	// Indexes and earlier revisions go first, as they are only found
+	// through the tree
+	if err := s.deleteIndexes(id); err != nil {
+		return err
+	}
+	for _, t := range revisions {
+		if err := s.backend.Delete(revisionKey(id, t.revision())); err != nil {
+			return err
+		}
+	}
+	if err := s.backend.Delete(treeKey(id)); err != nil {
+		return err
+	}
+
+	s.blobs.mu.Lock()
+	for _, t := range append(revisions, tree) {
+		for _, entry := range t.Files {
+			name := s.blobName(id, entry.SHA256)
+			if err := s.blobs.release(name); err != nil {
+				log.Printf("Error releasing blob %s of codebase %s: %v", name, id, err)
+			}
+		}
+	}
+	s.blobs.mu.Unlock()
+
+	// Without its key, whatever is left of the codebase is unreadable
+	return s.keys.remove(id)
+}
+
+// lookup returns the entry stored at path, which may use either separator.
+func (t *codebaseTree) lookup(path string) (treeEntry, bool) {
+	entry, ok := t.Files[filepath.ToSlash(path)]
+	return entry, ok
+}
+
+// isDir reports whether path is a directory containing files of the tree.
+func (t *codebaseTree) isDir(path string) bool {
+	prefix := filepath.ToSlash(path) + "/"
+	for p := range t.Files {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *codebaseTree) sortedPaths() []string {
+	paths := make([]string, 0, len(t.Files))
+	for p := range t.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// migrateCodebaseDirs imports codebases stored as plain directories by
+// earlier versions into the blob store. A directory is only removed once
+// its tree is saved, so an interrupted migration is simply redone.
+func (s *StorageServer) migrateCodebaseDirs() error {
+	entries, err := os.ReadDir(s.baseStorageDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(entry.Name()); err != nil {
+			continue
+		}
+
+		dir := filepath.Join(s.baseStorageDir, entry.Name())
+		if _, err := s.backend.Stat(treeKey(entry.Name())); err == nil {
+			// Migrated before, but not yet cleaned up
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tree := &codebaseTree{ID: entry.Name(), Files: make(map[string]treeEntry)}
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			sum, err := hashFile(path)
+			if err != nil {
+				return err
+			}
+			if err := s.blobs.link(path, sum); err != nil {
+				return err
+			}
+
+			relativePath, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			tree.Files[filepath.ToSlash(relativePath)] = treeEntry{
+				SHA256: sum,
+				Size:   info.Size(),
+				Mode:   uint32(info.Mode().Perm()),
+				MTime:  info.ModTime().UTC(),
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := s.saveTree(tree); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		log.Printf("Migrated codebase %s into the blob store: %d files", tree.ID, len(tree.Files))
+	}
+	return nil
+}
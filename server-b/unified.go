@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around changes
+	diffContext = 3
+	// maxDiffEdits bounds the work spent on a single file; files that
+	// differ more are shown as removed and added whole
+	maxDiffEdits = 2000
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// splitLines splits text into lines that keep their trailing newline, so a
+// missing newline at the end of a file counts as a change.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the edits turning a into b.
+func diffLines(a, b []string) []diffOp {
+	// Common prefix and suffix need no search
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	middle, ok := myersDiff(middleA, middleB, maxDiffEdits)
+	if !ok {
+		middle = middle[:0]
+		for _, line := range middleA {
+			middle = append(middle, diffOp{'-', line})
+		}
+		for _, line := range middleB {
+			middle = append(middle, diffOp{'+', line})
+		}
+	}
+	ops = append(ops, middle...)
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// myersDiff finds a shortest edit script with Myers' O(ND) algorithm. It
+// gives up and returns false if more than maxEdits edits are needed.
+func myersDiff(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k; trace keeps the
+	// part of v in use after each step for backtracking
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	found := -1
+
+	for d := 0; d <= limit && found < 0; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	if found < 0 {
+		return nil, false
+	}
+
+	// Walk back from the end, collecting the edits in reverse
+	var reversed []diffOp
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if prevK == k+1 {
+			reversed = append(reversed, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			reversed = append(reversed, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		reversed = append(reversed, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(ops)-1-i] = op
+	}
+	return ops, true
+}
+
+// unifiedDiff formats the differences between two texts as a unified diff
+// with the given file names, or returns "" if they are equal.
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+
+	// Unchanged lines within diffContext of a change are shown; runs of
+	// shown lines form the hunks
+	shown := make([]bool, len(ops))
+	last := -diffContext - 1
+	for i, op := range ops {
+		if op.kind != ' ' {
+			last = i
+		}
+		shown[i] = i-last <= diffContext
+	}
+	last = len(ops) + diffContext + 1
+	changed := false
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].kind != ' ' {
+			last = i
+			changed = true
+		}
+		shown[i] = shown[i] || last-i <= diffContext
+	}
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(ops); {
+		if !shown[i] {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		start := i
+		oldStart, newStart := oldLine, newLine
+		for i < len(ops) && shown[i] {
+			if ops[i].kind != '+' {
+				oldLine++
+			}
+			if ops[i].kind != '-' {
+				newLine++
+			}
+			i++
+		}
+
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLine-oldStart), hunkRange(newStart, newLine-newStart))
+		for _, op := range ops[start:i] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// hunkRange formats the zero-based start and length of a hunk side.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
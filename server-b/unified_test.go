@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// numbered returns lines 1 to n, with the given lines replaced.
+func numbered(n int, replaced map[int]string) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		if line, ok := replaced[i]; ok {
+			sb.WriteString(line + "\n")
+			continue
+		}
+		fmt.Fprintf(&sb, "%d\n", i)
+	}
+	return sb.String()
+}
+
+// The expected diffs are those of GNU diff -u.
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"both empty", "", "", ""},
+		{"added", "", "a\nb\n", "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed", "a\nb\n", "", "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"added without newline", "", "x", "@@ -0,0 +1 @@\n+x\n\\ No newline at end of file\n"},
+		{
+			"newline added", "a\nb", "a\nb\n",
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			"newline removed", "a\nb\n", "a\nb",
+			"@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+		{
+			"last line changed without newline", "a\nb", "a\nc",
+			"@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			"context at the edges", numbered(10, nil), numbered(10, map[int]string{1: "one", 10: "ten"}),
+			"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			// Six unchanged lines between changes join their hunks, seven
+			// split them
+			"hunks merged", numbered(20, nil), numbered(20, map[int]string{3: "three", 10: "ten", 18: "eighteen"}),
+			"@@ -1,13 +1,13 @@\n 1\n 2\n-3\n+three\n 4\n 5\n 6\n 7\n 8\n 9\n-10\n+ten\n 11\n 12\n 13\n" +
+				"@@ -15,6 +15,6 @@\n 15\n 16\n 17\n-18\n+eighteen\n 19\n 20\n",
+		},
+		{
+			"lines inserted", "a\nb\nc\n", "a\nx\nb\ny\nc\n",
+			"@@ -1,3 +1,5 @@\n a\n+x\n b\n+y\n c\n",
+		},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if want != "" {
+			want = "--- a/f\n+++ b/f\n" + want
+		}
+		if got := unifiedDiff("a/f", "b/f", tt.old, tt.new); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func TestUnifiedDiffTooManyEdits(t *testing.T) {
+	// Every other line differs: past maxDiffEdits the lines in between are
+	// no longer matched, and the rest of the file shows as replaced whole
+	pairs := maxDiffEdits/2 + 100
+	var old, new, want strings.Builder
+	var removed, added strings.Builder
+	for i := 0; i < pairs; i++ {
+		fmt.Fprintf(&old, "same %d\nold %d\n", i, i)
+		fmt.Fprintf(&new, "same %d\nnew %d\n", i, i)
+		if i > 0 {
+			fmt.Fprintf(&removed, "-same %d\n", i)
+			fmt.Fprintf(&added, "+same %d\n", i)
+		}
+		fmt.Fprintf(&removed, "-old %d\n", i)
+		fmt.Fprintf(&added, "+new %d\n", i)
+	}
+	fmt.Fprintf(&want, "--- a/f\n+++ b/f\n@@ -1,%d +1,%d @@\n same 0\n", 2*pairs, 2*pairs)
+	want.WriteString(removed.String())
+	want.WriteString(added.String())
+
+	if got := unifiedDiff("a/f", "b/f", old.String(), new.String()); got != want.String() {
+		t.Errorf("got %d bytes starting\n%.200s\nwant %d bytes starting\n%.200s", len(got), got, want.Len(), want.String())
+	}
+
+	// Within the bound the common lines are kept
+	a, b := splitLines(old.String()), splitLines(new.String())
+	if _, ok := myersDiff(a, b, 2*pairs); !ok {
+		t.Errorf("myersDiff with %d edits allowed gave up", 2*pairs)
+	}
+	if _, ok := myersDiff(a, b, 2*pairs-1); ok {
+		t.Errorf("myersDiff with %d edits allowed succeeded", 2*pairs-1)
+	}
+}
+
+// TestMyersDiff checks on random texts that the edits turn one into the
+// other and are as few as the longest common subsequence allows.
+func TestMyersDiff(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func() []string {
+		lines := make([]string, rng.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(3)))
+		}
+		return lines
+	}
+
+	for i := 0; i < 2000; i++ {
+		a, b := random(), random()
+		ops, ok := myersDiff(a, b, len(a)+len(b))
+		if !ok {
+			t.Fatalf("myersDiff(%q, %q) gave up", a, b)
+		}
+
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("myersDiff(%q, %q) = %v, which does not turn one into the other", a, b, ops)
+		}
+		if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+			t.Fatalf("myersDiff(%q, %q) made %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+	return lengths[0][0]
+}